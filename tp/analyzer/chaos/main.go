@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"analyzer/comms/chaos"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("log")
+
+func configLog(logLevel logging.Level) {
+	backend := logging.NewLogBackend(os.Stderr, "", 0)
+	format := logging.MustStringFormatter(`%{time:2006-01-02 15:04:05}	%{level:.4s}	%{message}`)
+	backendFormatter := logging.NewBackendFormatter(backend, format)
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	backendLeveled.SetLevel(logLevel, "log")
+	logging.SetBackend(backendLeveled)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <scenario>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [flags] -record\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Runs the system under the faults of the scenario and checks the results against the golden ones.")
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
+
+func report(run *Run, diffs []string) {
+	fmt.Printf("\n== %s ==\n", run.Name)
+	fmt.Println("Injected faults:")
+	for _, fired := range run.Fired {
+		fmt.Printf("  %s\n", fired)
+	}
+
+	if len(diffs) == 0 {
+		fmt.Println("Results are correct")
+		return
+	}
+
+	fmt.Println("Results differ:")
+	for _, diff := range diffs {
+		fmt.Printf("  %s\n", diff)
+	}
+}
+
+func main() {
+	dir := flag.String("dir", ".", "directory with the compose files")
+	goldenDir := flag.String("golden", "golden", "directory with the expected results of a client")
+	outDir := flag.String("out", ".chaos", "directory where the logs and results of each run are kept")
+	timeout := flag.Duration("timeout", 30*time.Minute, "time a run has to finish")
+	isolate := flag.Bool("isolate", true, "run each fault on its own when the scenario breaks the results")
+	record := flag.Bool("record", false, "run without faults and keep the results as the golden ones")
+	flag.Usage = usage
+	flag.Parse()
+	configLog(logging.INFO)
+
+	runner, err := NewRunner(*dir, *outDir, *timeout)
+	if err != nil {
+		log.Fatalf("couldn't create the runner: %v", err)
+	}
+
+	if *record {
+		run, err := runner.Run("golden", nil)
+		if err != nil {
+			log.Fatalf("failed to run without faults: %v", err)
+		}
+		if err := recordGolden(run.ResultsDir, *goldenDir); err != nil {
+			log.Fatalf("failed to record the golden results: %v", err)
+		}
+		log.Infof("Recorded the golden results in %s", *goldenDir)
+		return
+	}
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	rules, err := chaos.LoadScenario(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("couldn't load the scenario: %v", err)
+	}
+
+	check := func(name string, rules []chaos.Rule) bool {
+		// A run that doesn't finish broke the results as much as one with wrong ones
+		run, err := runner.Run(name, rules)
+		if err != nil {
+			log.Errorf("failed run %s: %v", name, err)
+			if run == nil {
+				run = &Run{Name: name}
+			}
+			report(run, []string{err.Error()})
+			return false
+		}
+
+		diffs, err := compareResults(*goldenDir, run.ResultsDir)
+		if err != nil {
+			log.Fatalf("couldn't compare the results of %s: %v", name, err)
+		}
+
+		report(run, diffs)
+		return len(diffs) == 0
+	}
+
+	if check("scenario", rules) {
+		return
+	}
+
+	if *isolate && len(rules) > 1 {
+		culprits := make([]chaos.Rule, 0)
+		for _, rule := range rules {
+			if !check(fmt.Sprintf("line-%d", rule.Line), []chaos.Rule{rule}) {
+				culprits = append(culprits, rule)
+			}
+		}
+
+		fmt.Println()
+		if len(culprits) == 0 {
+			fmt.Println("No fault broke the results on its own, only their combination did")
+		} else {
+			fmt.Println("Faults that broke the results on their own:")
+			for _, rule := range culprits {
+				fmt.Printf("  %v\n", rule)
+			}
+		}
+	}
+
+	os.Exit(1)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const MAX_SHOWN_LINES = 3
+
+// Compares the results of every client against the golden ones, the order
+// of the lines doesn't matter. Returns a line for every difference found
+func compareResults(goldenDir string, resultsDir string) ([]string, error) {
+	goldens, err := filepath.Glob(filepath.Join(goldenDir, "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	if len(goldens) == 0 {
+		return nil, fmt.Errorf("there are no golden results in %s", goldenDir)
+	}
+
+	clients, err := os.ReadDir(resultsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := make([]string, 0)
+	for _, client := range clients {
+		for _, golden := range goldens {
+			fileName := filepath.Base(golden)
+			expected, err := readLines(golden)
+			if err != nil {
+				return nil, err
+			}
+
+			got, err := readLines(filepath.Join(resultsDir, client.Name(), fileName))
+			if err != nil {
+				diffs = append(diffs, fmt.Sprintf("%s %s: %v", client.Name(), fileName, err))
+				continue
+			}
+
+			missing, unexpected := diffLines(expected, got)
+			if len(missing) > 0 || len(unexpected) > 0 {
+				diffs = append(diffs, fmt.Sprintf("%s %s: %d missing lines %q, %d unexpected lines %q",
+					client.Name(), fileName,
+					len(missing), missing[:min(len(missing), MAX_SHOWN_LINES)],
+					len(unexpected), unexpected[:min(len(unexpected), MAX_SHOWN_LINES)]))
+			}
+		}
+	}
+
+	return diffs, nil
+}
+
+func readLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	slices.Sort(lines)
+	return lines, nil
+}
+
+// Both are sorted, repeated lines count as many times as they appear
+func diffLines(expected, got []string) ([]string, []string) {
+	missing := make([]string, 0)
+	unexpected := make([]string, 0)
+
+	i, j := 0, 0
+	for i < len(expected) && j < len(got) {
+		switch strings.Compare(expected[i], got[j]) {
+		case 0:
+			i++
+			j++
+		case -1:
+			missing = append(missing, expected[i])
+			i++
+		case 1:
+			unexpected = append(unexpected, got[j])
+			j++
+		}
+	}
+
+	missing = append(missing, expected[i:]...)
+	unexpected = append(unexpected, got[j:]...)
+	return missing, unexpected
+}
+
+// Keeps the results of the first client as the golden ones
+func recordGolden(resultsDir string, goldenDir string) error {
+	clients, err := os.ReadDir(resultsDir)
+	if err != nil {
+		return err
+	}
+	if len(clients) == 0 {
+		return fmt.Errorf("there are no results in %s", resultsDir)
+	}
+
+	files, err := filepath.Glob(filepath.Join(resultsDir, clients[0].Name(), "*.csv"))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(goldenDir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(goldenDir, filepath.Base(file)), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
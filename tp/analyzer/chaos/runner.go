@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"analyzer/comms/chaos"
+)
+
+const (
+	PIPELINE_COMPOSE = "compose.yaml"
+	CHECKERS_COMPOSE = "compose.checkers.yaml"
+	CLIENTS_COMPOSE  = "compose.clients.yaml"
+	CHAOS_COMPOSE    = "compose.chaos.yaml"
+	NETWORK          = "moviesanalyzer_net"
+	SCENARIO_PATH    = "/chaos.scenario"
+	RESULTS_PATH     = "/results"
+	FILL_PATH        = "/chaos-fill"
+)
+
+// The clients didn't get their results within the timeout, as when a lost message leaves a receiver waiting
+var ErrTimedOut = errors.New("timed out")
+
+// Runs the whole system under a scenario, from the directory with the compose files
+type Runner struct {
+	dir     string
+	outDir  string
+	timeout time.Duration
+}
+
+type Run struct {
+	Name       string
+	Dir        string
+	ResultsDir string
+	Fired      []string
+}
+
+func NewRunner(dir string, outDir string, timeout time.Duration) (*Runner, error) {
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Runner{dir: dir, outDir: absOut, timeout: timeout}, nil
+}
+
+func (r *Runner) docker(ctx context.Context, logFile *os.File, args ...string) error {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Dir = r.dir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker %s failed: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func compose(files []string, args ...string) []string {
+	cmd := []string{"compose"}
+	for _, file := range files {
+		cmd = append(cmd, "-f", file)
+	}
+	return append(cmd, args...)
+}
+
+func (r *Runner) services(file string) ([]string, error) {
+	cmd := exec.Command("docker", compose([]string{file}, "config", "--services")...)
+	cmd.Dir = r.dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list the services of %s: %v", file, err)
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+// Mounts the scenario in every service and tells each one its name
+func (r *Runner) writeOverride(runDir string, scenarioPath string) (string, error) {
+	services, err := r.services(PIPELINE_COMPOSE)
+	if err != nil {
+		return "", err
+	}
+
+	buf := bytes.NewBufferString("services:\n")
+	for _, service := range services {
+		fmt.Fprintf(buf, "  %s:\n", service)
+		fmt.Fprintf(buf, "    volumes:\n      - %s:%s:ro\n", scenarioPath, SCENARIO_PATH)
+		fmt.Fprintf(buf, "    environment:\n      - CHAOS_SCENARIO=%s\n      - NODE_NAME=%s\n", SCENARIO_PATH, service)
+	}
+
+	path := filepath.Join(runDir, CHAOS_COMPOSE)
+	return path, os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Runs the system with the faults in `rules` until every client gets its results. If
+// the clients fail the run is still returned, with the faults that fired until then
+func (r *Runner) Run(name string, rules []chaos.Rule) (*Run, error) {
+	runDir := filepath.Join(r.outDir, name)
+	if err := os.RemoveAll(runDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.Create(filepath.Join(runDir, "docker.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	internal := make([]chaos.Rule, 0)
+	external := make([]chaos.Rule, 0)
+	for _, rule := range rules {
+		if rule.Internal() {
+			internal = append(internal, rule)
+		} else {
+			external = append(external, rule)
+		}
+	}
+
+	scenarioPath := filepath.Join(runDir, "scenario")
+	if err := os.WriteFile(scenarioPath, chaos.EncodeScenario(internal), 0644); err != nil {
+		return nil, err
+	}
+
+	overridePath, err := r.writeOverride(runDir, scenarioPath)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Run{Name: name, Dir: runDir, ResultsDir: filepath.Join(runDir, "results")}
+	pipeline := []string{PIPELINE_COMPOSE, overridePath}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	defer r.down(logFile, pipeline)
+
+	log.Infof("[%s] Starting the system", name)
+	if err := r.docker(ctx, logFile, compose(pipeline, "up", "-d", "--build")...); err != nil {
+		return nil, err
+	}
+	if err := r.docker(ctx, logFile, compose([]string{CHECKERS_COMPOSE}, "up", "-d", "--build")...); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	injectCtx, stopInjecting := context.WithCancel(ctx)
+	start := time.Now()
+
+	for _, rule := range external {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fired, err := r.inject(injectCtx, logFile, rule, start)
+			if err != nil {
+				log.Errorf("[%s] failed to inject %v: %v", name, rule, err)
+			}
+			if len(fired) > 0 {
+				mu.Lock()
+				run.Fired = append(run.Fired, fired)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	log.Infof("[%s] Running the clients", name)
+	clientsErr := r.docker(ctx, logFile, compose([]string{CLIENTS_COMPOSE}, "up", "--build")...)
+	stopInjecting()
+	wg.Wait()
+
+	if clientsErr != nil {
+		if fired, err := r.firedInternal(pipeline); err == nil {
+			run.Fired = append(run.Fired, fired...)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return run, ErrTimedOut
+		}
+		return run, clientsErr
+	}
+
+	if err := r.collect(logFile, run); err != nil {
+		return nil, err
+	}
+
+	fired, err := r.firedInternal(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	run.Fired = append(run.Fired, fired...)
+
+	return run, nil
+}
+
+// Injects a fault targeting whole containers once its time comes
+func (r *Runner) inject(ctx context.Context, logFile *os.File, rule chaos.Rule, start time.Time) (string, error) {
+	at, err := rule.Duration("at", 0)
+	if err != nil {
+		return "", err
+	}
+	dur, err := rule.Duration("for", 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	mb, err := rule.Int("mb", 1024)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", nil
+	case <-time.After(time.Until(start.Add(at))):
+	}
+
+	fired := fmt.Sprintf("%s at %v", rule, time.Since(start).Round(time.Second))
+	log.Infof("Injecting %s", fired)
+
+	// The clean up is done even if the run is over, the containers are still up
+	wait := func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(dur):
+		}
+	}
+
+	background := context.Background()
+	for _, container := range rule.Containers() {
+		switch rule.Fault {
+		case chaos.FAULT_KILL:
+			err = r.docker(background, logFile, "kill", "--signal=KILL", container)
+		case chaos.FAULT_PARTITION:
+			err = r.docker(background, logFile, "network", "disconnect", NETWORK, container)
+		case chaos.FAULT_FILL_DISK:
+			err = r.docker(background, logFile, "exec", container, "dd", "if=/dev/zero", "of="+FILL_PATH, "bs=1M", fmt.Sprintf("count=%d", mb))
+		}
+		if err != nil {
+			return fired, err
+		}
+	}
+
+	switch rule.Fault {
+	case chaos.FAULT_PARTITION:
+		wait()
+		for _, container := range rule.Containers() {
+			if err := r.docker(background, logFile, "network", "connect", NETWORK, container); err != nil {
+				return fired, err
+			}
+		}
+	case chaos.FAULT_FILL_DISK:
+		wait()
+		for _, container := range rule.Containers() {
+			if err := r.docker(background, logFile, "exec", container, "rm", "-f", FILL_PATH); err != nil {
+				return fired, err
+			}
+		}
+	}
+
+	return fired, nil
+}
+
+// Copies the results out of every client container
+func (r *Runner) collect(logFile *os.File, run *Run) error {
+	clients, err := r.services(CLIENTS_COMPOSE)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(run.ResultsDir, 0755); err != nil {
+		return err
+	}
+
+	for _, client := range clients {
+		dst := filepath.Join(run.ResultsDir, client)
+		if err := r.docker(context.Background(), logFile, "cp", client+":"+RESULTS_PATH, dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Faults injected by the nodes are found in their logs
+func (r *Runner) firedInternal(pipeline []string) ([]string, error) {
+	cmd := exec.Command("docker", compose(pipeline, "logs", "--no-color", "--no-log-prefix")...)
+	cmd.Dir = r.dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the logs: %v", err)
+	}
+
+	fired := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if _, msg, found := strings.Cut(scanner.Text(), "Chaos "); found {
+			fired = append(fired, msg)
+		}
+	}
+
+	return fired, scanner.Err()
+}
+
+func (r *Runner) down(logFile *os.File, pipeline []string) {
+	ctx := context.Background()
+	r.docker(ctx, logFile, compose([]string{CLIENTS_COMPOSE}, "down")...)
+	r.docker(ctx, logFile, compose([]string{CHECKERS_COMPOSE}, "down")...)
+	if err := r.docker(ctx, logFile, compose(pipeline, "down", "-v")...); err != nil {
+		log.Errorf("failed to tear the system down: %v", err)
+	}
+}
@@ -12,13 +12,24 @@ import (
 
 type Config struct {
 	// .env
-	HealthCheckPort               uint16
-	DefaultSleepDuration          time.Duration
-	ReviveSleepDuration           time.Duration
-	StartingKeepAliveWaitDuration time.Duration
-	StartupGraceDuration          time.Duration
-	KeepAliveRetries              int
-	ReviveRetries                 int
+	HealthCheckPort         uint16
+	KeepAliveInterval       time.Duration
+	ReviveSleepDuration     time.Duration
+	PhiThreshold            float64
+	PhiWindowSize           int
+	PhiMinStdDeviation      time.Duration
+	StallTimeout            time.Duration
+	StartupGraceDuration    time.Duration
+	KeepAliveRetries        int
+	ReviveRetries           int
+	HeartbeatDuration       time.Duration
+	ElectionTimeoutDuration time.Duration
+	Reviver                 string
+	DockerSocket            string
+	ProcessCommandsPath     string
+	StatusPort              uint16
+	FlapWindow              time.Duration
+	FlapThreshold           int
 
 	// compose
 	Id         int
@@ -61,15 +72,15 @@ func Create() (Config, error) {
 		return Config{}, fmt.Errorf("the provided health check port is invalid: %v", err)
 	}
 
-	// DEFAULT_SLEEP_DURATION
-	defaultSleepDurationInt, err := strconv.Atoi(os.Getenv("DEFAULT_SLEEP_DURATION"))
+	// KEEP_ALIVE_INTERVAL
+	keepAliveIntervalInt, err := strconv.Atoi(os.Getenv("KEEP_ALIVE_INTERVAL"))
 	if err != nil {
-		return Config{}, fmt.Errorf("the default sleep duration is invalid: %v", err)
+		return Config{}, fmt.Errorf("the keep alive interval is invalid: %v", err)
 	}
-	if defaultSleepDurationInt < 0 {
-		return Config{}, fmt.Errorf("the default sleep duration must be a postive number or zero")
+	if keepAliveIntervalInt <= 0 {
+		return Config{}, fmt.Errorf("the keep alive interval must be a positive number")
 	}
-	defaultSleepDuration := time.Duration(defaultSleepDurationInt) * time.Second
+	keepAliveInterval := time.Duration(keepAliveIntervalInt) * time.Second
 
 	// REVIVE_SLEEP_DURATION
 	reviveSleepDurationInt, err := strconv.Atoi(os.Getenv("REVIVE_SLEEP_DURATION"))
@@ -81,15 +92,43 @@ func Create() (Config, error) {
 	}
 	reviveSleepDuration := time.Duration(reviveSleepDurationInt) * time.Second
 
-	// STARTING_KEEP_ALIVE_WAIT_DURATION
-	startingKeepAliveWaitDurationInt, err := strconv.Atoi(os.Getenv("STARTING_KEEP_ALIVE_WAIT_DURATION"))
+	// PHI_THRESHOLD
+	phiThreshold, err := strconv.ParseFloat(os.Getenv("PHI_THRESHOLD"), 64)
 	if err != nil {
-		return Config{}, fmt.Errorf("the starting keep alive wait duration is invalid: %v", err)
+		return Config{}, fmt.Errorf("the phi threshold is invalid: %v", err)
 	}
-	if startingKeepAliveWaitDurationInt < 0 {
-		return Config{}, fmt.Errorf("the starting keep alive wait duration must be a postive number or zero")
+	if phiThreshold <= 0 {
+		return Config{}, fmt.Errorf("the phi threshold must be a positive number")
 	}
-	startingKeepAliveWaitDuration := time.Duration(startingKeepAliveWaitDurationInt) * time.Second
+
+	// PHI_WINDOW_SIZE
+	phiWindowSize, err := strconv.Atoi(os.Getenv("PHI_WINDOW_SIZE"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the phi window size is invalid: %v", err)
+	}
+	if phiWindowSize <= 0 {
+		return Config{}, fmt.Errorf("the phi window size must be a positive number")
+	}
+
+	// PHI_MIN_STD_DEVIATION
+	phiMinStdDeviationInt, err := strconv.Atoi(os.Getenv("PHI_MIN_STD_DEVIATION"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the phi min standard deviation is invalid: %v", err)
+	}
+	if phiMinStdDeviationInt <= 0 {
+		return Config{}, fmt.Errorf("the phi min standard deviation must be a positive number")
+	}
+	phiMinStdDeviation := time.Duration(phiMinStdDeviationInt) * time.Millisecond
+
+	// STALL_TIMEOUT
+	stallTimeoutInt, err := strconv.Atoi(os.Getenv("STALL_TIMEOUT"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the stall timeout is invalid: %v", err)
+	}
+	if stallTimeoutInt <= 0 {
+		return Config{}, fmt.Errorf("the stall timeout must be a positive number")
+	}
+	stallTimeout := time.Duration(stallTimeoutInt) * time.Second
 
 	// STARTUP_GRACE_DURATION
 	startupGraceDurationInt, err := strconv.Atoi(os.Getenv("STARTUP_GRACE_DURATION"))
@@ -99,7 +138,8 @@ func Create() (Config, error) {
 	if startupGraceDurationInt < 0 {
 		return Config{}, fmt.Errorf("the startup grace duration must be a postive number of zero")
 	}
-	startupGraceDuration := time.Duration(startingKeepAliveWaitDurationInt) * time.Second
+	startupGraceDuration := time.Duration(startupGraceDurationInt) * time.Second
+
 	// KEEP_ALIVE_RETRIES
 	keepAliveRetries, err := strconv.Atoi(os.Getenv("KEEP_ALIVE_RETRIES"))
 	if err != nil {
@@ -118,6 +158,69 @@ func Create() (Config, error) {
 		return Config{}, fmt.Errorf("the revive retries value must be a postive number or zero")
 	}
 
+	// HEARTBEAT_DURATION
+	heartbeatDurationInt, err := strconv.Atoi(os.Getenv("HEARTBEAT_DURATION"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the heartbeat duration is invalid: %v", err)
+	}
+	if heartbeatDurationInt <= 0 {
+		return Config{}, fmt.Errorf("the heartbeat duration must be a positive number")
+	}
+	heartbeatDuration := time.Duration(heartbeatDurationInt) * time.Second
+
+	// ELECTION_TIMEOUT_DURATION
+	electionTimeoutDurationInt, err := strconv.Atoi(os.Getenv("ELECTION_TIMEOUT_DURATION"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the election timeout duration is invalid: %v", err)
+	}
+	if electionTimeoutDurationInt <= heartbeatDurationInt {
+		return Config{}, fmt.Errorf("the election timeout duration must be greater than the heartbeat duration")
+	}
+	electionTimeoutDuration := time.Duration(electionTimeoutDurationInt) * time.Second
+
+	// REVIVER
+	reviver := os.Getenv("REVIVER")
+	if len(reviver) == 0 {
+		return Config{}, fmt.Errorf("the reviver was not provided")
+	}
+
+	// DOCKER_SOCKET
+	dockerSocket := os.Getenv("DOCKER_SOCKET")
+	if len(dockerSocket) == 0 {
+		dockerSocket = "/var/run/docker.sock"
+	}
+
+	// PROCESS_COMMANDS_PATH
+	processCommandsPath := os.Getenv("PROCESS_COMMANDS_PATH")
+	if reviver == "process" && len(processCommandsPath) == 0 {
+		return Config{}, fmt.Errorf("the process commands path is required by the process reviver")
+	}
+
+	// STATUS_PORT
+	statusPort, err := strconv.ParseUint(os.Getenv("STATUS_PORT"), 10, 16)
+	if err != nil {
+		return Config{}, fmt.Errorf("the provided status port is invalid: %v", err)
+	}
+
+	// FLAP_WINDOW
+	flapWindowInt, err := strconv.Atoi(os.Getenv("FLAP_WINDOW"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the flap window is invalid: %v", err)
+	}
+	if flapWindowInt <= 0 {
+		return Config{}, fmt.Errorf("the flap window must be a positive number")
+	}
+	flapWindow := time.Duration(flapWindowInt) * time.Second
+
+	// FLAP_THRESHOLD
+	flapThreshold, err := strconv.Atoi(os.Getenv("FLAP_THRESHOLD"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the flap threshold is invalid: %v", err)
+	}
+	if flapThreshold <= 0 {
+		return Config{}, fmt.Errorf("the flap threshold must be a positive number")
+	}
+
 	// WATCH_NODES
 	watchNodesStr := os.Getenv("WATCH_NODES")
 	watchNodes := strings.Split(watchNodesStr, ",")
@@ -134,16 +237,27 @@ func Create() (Config, error) {
 	configLog(logLevel)
 
 	return Config{
-		Id:                            id,
-		N:                             n,
-		HostName:                      hostName,
-		HealthCheckPort:               uint16(healthCheckPort),
-		DefaultSleepDuration:          defaultSleepDuration,
-		ReviveSleepDuration:           reviveSleepDuration,
-		StartingKeepAliveWaitDuration: startingKeepAliveWaitDuration,
-		StartupGraceDuration:          startupGraceDuration,
-		ReviveRetries:                 reviveRetries,
-		WatchNodes:                    watchNodes,
-		KeepAliveRetries:              keepAliveRetries,
+		Id:                      id,
+		N:                       n,
+		HostName:                hostName,
+		HealthCheckPort:         uint16(healthCheckPort),
+		KeepAliveInterval:       keepAliveInterval,
+		ReviveSleepDuration:     reviveSleepDuration,
+		PhiThreshold:            phiThreshold,
+		PhiWindowSize:           phiWindowSize,
+		PhiMinStdDeviation:      phiMinStdDeviation,
+		StallTimeout:            stallTimeout,
+		StartupGraceDuration:    startupGraceDuration,
+		ReviveRetries:           reviveRetries,
+		WatchNodes:              watchNodes,
+		KeepAliveRetries:        keepAliveRetries,
+		HeartbeatDuration:       heartbeatDuration,
+		ElectionTimeoutDuration: electionTimeoutDuration,
+		Reviver:                 reviver,
+		DockerSocket:            dockerSocket,
+		ProcessCommandsPath:     processCommandsPath,
+		StatusPort:              uint16(statusPort),
+		FlapWindow:              flapWindow,
+		FlapThreshold:           flapThreshold,
 	}, nil
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"analyzer/checker/impl"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const CLEAR_SCREEN = "\033[H\033[2J"
+
+func fetch(client *http.Client, url string) (impl.ClusterStatus, error) {
+	resp, err := client.Get(url + "/status")
+	if err != nil {
+		return impl.ClusterStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return impl.ClusterStatus{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var status impl.ClusterStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return impl.ClusterStatus{}, err
+	}
+
+	return status, nil
+}
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "url of the status server of any checker")
+	interval := flag.Duration("interval", 2*time.Second, "time between refreshes")
+	once := flag.Bool("once", false, "print the status once and exit")
+	flag.Parse()
+
+	client := &http.Client{Timeout: *interval}
+	for {
+		status, err := fetch(client, *url)
+		if !*once {
+			fmt.Print(CLEAR_SCREEN)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't fetch the status from %s: %v\n", *url, err)
+			if *once {
+				os.Exit(1)
+			}
+		} else {
+			impl.RenderStatus(os.Stdout, status, true)
+		}
+
+		if *once {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
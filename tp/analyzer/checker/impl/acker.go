@@ -3,19 +3,102 @@ package impl
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/op/go-logging"
 )
 
+// Max size of the datagrams that aren't keep-alives
+const ACKER_BUFFER_SIZE = 1 << 16
+
+// Handles the non empty datagrams received by an acker, keep-alives are empty
+type MessageHandler func(msg []byte, peerAddr *net.UDPAddr)
+
+// Health and progress of a node, sent along with every ack
+type Health struct {
+	Seqs      map[string]int // Last processed seq of each input queue
+	Idle      time.Duration  // Since the last delivery was done
+	Busy      time.Duration  // Since the current delivery started, zero if there's none
+	Lag       int            // Deliveries waiting in the input queues
+	Memory    uint64         // Allocated heap bytes
+	Processed uint64         // Deliveries processed so far
+	Held      int            // Out of order deliveries waiting for a gap to be filled, in memory or spilled
+}
+
+// Example: "seqs=q-0:12;q-1:3 idle=150 busy=0 lag=20 mem=1048576 processed=15 held=4"
+func (h Health) Encode() []byte {
+	seqs := make([]string, 0, len(h.Seqs))
+	for qName, seq := range h.Seqs {
+		seqs = append(seqs, fmt.Sprintf("%s:%d", qName, seq))
+	}
+
+	return fmt.Appendf(nil, "seqs=%s idle=%d busy=%d lag=%d mem=%d processed=%d held=%d",
+		strings.Join(seqs, ";"), h.Idle.Milliseconds(), h.Busy.Milliseconds(), h.Lag, h.Memory, h.Processed, h.Held)
+}
+
+// Example: "seqs=q-0:12;q-1:3 idle=150 busy=0 lag=20 mem=1048576 processed=15 held=4"
+func DecodeHealth(data []byte) (Health, error) {
+	h := Health{Seqs: make(map[string]int)}
+
+	for _, field := range strings.Fields(string(data)) {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return Health{}, fmt.Errorf("field is not a key value pair: %s", field)
+		}
+
+		if key == "seqs" {
+			for _, entry := range strings.Split(value, ";") {
+				if len(entry) == 0 {
+					continue
+				}
+
+				qName, seqStr, _ := strings.Cut(entry, ":")
+				seq, err := strconv.Atoi(seqStr)
+				if err != nil {
+					return Health{}, fmt.Errorf("seq is not a number: %s", entry)
+				}
+				h.Seqs[qName] = seq
+			}
+			continue
+		}
+
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return Health{}, fmt.Errorf("%s is not a number: %s", key, value)
+		}
+
+		switch key {
+		case "idle":
+			h.Idle = time.Duration(n) * time.Millisecond
+		case "busy":
+			h.Busy = time.Duration(n) * time.Millisecond
+		case "lag":
+			h.Lag = int(n)
+		case "mem":
+			h.Memory = n
+		case "processed":
+			h.Processed = n
+		case "held":
+			h.Held = int(n)
+		}
+	}
+
+	return h, nil
+}
+
 type Acker struct {
 	conn             *net.UDPConn
 	log              *logging.Logger
 	wg               sync.WaitGroup
 	keepAliveRetries int
+	handler          MessageHandler
+	health           func() Health
 }
 
-func newAcker(port uint16, log *logging.Logger, keepAliveRetries int) (Acker, error) {
+func newAcker(port uint16, log *logging.Logger, keepAliveRetries int, handler MessageHandler, health func() Health) (Acker, error) {
 	addrStr := fmt.Sprintf(":%d", port)
 	addr, err := net.ResolveUDPAddr("udp", addrStr)
 	if err != nil {
@@ -31,11 +114,23 @@ func newAcker(port uint16, log *logging.Logger, keepAliveRetries int) (Acker, er
 		conn:             conn,
 		log:              log,
 		keepAliveRetries: keepAliveRetries,
+		handler:          handler,
+		health:           health,
 	}, nil
 }
 
 func SpawnAcker(port uint16, keepAliveRetries int, log *logging.Logger) (*Acker, error) {
-	a, err := newAcker(port, log, keepAliveRetries)
+	return spawnAcker(port, keepAliveRetries, log, nil, nil)
+}
+
+// Spawns an acker that sends the result of `health` along with every ack
+func SpawnHealthAcker(port uint16, keepAliveRetries int, log *logging.Logger, health func() Health) (*Acker, error) {
+	return spawnAcker(port, keepAliveRetries, log, nil, health)
+}
+
+// Spawns an acker that hands every non empty datagram to `handler` instead of acking it
+func spawnAcker(port uint16, keepAliveRetries int, log *logging.Logger, handler MessageHandler, health func() Health) (*Acker, error) {
+	a, err := newAcker(port, log, keepAliveRetries, handler, health)
 	if err != nil {
 		return nil, err
 	}
@@ -51,25 +146,49 @@ func SpawnAcker(port uint16, keepAliveRetries int, log *logging.Logger) (*Acker,
 }
 
 func (a *Acker) run() {
+	var buf []byte
+	if a.handler != nil {
+		buf = make([]byte, ACKER_BUFFER_SIZE)
+	}
+
 	for {
 		a.log.Debugf("Waiting for keep-alives...")
-		_, peerAddr, err := a.conn.ReadFromUDP(nil)
+		n, peerAddr, err := a.conn.ReadFromUDP(buf)
 		if err != nil {
 			return
 		}
 
+		if n > 0 {
+			msg := make([]byte, n)
+			copy(msg, buf[:n])
+			a.handler(msg, peerAddr)
+			continue
+		}
+
 		host := peerAddr.IP.String()
 		a.log.Debugf("Received a keep-alive from %s, trying to ACK", host)
 
-		for range 1 + a.keepAliveRetries {
-			_, err = a.conn.WriteToUDP(nil, peerAddr)
-			if err == nil {
-				break
-			}
+		var ack []byte
+		if a.health != nil {
+			ack = a.health().Encode()
 		}
+		a.send(ack, peerAddr)
 	}
 }
 
+// Sends a datagram from the acker's port, retrying on failure
+func (a *Acker) send(msg []byte, peerAddr *net.UDPAddr) error {
+	var err error
+	for range 1 + a.keepAliveRetries {
+		_, err = a.conn.WriteToUDP(msg, peerAddr)
+		if err == nil {
+			break
+		}
+	}
+
+	return err
+}
+
 func (a *Acker) Stop() error {
 	a.log.Debugf("Waiting for Acker to stop...")
 
@@ -2,11 +2,9 @@ package impl
 
 import (
 	"analyzer/checker/config"
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/op/go-logging"
 )
@@ -28,20 +26,22 @@ func (c Checker) Run() error {
 	signal.Notify(sigs, syscall.SIGTERM)
 	defer close(sigs)
 
-	acker, err := SpawnAcker(c.con.HealthCheckPort, c.con.KeepAliveRetries, c.log)
+	// Nodes are assigned by the leader once elected
+	monitor, err := SpawnMonitor(c.con, c.log, []string{})
 	if err != nil {
 		return err
 	}
-	defer acker.Stop()
-
-	time.Sleep(c.con.StartupGraceDuration)
+	defer monitor.Stop()
 
-	nextName := fmt.Sprintf("%s-%d", c.con.HostName, (c.con.Id+1)%c.con.N)
-	monitor, err := SpawnMonitor(c.con, c.log, append(c.con.WatchNodes, nextName))
+	elector, acker, err := SpawnElector(c.con, c.log, monitor)
 	if err != nil {
 		return err
 	}
-	defer monitor.Stop()
+	defer acker.Stop()
+	defer elector.Stop()
+
+	status := SpawnStatusServer(c.con, c.log, monitor, elector)
+	defer status.Stop()
 
 	c.log.Infof("Running...")
 	<-sigs
@@ -0,0 +1,59 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+)
+
+// Restarts containers through the docker command line
+type DockerCliReviver struct{}
+
+func (DockerCliReviver) Revive(name string) error {
+	cmd := exec.Command("docker", "restart", name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+
+	return nil
+}
+
+// Restarts containers through the docker engine's http api, served on a unix socket
+type DockerApiReviver struct {
+	client *http.Client
+}
+
+func NewDockerApiReviver(socketPath string) DockerApiReviver {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return DockerApiReviver{
+		client: &http.Client{Transport: transport},
+	}
+}
+
+func (r DockerApiReviver) Revive(name string) error {
+	// The host is ignored, every request goes through the socket
+	endpoint := fmt.Sprintf("http://docker/containers/%s/restart", url.PathEscape(name))
+
+	res, err := r.client.Post(endpoint, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("docker api responded %s: %s", res.Status, body)
+	}
+
+	return nil
+}
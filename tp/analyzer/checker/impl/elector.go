@@ -0,0 +1,348 @@
+package impl
+
+import (
+	"analyzer/checker/config"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Messages exchanged between checkers through their ackers, "<kind> <id> [payload]"
+const (
+	MSG_ELECTION    = "election"
+	MSG_ANSWER      = "answer"
+	MSG_COORDINATOR = "coordinator"
+	MSG_ALIVE       = "alive"
+)
+
+const NO_LEADER = -1
+
+type message struct {
+	kind    string
+	id      int
+	payload string
+}
+
+func encodeMessage(kind string, id int, payload string) []byte {
+	return fmt.Appendf(nil, "%s %d %s", kind, id, payload)
+}
+
+// Example: "coordinator 2 worker-0,worker-1"
+func decodeMessage(data []byte) (message, error) {
+	parts := strings.SplitN(string(data), " ", 3)
+	if len(parts) < 2 {
+		return message{}, fmt.Errorf("the amount of parts is not enough: %s", data)
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return message{}, fmt.Errorf("id is not a number: %s", data)
+	}
+
+	msg := message{kind: parts[0], id: id}
+	if len(parts) == 3 {
+		msg.payload = parts[2]
+	}
+
+	return msg, nil
+}
+
+// Bully election among checkers. The leader sends heartbeats to every other
+// checker carrying the nodes it has to watch, the checkers that stop answering
+// are handed to the live ones to be revived
+type Elector struct {
+	con     config.Config
+	log     *logging.Logger
+	acker   *Acker
+	monitor *Monitor
+	msgs    chan message
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	current atomic.Int32
+
+	// Owned by the elector's goroutine
+	leader           int
+	electionDeadline time.Time
+	answered         bool
+	lastHeartbeat    time.Time
+	lastSeen         map[int]time.Time
+}
+
+func SpawnElector(con config.Config, log *logging.Logger, monitor *Monitor) (*Elector, *Acker, error) {
+	e := &Elector{
+		con:      con,
+		log:      log,
+		monitor:  monitor,
+		msgs:     make(chan message, 64),
+		quit:     make(chan struct{}),
+		leader:   NO_LEADER,
+		lastSeen: make(map[int]time.Time),
+	}
+	e.current.Store(NO_LEADER)
+
+	acker, err := spawnAcker(con.HealthCheckPort, con.KeepAliveRetries, log, e.deliver, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.acker = acker
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.run()
+		log.Infof("Terminating Elector...")
+	}()
+
+	return e, acker, nil
+}
+
+// Called by the acker, messages are dropped if the elector falls behind
+func (e *Elector) deliver(data []byte, _ *net.UDPAddr) {
+	msg, err := decodeMessage(data)
+	if err != nil {
+		e.log.Errorf("failed to decode election message: %v", err)
+		return
+	}
+
+	select {
+	case e.msgs <- msg:
+	default:
+	}
+}
+
+func (e *Elector) peerName(id int) string {
+	return fmt.Sprintf("%s-%d", e.con.HostName, id)
+}
+
+func (e *Elector) send(id int, kind string, payload string) {
+	addr, err := resolveAddr(e.peerName(id), e.con.HealthCheckPort)
+	if err != nil {
+		e.log.Debugf("couldn't resolve %s: %v", e.peerName(id), err)
+		return
+	}
+
+	if err := e.acker.send(encodeMessage(kind, e.con.Id, payload), addr); err != nil {
+		e.log.Debugf("couldn't send %s to %s: %v", kind, e.peerName(id), err)
+	}
+}
+
+func (e *Elector) run() {
+	select {
+	case <-e.quit:
+		return
+	case <-time.After(e.con.StartupGraceDuration):
+	}
+
+	e.startElection()
+
+	ticker := time.NewTicker(e.con.HeartbeatDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.quit:
+			return
+		case msg := <-e.msgs:
+			e.handle(msg)
+		case <-ticker.C:
+			e.tick()
+		}
+	}
+}
+
+func (e *Elector) setLeader(id int) {
+	e.leader = id
+	e.current.Store(int32(id))
+}
+
+// Returns the current leader, or NO_LEADER while electing one
+func (e *Elector) Leader() int {
+	return int(e.current.Load())
+}
+
+func (e *Elector) electing() bool {
+	return !e.electionDeadline.IsZero()
+}
+
+func (e *Elector) startElection() {
+	e.log.Infof("Starting election")
+	e.setLeader(NO_LEADER)
+	e.answered = false
+	e.electionDeadline = time.Now().Add(e.con.ElectionTimeoutDuration)
+
+	if e.con.Id == e.con.N-1 {
+		e.becomeLeader()
+		return
+	}
+
+	for id := e.con.Id + 1; id < e.con.N; id++ {
+		e.send(id, MSG_ELECTION, "")
+	}
+}
+
+func (e *Elector) becomeLeader() {
+	e.log.Infof("Elected as leader")
+	e.setLeader(e.con.Id)
+	e.electionDeadline = time.Time{}
+
+	// Every checker is taken as alive until it misses a whole timeout
+	now := time.Now()
+	for id := range e.con.N {
+		e.lastSeen[id] = now
+	}
+
+	e.heartbeat()
+}
+
+func (e *Elector) tick() {
+	now := time.Now()
+
+	switch {
+	case e.leader == e.con.Id:
+		e.heartbeat()
+
+	case e.electing() && now.After(e.electionDeadline):
+		if e.answered {
+			// A higher checker answered but never took over
+			e.startElection()
+		} else {
+			e.becomeLeader()
+		}
+
+	case !e.electing() && now.Sub(e.lastHeartbeat) > e.con.ElectionTimeoutDuration:
+		e.log.Infof("Lost leader %d", e.leader)
+		e.startElection()
+	}
+}
+
+func (e *Elector) handle(msg message) {
+	// Any message proves the checker is alive, even one that's not following yet
+	if e.leader == e.con.Id {
+		e.lastSeen[msg.id] = time.Now()
+	}
+
+	switch msg.kind {
+	case MSG_ELECTION:
+		if msg.id >= e.con.Id {
+			return
+		}
+
+		e.send(msg.id, MSG_ANSWER, "")
+		if e.leader == e.con.Id {
+			e.heartbeat()
+		} else if !e.electing() {
+			e.startElection()
+		}
+
+	case MSG_ANSWER:
+		if e.electing() {
+			e.answered = true
+			e.electionDeadline = time.Now().Add(e.con.ElectionTimeoutDuration)
+		}
+
+	case MSG_COORDINATOR:
+		if msg.id < e.con.Id {
+			// Bully the lower checker into following
+			if e.leader == e.con.Id {
+				e.heartbeat()
+			} else if !e.electing() {
+				e.startElection()
+			}
+			return
+		}
+
+		if e.leader != msg.id {
+			e.log.Infof("Following leader %d", msg.id)
+		}
+
+		e.setLeader(msg.id)
+		e.electionDeadline = time.Time{}
+		e.lastHeartbeat = time.Now()
+		e.monitor.SetWatchNodes(decodeNodes(msg.payload))
+		e.send(msg.id, MSG_ALIVE, "")
+
+	case MSG_ALIVE:
+		// Already taken into account
+
+	default:
+		e.log.Errorf("unknown election message kind %s from %d", msg.kind, msg.id)
+	}
+}
+
+// Splits the nodes among the live checkers and lets them know who's the leader
+func (e *Elector) heartbeat() {
+	live := []int{e.con.Id}
+	nodes := slices.Clone(e.con.WatchNodes)
+
+	now := time.Now()
+	for id := range e.con.N {
+		if id == e.con.Id {
+			continue
+		}
+
+		if now.Sub(e.lastSeen[id]) > e.con.ElectionTimeoutDuration {
+			nodes = append(nodes, e.peerName(id))
+		} else {
+			live = append(live, id)
+		}
+	}
+
+	assignment := assign(nodes, live)
+	e.monitor.SetWatchNodes(assignment[e.con.Id])
+
+	for _, id := range live {
+		if id != e.con.Id {
+			e.send(id, MSG_COORDINATOR, strings.Join(assignment[id], ","))
+		}
+	}
+}
+
+// Each node goes to the checker with the highest score for it (rendezvous hashing), so
+// when a checker joins or leaves only the nodes it wins or had change hands
+func assign(nodes []string, checkers []int) map[int][]string {
+	slices.Sort(nodes)
+	slices.Sort(checkers)
+
+	assignment := make(map[int][]string, len(checkers))
+	for _, id := range checkers {
+		assignment[id] = []string{}
+	}
+
+	for _, node := range nodes {
+		best, bestScore := checkers[0], uint64(0)
+		for i, id := range checkers {
+			h := fnv.New64a()
+			fmt.Fprintf(h, "%s/%d", node, id)
+			if score := h.Sum64(); i == 0 || score > bestScore {
+				best, bestScore = id, score
+			}
+		}
+		assignment[best] = append(assignment[best], node)
+	}
+
+	return assignment
+}
+
+func decodeNodes(payload string) []string {
+	if len(payload) == 0 {
+		return []string{}
+	}
+	return strings.Split(payload, ",")
+}
+
+func (e *Elector) Stop() {
+	e.log.Debugf("Waiting for Elector to stop...")
+
+	close(e.quit)
+	e.wg.Wait()
+
+	e.log.Debugf("Elector stopped")
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"maps"
 	"net"
-	"os/exec"
 	"slices"
 	"sync"
 	"time"
@@ -19,24 +18,30 @@ type Monitor struct {
 	log        *logging.Logger
 	conn       *net.UDPConn
 	wg         sync.WaitGroup
+	mu         sync.Mutex
 	watchNodes []string
+	reviver    Reviver
+	detector   *PhiDetector
+	healths    map[string]Health
+	progressed map[string]time.Time // Last time the processed count of a node moved
+	revivals   map[string][]Revival
+	restarts   map[string]int
 }
 
-func revive(containerName string, retries int, log *logging.Logger, healthCheckPort uint16) (*net.UDPAddr, error) {
+func revive(reviver Reviver, containerName string, retries int, log *logging.Logger) error {
 	var err error
 	for range 1 + retries {
-		cmd := exec.Command("docker", "restart", containerName)
-		if err = cmd.Run(); err == nil {
+		if err = reviver.Revive(containerName); err == nil {
 			break
 		}
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to revive %s: %v", containerName, err)
+		return fmt.Errorf("failed to revive %s: %v", containerName, err)
 	}
 
 	log.Infof("Successfully revived %s", containerName)
-	return resolveAddr(containerName, healthCheckPort)
+	return nil
 }
 
 func resolveAddr(host string, port uint16) (*net.UDPAddr, error) {
@@ -49,6 +54,11 @@ func resolveAddr(host string, port uint16) (*net.UDPAddr, error) {
 }
 
 func newMonitor(con config.Config, log *logging.Logger, watchNodes []string) (Monitor, error) {
+	reviver, err := NewReviver(con)
+	if err != nil {
+		return Monitor{}, err
+	}
+
 	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
 		return Monitor{}, fmt.Errorf("failed to open udp connection for keep alive: %v", err)
@@ -59,6 +69,12 @@ func newMonitor(con config.Config, log *logging.Logger, watchNodes []string) (Mo
 		log:        log,
 		conn:       conn,
 		watchNodes: watchNodes,
+		reviver:    reviver,
+		detector:   NewPhiDetector(con.PhiWindowSize, con.PhiMinStdDeviation, con.KeepAliveInterval),
+		healths:    make(map[string]Health),
+		progressed: make(map[string]time.Time),
+		revivals:   make(map[string][]Revival),
+		restarts:   make(map[string]int),
 	}, nil
 }
 
@@ -78,6 +94,23 @@ func SpawnMonitor(con config.Config, log *logging.Logger, watchNodes []string) (
 	return &m, nil
 }
 
+// Replaces the nodes to watch, takes effect on the next iteration
+func (m *Monitor) SetWatchNodes(nodes []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !slices.Equal(m.watchNodes, nodes) {
+		m.log.Infof("Watching %v", nodes)
+	}
+	m.watchNodes = nodes
+}
+
+func (m *Monitor) getWatchNodes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.watchNodes
+}
+
 func (m *Monitor) direct(addr string) bool {
 	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
 	_, err := m.conn.WriteToUDP(nil, udpAddr)
@@ -95,7 +128,8 @@ func (m *Monitor) broadcast(nodes map[string]string) bool {
 	return allOk
 }
 
-func (m *Monitor) wait(dur time.Duration, dead map[string]string) (bool, error) {
+// Waits for acks during `dur`, recording a heartbeat for each one
+func (m *Monitor) wait(dur time.Duration, nodes map[string]string) (bool, error) {
 	now := time.Now()
 	deadline := now.Add(dur)
 
@@ -103,8 +137,9 @@ func (m *Monitor) wait(dur time.Duration, dead map[string]string) (bool, error)
 		return false, fmt.Errorf("failed to set deadline timeout: %v", err)
 	}
 
+	buf := make([]byte, ACKER_BUFFER_SIZE)
 	for {
-		_, peerAddr, err := m.conn.ReadFromUDP(nil)
+		n, peerAddr, err := m.conn.ReadFromUDP(buf)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				return true, nil
@@ -118,22 +153,77 @@ func (m *Monitor) wait(dur time.Duration, dead map[string]string) (bool, error)
 		}
 
 		m.log.Debugf("Received ACK from %s", peerAddr.IP.String())
-		delete(dead, peerAddr.String())
+		name, ok := nodes[peerAddr.String()]
+		if !ok {
+			continue
+		}
+		m.detector.Heartbeat(name, time.Now())
+
+		// Only workers report their health
+		if n > 0 {
+			health, err := DecodeHealth(buf[:n])
+			if err != nil {
+				m.log.Errorf("failed to decode %s's health: %v", name, err)
+				continue
+			}
+			m.setHealth(name, health)
+		}
+	}
+}
+
+func (m *Monitor) revive(containerName string, reason string) (*net.UDPAddr, error) {
+	now := time.Now()
+	err := revive(m.reviver, containerName, m.con.ReviveRetries, m.log)
+
+	// Give it time to start before suspecting it again
+	m.detector.Reset(containerName, now.Add(m.con.ReviveSleepDuration))
+
+	m.mu.Lock()
+	delete(m.healths, containerName)
+	delete(m.progressed, containerName)
+	m.recordRevival(containerName, reason, now, err)
+	m.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return m.resolve(containerName)
+}
+
+// Nodes are reached by their name on the health check port, unless the reviver knows their address
+func (m *Monitor) resolve(name string) (*net.UDPAddr, error) {
+	if addresser, ok := m.reviver.(Addresser); ok {
+		if addr, ok := addresser.Addr(name); ok {
+			return net.ResolveUDPAddr("udp", addr)
+		}
 	}
+	return resolveAddr(name, m.con.HealthCheckPort)
 }
 
-func (m *Monitor) revive(containerName string) (*net.UDPAddr, error) {
-	return revive(containerName, m.con.ReviveRetries, m.log, m.con.HealthCheckPort)
+// Must be called with the lock held, only the last MAX_REVIVALS revivals are kept
+func (m *Monitor) recordRevival(name string, reason string, at time.Time, err error) {
+	revival := Revival{At: at, Reason: reason}
+	if err != nil {
+		revival.Error = err.Error()
+	} else {
+		m.restarts[name]++
+	}
+
+	revivals := append(m.revivals[name], revival)
+	if len(revivals) > MAX_REVIVALS {
+		revivals = revivals[1:]
+	}
+	m.revivals[name] = revivals
 }
 
-func (m *Monitor) sendWait(waitDur time.Duration, dead map[string]string) bool {
-	m.log.Debugf("Broadcasting keep-alives to %d nodes", len(dead))
-	if !m.broadcast(dead) {
+func (m *Monitor) sendWait(waitDur time.Duration, nodes map[string]string) bool {
+	m.log.Debugf("Broadcasting keep-alives to %d nodes", len(nodes))
+	if !m.broadcast(nodes) {
 		return false
 	}
 
-	m.log.Debugf("Waiting for ACKs for %d seconds...", int(waitDur.Seconds()))
-	ok, err := m.wait(waitDur, dead)
+	m.log.Debugf("Waiting for ACKs for %v...", waitDur)
+	ok, err := m.wait(waitDur, nodes)
 	if err != nil {
 		m.log.Error(err)
 	}
@@ -141,67 +231,172 @@ func (m *Monitor) sendWait(waitDur time.Duration, dead map[string]string) bool {
 	return ok
 }
 
-func (m *Monitor) resolveAddrs(nodes []string) (map[string]string, bool) {
+func (m *Monitor) resolveAddrs(nodes []string) map[string]string {
 	addrs := make(map[string]string, len(nodes))
-	revived := false
 
 	for _, name := range nodes {
 		var addr *net.UDPAddr
 		for addr == nil {
 			var err error
-			addr, err = resolveAddr(name, m.con.HealthCheckPort)
+			addr, err = m.resolve(name)
 			if err != nil {
-				addr, err = m.revive(name)
-				revived = true
+				addr, err = m.revive(name, REASON_UNRESOLVABLE)
 			}
 		}
 
 		addrs[addr.String()] = name
 	}
 
-	return addrs, revived
+	return addrs
 }
 
-func (m *Monitor) run() {
-	for {
-		dead, revived := m.resolveAddrs(m.watchNodes)
-		if revived {
-			time.Sleep(m.con.ReviveSleepDuration)
-		}
+func (m *Monitor) keepHealths(names []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		waitDur := m.con.StartingKeepAliveWaitDuration
-		if !m.sendWait(waitDur, dead) {
-			return
+	maps.DeleteFunc(m.healths, func(name string, _ Health) bool {
+		return !slices.Contains(names, name)
+	})
+	maps.DeleteFunc(m.progressed, func(name string, _ time.Time) bool {
+		return !slices.Contains(names, name)
+	})
+}
+
+func (m *Monitor) setHealth(name string, health Health) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if prev, ok := m.healths[name]; !ok || prev.Processed != health.Processed {
+		m.progressed[name] = time.Now()
+	}
+	m.healths[name] = health
+}
+
+// Returns the last health reported by every watched node that reports it
+func (m *Monitor) Healths() map[string]Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.healths)
+}
+
+// A node is stalled if it's stuck on a delivery, or it has deliveries waiting and
+// its processed count doesn't move, while still answering keep-alives
+func (m *Monitor) stalled(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isStalled(name, time.Now())
+}
+
+// Must hold the lock
+func (m *Monitor) isStalled(name string, now time.Time) bool {
+	health, ok := m.healths[name]
+	if !ok {
+		return false
+	}
+
+	// A node holding out of order deliveries is waiting for a gap upstream to be filled
+	timeout := m.con.StallTimeout
+	waiting := health.Held > 0
+	return health.Busy > timeout || (health.Lag > 0 && !waiting && now.Sub(m.progressed[name]) > timeout)
+}
+
+// Returns the suspicion level of every watched node
+func (m *Monitor) Suspicions() map[string]float64 {
+	return m.detector.Phis(time.Now())
+}
+
+// Returns the status of every watched node, along with the ones that were
+// revived by this checker before being handed to another one
+func (m *Monitor) Status() []NodeStatus {
+	watchNodes := m.getWatchNodes()
+	phis := m.Suspicions()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := slices.Clone(watchNodes)
+	for name := range m.revivals {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	status := make([]NodeStatus, 0, len(names))
+	for _, name := range names {
+		node := NodeStatus{
+			Name:     name,
+			Owner:    NO_OWNER,
+			State:    NODE_UNKNOWN,
+			Restarts: m.restarts[name],
+			Revivals: slices.Clone(m.revivals[name]),
 		}
 
-		for retry := range m.con.KeepAliveRetries {
-			if len(dead) == 0 {
-				break
+		if slices.Contains(watchNodes, name) {
+			node.Owner = m.con.Id
+			node.Phi = phis[name]
+			if health, ok := m.healths[name]; ok {
+				node.Health = &health
 			}
+			node.State = m.state(node)
+		}
 
-			waitDur <<= 1
-			m.log.Infof("[%d] %v didn't respond, retrying in %d seconds", retry+1, slices.Collect(maps.Values(dead)), int(waitDur.Seconds()))
+		status = append(status, node)
+	}
 
-			if !m.sendWait(waitDur, dead) {
-				return
+	return status
+}
+
+// A node that's still failing to be revived is taken as dead
+func (m *Monitor) state(node NodeStatus) string {
+	failed := len(node.Revivals) > 0 && len(node.Revivals[len(node.Revivals)-1].Error) > 0
+	stalled := node.Health != nil && m.isStalled(node.Name, time.Now())
+
+	switch {
+	case failed || node.Phi >= m.con.PhiThreshold:
+		return NODE_DEAD
+	case stalled || node.Phi >= m.con.PhiThreshold/2:
+		return NODE_SUSPECTED
+	default:
+		return NODE_ALIVE
+	}
+}
+
+func (m *Monitor) run() {
+	for {
+		watchNodes := m.getWatchNodes()
+		m.detector.Keep(watchNodes)
+		m.keepHealths(watchNodes)
+
+		nodes := m.resolveAddrs(watchNodes)
+		if !m.sendWait(m.con.KeepAliveInterval, nodes) {
+			return
+		}
+
+		now := time.Now()
+		dead := make(map[string]string)
+		for _, name := range nodes {
+			phi := m.detector.Phi(name, now)
+			if phi >= m.con.PhiThreshold {
+				dead[name] = REASON_DEAD
+			} else if m.stalled(name) {
+				m.log.Infof("%s is alive but not making progress", name)
+				dead[name] = REASON_STALLED
+			} else if phi >= m.con.PhiThreshold/2 {
+				m.log.Infof("Suspecting %s, phi %.2f", name, phi)
 			}
 		}
 
-		sleepDur := m.con.DefaultSleepDuration
 		if len(dead) > 0 {
-			m.log.Infof("Dead nodes: %v", slices.Collect(maps.Values(dead)))
-			sleepDur = m.con.ReviveSleepDuration
+			m.log.Infof("Dead nodes: %v", slices.Sorted(maps.Keys(dead)))
 		}
 
-		for _, name := range dead {
-			_, err := m.revive(name)
+		for name, reason := range dead {
+			_, err := m.revive(name, reason)
 			if err != nil {
 				m.log.Error(err)
 			}
 		}
-
-		m.log.Debugf("Sleeping for %d seconds...", int(sleepDur.Seconds()))
-		time.Sleep(sleepDur)
 	}
 }
 
@@ -0,0 +1,137 @@
+package impl
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Phi accrual failure detector. Keeps the latest inter-arrival times of the
+// heartbeats of each node and tells how unlikely it is for the current silence
+// to happen if the node were alive, as phi = -log10(P(silence))
+type PhiDetector struct {
+	mu         sync.Mutex
+	windowSize int
+	minStdDev  float64
+	expected   float64
+	nodes      map[string]*arrivals
+}
+
+type arrivals struct {
+	last      time.Time
+	intervals []float64
+}
+
+// Nodes start with a single interval of `expected`, so one that never answers gets suspected as well
+func NewPhiDetector(windowSize int, minStdDev time.Duration, expected time.Duration) *PhiDetector {
+	return &PhiDetector{
+		windowSize: windowSize,
+		minStdDev:  minStdDev.Seconds(),
+		expected:   expected.Seconds(),
+		nodes:      make(map[string]*arrivals),
+	}
+}
+
+func (d *PhiDetector) node(name string, now time.Time) *arrivals {
+	a, ok := d.nodes[name]
+	if !ok {
+		a = &arrivals{last: now, intervals: []float64{d.expected}}
+		d.nodes[name] = a
+	}
+	return a
+}
+
+// Records a heartbeat from `name` received at `at`
+func (d *PhiDetector) Heartbeat(name string, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a := d.node(name, at)
+	if interval := at.Sub(a.last).Seconds(); interval > 0 {
+		a.intervals = append(a.intervals, interval)
+		if len(a.intervals) > d.windowSize {
+			a.intervals = a.intervals[1:]
+		}
+	}
+	a.last = at
+}
+
+// Forgets the history of `name`, it's silence is not taken into account until `since`
+func (d *PhiDetector) Reset(name string, since time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nodes[name] = &arrivals{last: since, intervals: []float64{d.expected}}
+}
+
+// Forgets every node but the given ones
+func (d *PhiDetector) Keep(names []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keep := make(map[string]*arrivals, len(names))
+	for _, name := range names {
+		if a, ok := d.nodes[name]; ok {
+			keep[name] = a
+		}
+	}
+	d.nodes = keep
+}
+
+// Returns the suspicion level of `name` at `now`
+func (d *PhiDetector) Phi(name string, now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a := d.node(name, now)
+	elapsed := now.Sub(a.last).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	mean, stdDev := meanStdDev(a.intervals)
+	return phi(elapsed, mean, max(stdDev, d.minStdDev))
+}
+
+// Returns the suspicion level of every known node at `now`
+func (d *PhiDetector) Phis(now time.Time) map[string]float64 {
+	d.mu.Lock()
+	names := make([]string, 0, len(d.nodes))
+	for name := range d.nodes {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	phis := make(map[string]float64, len(names))
+	for _, name := range names {
+		phis[name] = d.Phi(name, now)
+	}
+	return phis
+}
+
+func meanStdDev(xs []float64) (float64, float64) {
+	mean := 0.0
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+
+	variance := 0.0
+	for _, x := range xs {
+		variance += (x - mean) * (x - mean)
+	}
+	variance /= float64(len(xs))
+
+	return mean, math.Sqrt(variance)
+}
+
+// Logistic approximation of the normal cumulative distribution
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
@@ -0,0 +1,120 @@
+package impl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Runs every node as a local process, reviving one kills what's left
+// of its last process and starts it again
+type ProcessReviver struct {
+	mu       sync.Mutex
+	commands map[string]command
+	procs    map[string]*process
+}
+
+// A started process, `done` is closed once it's reaped
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+type command struct {
+	addr string
+	env  []string
+	args []string
+}
+
+// Reads the commands of each node from the file at `path`, one per line with
+// the address its health check listens on, as every process has its own port.
+// Example: "<name> <host:port> [KEY=value...] <binary> [args...]"
+func NewProcessReviver(path string) (*ProcessReviver, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open process commands: %v", err)
+	}
+	defer fp.Close()
+
+	commands := make(map[string]command)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("node %s has no address", fields[0])
+		}
+		name, addr, rest := fields[0], fields[1], fields[2:]
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("the address of node %s is invalid: %v", name, err)
+		}
+
+		var env []string
+		for len(rest) > 0 && strings.Contains(rest[0], "=") {
+			env = append(env, rest[0])
+			rest = rest[1:]
+		}
+
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("node %s has no command", name)
+		}
+		commands[name] = command{addr, env, rest}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read process commands: %v", err)
+	}
+
+	return &ProcessReviver{
+		commands: commands,
+		procs:    make(map[string]*process),
+	}, nil
+}
+
+func (r *ProcessReviver) Revive(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	command, ok := r.commands[name]
+	if !ok {
+		return fmt.Errorf("there's no command for %s", name)
+	}
+
+	// The process might still be running, stuck. It's waited for so the
+	// new one doesn't start while the old one still holds its resources
+	if prev, ok := r.procs[name]; ok {
+		prev.cmd.Process.Kill()
+		<-prev.done
+	}
+
+	cmd := exec.Command(command.args[0], command.args[1:]...)
+	cmd.Env = append(os.Environ(), command.env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Reap it once it's done
+	proc := &process{cmd, make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(proc.done)
+	}()
+
+	r.procs[name] = proc
+	return nil
+}
+
+// Returns the health check address of `name`, given with its command
+func (r *ProcessReviver) Addr(name string) (string, bool) {
+	command, ok := r.commands[name]
+	return command.addr, ok
+}
@@ -0,0 +1,66 @@
+package impl
+
+import (
+	"analyzer/checker/config"
+	"fmt"
+	"sync"
+)
+
+const (
+	REVIVER_DOCKER_CLI = "docker-cli"
+	REVIVER_DOCKER_API = "docker-api"
+	REVIVER_PROCESS    = "process"
+	REVIVER_FAKE       = "fake"
+)
+
+// Brings a dead node back to life
+type Reviver interface {
+	Revive(name string) error
+}
+
+// A reviver whose nodes aren't reached by their name on the shared health check port
+type Addresser interface {
+	Addr(name string) (string, bool)
+}
+
+// Creates the reviver chosen in the config
+func NewReviver(con config.Config) (Reviver, error) {
+	switch con.Reviver {
+	case REVIVER_DOCKER_CLI:
+		return DockerCliReviver{}, nil
+	case REVIVER_DOCKER_API:
+		return NewDockerApiReviver(con.DockerSocket), nil
+	case REVIVER_PROCESS:
+		return NewProcessReviver(con.ProcessCommandsPath)
+	case REVIVER_FAKE:
+		return NewFakeReviver(), nil
+	default:
+		return nil, fmt.Errorf("unknown reviver %s", con.Reviver)
+	}
+}
+
+// Doesn't revive anything, only keeps track of what it was asked to revive
+type FakeReviver struct {
+	mu      sync.Mutex
+	revived map[string]int
+}
+
+func NewFakeReviver() *FakeReviver {
+	return &FakeReviver{revived: make(map[string]int)}
+}
+
+func (r *FakeReviver) Revive(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.revived[name]++
+	return nil
+}
+
+// Returns how many times `name` was revived
+func (r *FakeReviver) Revived(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.revived[name]
+}
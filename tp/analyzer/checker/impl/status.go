@@ -0,0 +1,323 @@
+package impl
+
+import (
+	"analyzer/checker/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	NODE_ALIVE     = "alive"
+	NODE_SUSPECTED = "suspected"
+	NODE_DEAD      = "dead"
+	NODE_UNKNOWN   = "unknown"
+)
+
+// Why a node was revived
+const (
+	REASON_DEAD         = "dead"
+	REASON_STALLED      = "stalled"
+	REASON_UNRESOLVABLE = "unresolvable"
+)
+
+const NO_OWNER = -1
+const MAX_REVIVALS = 32
+
+type Revival struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type NodeStatus struct {
+	Name     string    `json:"name"`
+	Owner    int       `json:"owner"`
+	State    string    `json:"state"`
+	Phi      float64   `json:"phi"`
+	Health   *Health   `json:"health,omitempty"`
+	Restarts int       `json:"restarts"`
+	Revivals []Revival `json:"revivals"`
+	Flapping bool      `json:"flapping"`
+}
+
+type CheckerStatus struct {
+	Id        int  `json:"id"`
+	Reachable bool `json:"reachable"`
+	Leader    int  `json:"leader"`
+}
+
+type ClusterStatus struct {
+	At       time.Time       `json:"at"`
+	Leader   int             `json:"leader"`
+	Checkers []CheckerStatus `json:"checkers"`
+	Nodes    []NodeStatus    `json:"nodes"`
+}
+
+// Serves the status of the cluster over http. Any checker can answer for the
+// whole cluster, it asks every other checker for the nodes they own
+type StatusServer struct {
+	con     config.Config
+	log     *logging.Logger
+	monitor *Monitor
+	elector *Elector
+	server  *http.Server
+	client  *http.Client
+	wg      sync.WaitGroup
+}
+
+func SpawnStatusServer(con config.Config, log *logging.Logger, monitor *Monitor, elector *Elector) *StatusServer {
+	s := &StatusServer{
+		con:     con,
+		log:     log,
+		monitor: monitor,
+		elector: elector,
+		client:  &http.Client{Timeout: con.HeartbeatDuration},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status/local", s.handleLocal)
+	mux.HandleFunc("GET /status", s.handleCluster)
+	mux.HandleFunc("GET /{$}", s.handleText)
+	s.server = &http.Server{Addr: fmt.Sprintf(":%d", con.StatusPort), Handler: mux}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("status server failed: %v", err)
+		}
+		log.Infof("Terminating Status Server...")
+	}()
+
+	return s
+}
+
+func (s *StatusServer) local() ClusterStatus {
+	leader := s.elector.Leader()
+	return ClusterStatus{
+		At:       time.Now(),
+		Leader:   leader,
+		Checkers: []CheckerStatus{{Id: s.con.Id, Reachable: true, Leader: leader}},
+		Nodes:    s.monitor.Status(),
+	}
+}
+
+func (s *StatusServer) fetch(id int) (ClusterStatus, error) {
+	url := fmt.Sprintf("http://%s-%d:%d/status/local", s.con.HostName, id, s.con.StatusPort)
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return ClusterStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ClusterStatus{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var status ClusterStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return ClusterStatus{}, err
+	}
+
+	return status, nil
+}
+
+// Asks every checker for its status concurrently and merges them
+func (s *StatusServer) Cluster() ClusterStatus {
+	statuses := make([]ClusterStatus, s.con.N)
+	reachable := make([]bool, s.con.N)
+
+	var wg sync.WaitGroup
+	for id := range s.con.N {
+		if id == s.con.Id {
+			statuses[id], reachable[id] = s.local(), true
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := s.fetch(id)
+			if err != nil {
+				s.log.Debugf("couldn't fetch the status of checker %d: %v", id, err)
+				return
+			}
+			statuses[id], reachable[id] = status, true
+		}()
+	}
+	wg.Wait()
+
+	return mergeStatus(s.con, statuses, reachable)
+}
+
+func mergeStatus(con config.Config, statuses []ClusterStatus, reachable []bool) ClusterStatus {
+	cluster := ClusterStatus{At: time.Now(), Leader: NO_LEADER}
+	nodes := make(map[string]*NodeStatus)
+
+	for _, name := range con.WatchNodes {
+		nodes[name] = &NodeStatus{Name: name, Owner: NO_OWNER, State: NODE_UNKNOWN}
+	}
+
+	for id, status := range statuses {
+		checker := CheckerStatus{Id: id, Reachable: reachable[id], Leader: NO_LEADER}
+		if reachable[id] {
+			checker.Leader = status.Leader
+		}
+		cluster.Checkers = append(cluster.Checkers, checker)
+
+		// The one they agree on, the leader's own word otherwise
+		if checker.Leader == id || (cluster.Leader == NO_LEADER && checker.Leader != NO_LEADER) {
+			cluster.Leader = checker.Leader
+		}
+
+		for _, node := range status.Nodes {
+			merged, ok := nodes[node.Name]
+			if !ok {
+				merged = &NodeStatus{Name: node.Name, Owner: NO_OWNER, State: NODE_UNKNOWN}
+				nodes[node.Name] = merged
+			}
+
+			if node.Owner != NO_OWNER {
+				merged.Owner = node.Owner
+				merged.State = node.State
+				merged.Phi = node.Phi
+				merged.Health = node.Health
+			}
+
+			// Every revival is done by a single checker
+			merged.Restarts += node.Restarts
+			merged.Revivals = append(merged.Revivals, node.Revivals...)
+		}
+	}
+
+	for _, node := range nodes {
+		slices.SortFunc(node.Revivals, func(a, b Revival) int { return a.At.Compare(b.At) })
+		node.Flapping = flapping(node.Revivals, cluster.At, con.FlapWindow, con.FlapThreshold)
+		cluster.Nodes = append(cluster.Nodes, *node)
+	}
+	slices.SortFunc(cluster.Nodes, func(a, b NodeStatus) int { return strings.Compare(a.Name, b.Name) })
+
+	return cluster
+}
+
+// A node is flapping if it was revived at least `threshold` times during the last `window`
+func flapping(revivals []Revival, now time.Time, window time.Duration, threshold int) bool {
+	n := 0
+	for _, revival := range revivals {
+		if now.Sub(revival.At) <= window {
+			n++
+		}
+	}
+	return n >= threshold
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *StatusServer) handleLocal(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, s.local())
+}
+
+func (s *StatusServer) handleCluster(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, s.Cluster())
+}
+
+func (s *StatusServer) handleText(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	RenderStatus(w, s.Cluster(), false)
+}
+
+const (
+	COLOR_RESET  = "\033[0m"
+	COLOR_RED    = "\033[31m"
+	COLOR_GREEN  = "\033[32m"
+	COLOR_YELLOW = "\033[33m"
+	COLOR_GREY   = "\033[90m"
+	COLOR_BOLD   = "\033[1m"
+)
+
+var stateColors = map[string]string{
+	NODE_ALIVE:     COLOR_GREEN,
+	NODE_SUSPECTED: COLOR_YELLOW,
+	NODE_DEAD:      COLOR_RED,
+	NODE_UNKNOWN:   COLOR_GREY,
+}
+
+// Writes the status as a table, flapping nodes are marked with a `!`
+func RenderStatus(w io.Writer, status ClusterStatus, color bool) {
+	paint := func(c string, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + COLOR_RESET
+	}
+
+	fmt.Fprintf(w, "%s\n\n", status.At.Format(time.DateTime))
+
+	leader := "none"
+	if status.Leader != NO_LEADER {
+		leader = fmt.Sprint(status.Leader)
+	}
+	fmt.Fprintf(w, "leader: %s\n", leader)
+
+	for _, checker := range status.Checkers {
+		state := paint(COLOR_GREEN, "reachable")
+		if !checker.Reachable {
+			state = paint(COLOR_RED, "unreachable")
+		}
+		fmt.Fprintf(w, "  checker-%d  %s\n", checker.Id, state)
+	}
+
+	fmt.Fprintf(w, "\n  %-32s %-10s %-6s %7s %9s %8s  %s\n", "NODE", "STATE", "OWNER", "PHI", "RESTARTS", "LAG", "LAST REVIVAL")
+	for _, node := range status.Nodes {
+		mark := " "
+		if node.Flapping {
+			mark = paint(COLOR_BOLD+COLOR_YELLOW, "!")
+		}
+
+		owner := "-"
+		if node.Owner != NO_OWNER {
+			owner = fmt.Sprint(node.Owner)
+		}
+
+		lag := "-"
+		if node.Health != nil {
+			lag = fmt.Sprint(node.Health.Lag)
+		}
+
+		last := "-"
+		if n := len(node.Revivals); n > 0 {
+			revival := node.Revivals[n-1]
+			last = fmt.Sprintf("%s (%s)", revival.At.Format(time.TimeOnly), revival.Reason)
+			if len(revival.Error) > 0 {
+				last += " failed: " + revival.Error
+			}
+		}
+
+		state := paint(stateColors[node.State], fmt.Sprintf("%-10s", node.State))
+		fmt.Fprintf(w, "%s %-32s %s %-6s %7.2f %9d %8s  %s\n", mark, node.Name, state, owner, node.Phi, node.Restarts, lag, last)
+	}
+}
+
+func (s *StatusServer) Stop() {
+	s.log.Debugf("Waiting for Status Server to stop...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.con.HeartbeatDuration)
+	defer cancel()
+	s.server.Shutdown(ctx)
+	s.wg.Wait()
+
+	s.log.Debugf("Status Server stopped")
+}
@@ -0,0 +1,171 @@
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Keeps how many times each crash fired, so a revived node doesn't crash at the same point forever
+const STATE_DIRNAME = "chaos"
+
+type fault struct {
+	Rule
+	chance float64
+	after  int
+	times  int
+	delay  time.Duration
+	hits   int
+	fired  int
+}
+
+type injector struct {
+	mu     sync.Mutex
+	log    *logging.Logger
+	node   string
+	faults []*fault
+}
+
+// Nil while there's no scenario, every point is a no-op then
+var active *injector
+
+// Loads the faults of the scenario at `path` that apply to `node`
+func Init(path string, node string, log *logging.Logger) error {
+	rules, err := LoadScenario(path)
+	if err != nil {
+		return fmt.Errorf("couldn't load chaos scenario %s: %v", path, err)
+	}
+
+	inj := &injector{log: log, node: node}
+	for _, rule := range rules {
+		if !rule.Internal() || !rule.Matches(node) {
+			continue
+		}
+
+		f, err := newFault(rule)
+		if err != nil {
+			return err
+		}
+
+		inj.faults = append(inj.faults, f)
+	}
+
+	log.Infof("Loaded %d chaos faults for %s", len(inj.faults), node)
+	active = inj
+	return nil
+}
+
+func newFault(rule Rule) (*fault, error) {
+	var err error
+	f := &fault{Rule: rule}
+
+	if f.chance, err = rule.Float("chance", 100); err != nil {
+		return nil, err
+	}
+	if f.after, err = rule.Int("after", 0); err != nil {
+		return nil, err
+	}
+	if f.delay, err = rule.Duration("for", time.Second); err != nil {
+		return nil, err
+	}
+
+	// Crashes fire once unless told otherwise, the rest every time
+	defaultTimes := 0
+	if rule.Fault == FAULT_CRASH {
+		defaultTimes = 1
+	}
+	if f.times, err = rule.Int("times", defaultTimes); err != nil {
+		return nil, err
+	}
+	f.fired = loadFired(rule)
+
+	return f, nil
+}
+
+func firedPath(rule Rule) string {
+	return fmt.Sprintf("/%s/%d", STATE_DIRNAME, rule.Line)
+}
+
+func loadFired(rule Rule) int {
+	if rule.Fault != FAULT_CRASH {
+		return 0
+	}
+
+	data, err := os.ReadFile(firedPath(rule))
+	if err != nil {
+		return 0
+	}
+
+	fired, _ := strconv.Atoi(string(data))
+	return fired
+}
+
+func storeFired(f *fault) {
+	os.MkdirAll(fmt.Sprintf("/%s", STATE_DIRNAME), 0755)
+	os.WriteFile(firedPath(f.Rule), []byte(strconv.Itoa(f.fired)), 0644)
+}
+
+// Returns the faults of `kinds` at `point` that fire on this hit
+func (inj *injector) fire(point string, kinds ...string) []*fault {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	firing := make([]*fault, 0)
+	for _, f := range inj.faults {
+		if f.Target != point || !slices.Contains(kinds, f.Fault) {
+			continue
+		}
+
+		f.hits++
+		if f.hits <= f.after || (f.times > 0 && f.fired >= f.times) {
+			continue
+		}
+		if rand.Float64()*100 >= f.chance {
+			continue
+		}
+
+		f.fired++
+		firing = append(firing, f)
+	}
+
+	return firing
+}
+
+// Crashes or delays the node if its scenario says so
+func Point(point string) {
+	if active == nil {
+		return
+	}
+
+	for _, f := range active.fire(point, FAULT_CRASH, FAULT_DELAY) {
+		switch f.Fault {
+		case FAULT_CRASH:
+			storeFired(f)
+			active.log.Criticalf("Chaos crash at %s on %s by %v", point, active.node, f.Rule)
+			os.Exit(1)
+		case FAULT_DELAY:
+			active.log.Infof("Chaos delay of %v at %s on %s by %v", f.delay, point, active.node, f.Rule)
+			time.Sleep(f.delay)
+		}
+	}
+}
+
+// Tells whether the message going through `point` should be dropped
+func Drop(point string) bool {
+	if active == nil {
+		return false
+	}
+
+	dropping := active.fire(point, FAULT_DROP)
+	for _, f := range dropping {
+		active.log.Infof("Chaos drop at %s on %s by %v", point, active.node, f.Rule)
+	}
+
+	return len(dropping) > 0
+}
@@ -0,0 +1,189 @@
+package chaos
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faults injected by the nodes themselves when they reach a point
+const (
+	FAULT_CRASH = "crash"
+	FAULT_DELAY = "delay"
+	FAULT_DROP  = "drop"
+)
+
+// Faults injected by the runner on whole containers
+const (
+	FAULT_KILL      = "kill"
+	FAULT_PARTITION = "partition"
+	FAULT_FILL_DISK = "fill-disk"
+)
+
+// Named points where nodes check for faults
+const (
+	POINT_RECV            = "worker.recv"
+	POINT_PROCESS         = "worker.process"
+	POINT_DUMP            = "worker.dump"
+	POINT_PERSISTOR_STORE = "persistor.store"
+	POINT_SHARD_BATCH     = "shard.batch"
+	POINT_MAILER_DUMP     = "mailer.dump"
+	POINT_ATOMIC_WRITE    = "atomic.write"
+	POINT_PUBLISH         = "broker.publish"
+	POINT_CONSUME         = "broker.consume"
+)
+
+// A line of a scenario file, "<fault> <target> [key=value ...]". The target is
+// a point for the faults injected by the nodes and a list of containers for the
+// ones injected by the runner
+type Rule struct {
+	Line   int
+	Fault  string
+	Target string
+	Params map[string]string
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("line %d: %s", r.Line, r.encode())
+}
+
+func (r Rule) encode() string {
+	fields := []string{r.Fault, r.Target}
+	for _, k := range slices.Sorted(maps.Keys(r.Params)) {
+		fields = append(fields, fmt.Sprintf("%s=%s", k, r.Params[k]))
+	}
+	return strings.Join(fields, " ")
+}
+
+// Whether the fault is injected by the nodes
+func (r Rule) Internal() bool {
+	return r.Fault == FAULT_CRASH || r.Fault == FAULT_DELAY || r.Fault == FAULT_DROP
+}
+
+// Nodes are matched against the `node` glob, every node by default
+func (r Rule) Matches(node string) bool {
+	pattern, ok := r.Params["node"]
+	if !ok {
+		return true
+	}
+
+	matched, _ := path.Match(pattern, node)
+	return matched
+}
+
+// Containers targeted by a fault injected by the runner
+func (r Rule) Containers() []string {
+	return strings.Split(r.Target, ",")
+}
+
+func (r Rule) Int(key string, def int) (int, error) {
+	v, ok := r.Params[key]
+	if !ok {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number in %v", key, r)
+	}
+	return n, nil
+}
+
+func (r Rule) Float(key string, def float64) (float64, error) {
+	v, ok := r.Params[key]
+	if !ok {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number in %v", key, r)
+	}
+	return f, nil
+}
+
+// Durations are written as in "200ms" or "30s"
+func (r Rule) Duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := r.Params[key]
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a duration in %v", key, r)
+	}
+	return d, nil
+}
+
+// Example: "crash persistor.store node=join-* after=100 chance=50", lines starting with `#` are ignored
+func ParseScenario(r io.Reader) ([]Rule, error) {
+	rules := make([]Rule, 0)
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d has no target: %s", line, text)
+		}
+
+		rule := Rule{Line: line, Fault: fields[0], Target: fields[1], Params: make(map[string]string)}
+		switch rule.Fault {
+		case FAULT_CRASH, FAULT_DELAY, FAULT_DROP, FAULT_KILL, FAULT_PARTITION, FAULT_FILL_DISK:
+		default:
+			return nil, fmt.Errorf("line %d has an unknown fault: %s", line, rule.Fault)
+		}
+
+		for _, field := range fields[2:] {
+			k, v, found := strings.Cut(field, "=")
+			if !found {
+				return nil, fmt.Errorf("line %d has a parameter that is not a key value pair: %s", line, field)
+			}
+			rule.Params[k] = v
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+func LoadScenario(path string) ([]Rule, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return ParseScenario(fp)
+}
+
+// Example: the same as the scenario file it was parsed from, rules are kept
+// in their lines so they are still told apart when only some of them are written
+func EncodeScenario(rules []Rule) []byte {
+	buf := bytes.NewBuffer(nil)
+	line := 1
+	for _, rule := range rules {
+		for ; line < rule.Line; line++ {
+			buf.WriteByte('\n')
+		}
+
+		buf.WriteString(rule.encode())
+		buf.WriteByte('\n')
+		line++
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"analyzer/comms"
+)
+
+// Sends every message to all the replicas, meant for the small side of a join
+type SenderBroadcast struct {
+	broker       *Broker
+	outputCopies int
+	fmt          string
+	name         string
+
+	// Persisted
+	seq []map[int]int
+}
+
+func NewBroadcast(broker *Broker, fmt string, outputCopies int) *SenderBroadcast {
+	seq := make([]map[int]int, outputCopies)
+	for i := range seq {
+		seq[i] = make(map[int]int)
+	}
+
+	return &SenderBroadcast{
+		broker:       broker,
+		fmt:          fmt,
+		name:         strings.TrimSuffix(fmt, "-%d"),
+		outputCopies: outputCopies,
+		seq:          seq,
+	}
+}
+
+// Returns the replicas the client's messages are sent to, the ones
+// beyond the initial copies get their sequence numbers on demand
+func (s *SenderBroadcast) copies(headers Table) int {
+	copies := scaleOf(headers).Copies(s.name, s.outputCopies)
+	s.grow(copies)
+	return copies
+}
+
+func (s *SenderBroadcast) grow(copies int) {
+	for len(s.seq) < copies {
+		s.seq = append(s.seq, make(map[int]int))
+	}
+}
+
+func (s *SenderBroadcast) Batch(batch comms.Batch, filterCols map[string]struct{}, headers Table) error {
+	body := batch.Encode(filterCols)
+	return s.Broadcast(body, headers)
+}
+
+func (s *SenderBroadcast) Eof(eof comms.Eof, headers Table) error {
+	body := eof.Encode()
+	return s.Broadcast(body, headers)
+}
+
+func (s *SenderBroadcast) Flush(flush comms.Flush, headers Table) error {
+	body := flush.Encode()
+	err := s.Broadcast(body, headers)
+
+	clientId := int(headers["client-id"].(int32))
+	for replicaId := range s.seq {
+		delete(s.seq[replicaId], clientId)
+	}
+
+	return err
+}
+
+func (s *SenderBroadcast) Purge(purge comms.Purge, headers Table) error {
+	body := purge.Encode()
+	err := s.broadcast(body, headers, len(s.seq))
+
+	s.seq = make([]map[int]int, s.outputCopies)
+	for i := range s.seq {
+		s.seq[i] = make(map[int]int)
+	}
+
+	return err
+}
+
+// Sends the barrier to the replicas of both the old and the new scale
+func (s *SenderBroadcast) Rescale(rescale comms.Rescale, headers Table) error {
+	rescale.From, rescale.To = rescaled(rescale, s.name, s.outputCopies)
+	rescale.Delivery = DELIVERY_BROADCAST
+	rescale.Keys, rescale.Hot = nil, nil
+
+	copies := max(rescale.From, rescale.To)
+	s.grow(copies)
+	return s.broadcast(rescale.Encode(), headers, copies)
+}
+
+func (s *SenderBroadcast) Broadcast(body []byte, headers Table) error {
+	return s.broadcast(body, headers, s.copies(headers))
+}
+
+func (s *SenderBroadcast) broadcast(body []byte, headers Table, copies int) error {
+	clientId := int(headers["client-id"].(int32))
+
+	for i := range copies {
+		key := fmt.Sprintf(s.fmt, i)
+		headers["seq"] = s.seq[i][clientId]
+		s.seq[i][clientId]++
+
+		if err := s.broker.Publish(key, body, headers); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Example: "broadcast <seq> ... <seq>"
+func (s *SenderBroadcast) Encode(clientId int) []byte {
+	builder := bytes.NewBufferString("broadcast")
+
+	for replicaId := range s.seq {
+		seq := s.seq[replicaId][clientId]
+		builder.WriteRune(' ')
+		builder.WriteString(strconv.Itoa(seq))
+	}
+
+	return builder.Bytes()
+}
+
+// Example: "broadcast <seq> ... <seq>"
+func DecodeLineBroadcast(line string) ([]int, error) {
+	line, _ = strings.CutPrefix(line, "broadcast ")
+
+	parts := strings.Split(line, " ")
+	seqs := make([]int, 0, len(parts))
+	for _, seqStr := range parts {
+		seq, err := strconv.Atoi(seqStr)
+		if err != nil {
+			return nil, fmt.Errorf("seq number is not a number: %s", line)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	return seqs, nil
+}
+
+func (s *SenderBroadcast) SetState(clientId int, seqs []int) error {
+	if len(seqs) < s.outputCopies {
+		return fmt.Errorf("expected at least %d seqs, got %d", s.outputCopies, len(seqs))
+	}
+
+	for len(s.seq) < len(seqs) {
+		s.seq = append(s.seq, make(map[int]int))
+	}
+
+	for i, seq := range seqs {
+		s.seq[i][clientId] = seq
+	}
+
+	return nil
+}
@@ -2,78 +2,350 @@ package middleware
 
 import (
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"analyzer/comms/chaos"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	QUEUE_TRANSIENT = "transient"
+	QUEUE_DURABLE   = "durable"
+	QUEUE_QUORUM    = "quorum"
+)
+
+var QueueTypes = []string{QUEUE_TRANSIENT, QUEUE_DURABLE, QUEUE_QUORUM}
+
+// Times a message is published again after being nacked by the broker server
+const NACK_RETRIES = 3
+
+// Exponential backoff used while (re)connecting to the broker server
+type Backoff struct {
+	Retries int
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Upper bound of the time spent retrying, plus some slack for the topology to be restored
+func (bo Backoff) total() time.Duration {
+	total := bo.Initial
+	delay := bo.Initial
+	for range bo.Retries {
+		total += delay
+		delay = min(2*delay, bo.Max)
+	}
+
+	return total + max(bo.Max, time.Second)
+}
+
+// A message waiting for the broker server's confirmation
+type publishing struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+	ch       *amqp.Channel
+	confirm  *amqp.DeferredConfirmation
+	nacks    int
+}
+
+type exchangeDecl struct {
+	name    string
+	kind    string
+	durable bool
+}
+
+type queueDecl struct {
+	name  string
+	qType string
+}
+
+type bindDecl struct {
+	qName        string
+	key          string
+	exchangeName string
+}
+
+// A consumer outlives the channel it was created on, `resume` hands it the
+// deliveries of the new channel after every reconnection
+type consumer struct {
+	q        Queue
+	name     string
+	prefetch int
+	resume   chan (<-chan amqp.Delivery)
+}
+
 type Broker struct {
-	rxConn             *amqp.Connection
-	txConn             *amqp.Connection
-	rxCh               *amqp.Channel
-	txCh               *amqp.Channel
-	outputExchangeName string
+	url     string
+	backoff Backoff
+
+	mu          sync.RWMutex
+	rxConn      *amqp.Connection
+	txConn      *amqp.Connection
+	rxCh        *amqp.Channel
+	txCh        *amqp.Channel
+	reconnected chan struct{}
+	closed      bool
+	err         error
+
+	// Re-declared after every reconnection
+	exchanges []exchangeDecl
+	queues    []queueDecl
+	bindings  []bindDecl
+	consumers []*consumer
+
+	// Unconfirmed messages, in publishing order
+	pubMu   sync.Mutex
+	pending []*publishing
+	window  int
+
+	outputExchangeName     string
+	outputQTypes           map[string]string
+	persistent             map[string]bool
+	peers                  map[string]bool
+	deadLetterExchangeName string
+	deadLetterQName        string
 }
 
-// Creates a `Broker` and sets the connections to it
-func NewBroker(url string) (*Broker, error) {
-	rxConn, err := amqp.Dial(url)
-	if err != nil {
+// Creates a `Broker` and sets the connections to it, the connections are
+// watched and restored with the given backoff whenever they are lost. At most
+// `window` published messages are left waiting for their confirmation
+func NewBroker(url string, backoff Backoff, window int) (*Broker, error) {
+	b := &Broker{
+		url:                url,
+		backoff:            backoff,
+		reconnected:        make(chan struct{}),
+		window:             max(window, 1),
+		outputExchangeName: "",
+		outputQTypes:       make(map[string]string),
+		persistent:         make(map[string]bool),
+		peers:              make(map[string]bool),
+	}
+
+	if err := b.dial(); err != nil {
 		return nil, err
 	}
 
-	txConn, err := amqp.Dial(url)
+	go b.watch()
+	return b, nil
+}
+
+// Parses a comma separated list of `n` queue types, an empty string keeps every queue transient
+// as a queue that already exists can't be redeclared with another durability
+func ParseQueueTypes(str string, n int) ([]string, error) {
+	if len(str) == 0 {
+		return slices.Repeat([]string{QUEUE_TRANSIENT}, n), nil
+	}
+
+	qTypes := strings.Split(str, ",")
+	if len(qTypes) != n {
+		return nil, fmt.Errorf("expected %d queue types, got %d", n, len(qTypes))
+	}
+
+	for _, qType := range qTypes {
+		if !slices.Contains(QueueTypes, qType) {
+			return nil, fmt.Errorf("invalid queue type %v", qType)
+		}
+	}
+
+	return qTypes, nil
+}
+
+// Parses a comma separated list of `n` booleans, an empty string makes every exchange durable
+func ParseExchangeDurability(str string, n int) ([]bool, error) {
+	if len(str) == 0 {
+		return slices.Repeat([]bool{true}, n), nil
+	}
+
+	parts := strings.Split(str, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d exchange durabilities, got %d", n, len(parts))
+	}
+
+	durables := make([]bool, 0, n)
+	for _, part := range parts {
+		switch part {
+		case "true":
+			durables = append(durables, true)
+		case "false":
+			durables = append(durables, false)
+		default:
+			return nil, fmt.Errorf("invalid exchange durability %v", part)
+		}
+	}
+
+	return durables, nil
+}
+
+// Opens both connections and their channels
+func (b *Broker) connect() error {
+	rxConn, err := amqp.Dial(b.url)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	rxCh, err := rxConn.Channel()
+	txConn, err := amqp.Dial(b.url)
 	if err != nil {
-		return nil, err
+		rxConn.Close()
+		return err
 	}
-	if err := rxCh.Qos(4096, 0, false); err != nil {
-		return nil, err
+
+	b.rxConn = rxConn
+	b.txConn = txConn
+	if err := b.openChannels(); err != nil {
+		rxConn.Close()
+		txConn.Close()
+		return err
 	}
 
-	txCh, err := txConn.Channel()
+	return nil
+}
+
+// Opens a channel on each connection, publishes on the tx one get confirmed
+func (b *Broker) openChannels() error {
+	rxCh, err := b.rxConn.Channel()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	txCh, err := b.txConn.Channel()
+	if err != nil {
+		rxCh.Close()
+		return err
 	}
 	if err := txCh.Confirm(false); err != nil {
-		return nil, err
+		rxCh.Close()
+		txCh.Close()
+		return err
 	}
 
-	return &Broker{
-		rxConn:             rxConn,
-		txConn:             txConn,
-		rxCh:               rxCh,
-		txCh:               txCh,
-		outputExchangeName: "",
-	}, nil
+	b.rxCh = rxCh
+	b.txCh = txCh
+	return nil
 }
 
-// Creates all the broker's infrastructure the node needs to communicate with the broker
-func (b *Broker) Init(id int, inExchNames []string, inQNames []string, outExchName string, outQNames []string, outCopies []int) ([]Queue, error) {
-	inputQs, err := b.InitInput(id, inExchNames, inQNames)
-	if err != nil {
-		return nil, err
+// Connects to the broker server, retrying with exponential backoff
+func (b *Broker) dial() error {
+	delay := b.backoff.Initial
+
+	var err error
+	for retry := range 1 + b.backoff.Retries {
+		if err = b.connect(); err == nil {
+			return nil
+		}
+
+		if retry < b.backoff.Retries {
+			time.Sleep(delay)
+			delay = min(2*delay, b.backoff.Max)
+		}
 	}
 
-	if err := b.InitOutput(outExchName, outQNames, outCopies); err != nil {
-		return nil, err
+	return fmt.Errorf("couldn't connect to the broker after %d retries: %v", b.backoff.Retries, err)
+}
+
+// Waits for any of the connections or channels to be lost, or for a consumer to be
+// cancelled by the broker server, and restores them until the broker is closed
+func (b *Broker) watch() {
+	for {
+		b.mu.RLock()
+		rxConnClosed := b.rxConn.NotifyClose(make(chan *amqp.Error, 1))
+		txConnClosed := b.txConn.NotifyClose(make(chan *amqp.Error, 1))
+		rxChClosed := b.rxCh.NotifyClose(make(chan *amqp.Error, 1))
+		txChClosed := b.txCh.NotifyClose(make(chan *amqp.Error, 1))
+		cancelled := b.rxCh.NotifyCancel(make(chan string, 1))
+		b.mu.RUnlock()
+
+		select {
+		case <-rxConnClosed:
+		case <-txConnClosed:
+		case <-rxChClosed:
+		case <-txChClosed:
+		case <-cancelled:
+		}
+
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			b.closeConsumers()
+			return
+		}
+
+		err := b.reopen()
+		if err != nil {
+			b.closed = true
+			b.err = err
+		}
+
+		close(b.reconnected)
+		b.reconnected = make(chan struct{})
+		b.mu.Unlock()
+
+		if err != nil {
+			b.closeConsumers()
+			return
+		}
+	}
+}
+
+// Reopens the channels, reconnecting if any connection was lost, re-declares the
+// whole topology and resumes every consumer, must hold the lock
+func (b *Broker) reopen() error {
+	b.closeChannels()
+	if b.rxConn.IsClosed() || b.txConn.IsClosed() || b.openChannels() != nil {
+		b.closeConns()
+		if err := b.dial(); err != nil {
+			return err
+		}
+	}
+
+	for _, exch := range b.exchanges {
+		if err := b.declareExchange(exch); err != nil {
+			return fmt.Errorf("failed to re-declare exchange %s: %v", exch.name, err)
+		}
+	}
+
+	for _, q := range b.queues {
+		if err := b.declareQueue(q); err != nil {
+			return fmt.Errorf("failed to re-declare queue %s: %v", q.name, err)
+		}
+	}
+
+	for _, bind := range b.bindings {
+		if err := b.bindQueue(bind); err != nil {
+			return fmt.Errorf("failed to re-bind queue %s: %v", bind.qName, err)
+		}
+	}
+
+	for _, c := range b.consumers {
+		dels, err := b.consume(c)
+		if err != nil {
+			return fmt.Errorf("failed to resume consuming from %s: %v", c.q.Name, err)
+		}
+
+		// Drop a resume that wasn't picked up yet, its channel is already dead
+		select {
+		case <-c.resume:
+		default:
+		}
+		c.resume <- dels
 	}
 
-	return inputQs, nil
+	return nil
 }
 
-// Releases the used external resources
-func (b *Broker) DeInit() {
+func (b *Broker) closeChannels() {
 	if !b.rxCh.IsClosed() {
 		b.rxCh.Close()
 	}
 	if !b.txCh.IsClosed() {
 		b.txCh.Close()
 	}
+}
 
+func (b *Broker) closeConns() {
 	if !b.rxConn.IsClosed() {
 		b.rxConn.Close()
 	}
@@ -82,16 +354,36 @@ func (b *Broker) DeInit() {
 	}
 }
 
+func (b *Broker) closeConsumers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range b.consumers {
+		close(c.resume)
+	}
+	b.consumers = nil
+}
+
+// Releases the used external resources
+func (b *Broker) DeInit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.closeChannels()
+	b.closeConns()
+}
+
 // Creates the broker's infrastructure for the input of this particular node
-func (b *Broker) InitInput(id int, exchangeNames []string, qNames []string) ([]Queue, error) {
+func (b *Broker) InitInput(id int, exchangeNames []string, exchangeDurables []bool, qNames []string, qTypes []string) ([]Queue, error) {
 	qs := make([]Queue, 0)
 	for i := range exchangeNames {
-		if err := b.exchangeDeclare(exchangeNames[i], "direct"); err != nil {
+		if err := b.exchangeDeclare(exchangeNames[i], "direct", exchangeDurables[i]); err != nil {
 			return nil, err
 		}
 
 		qName := fmt.Sprintf("%s-%d", qNames[i], id)
-		q, err := b.queueDeclare(qName)
+		q, err := b.queueDeclare(qName, qTypes[i])
 		if err != nil {
 			return nil, err
 		}
@@ -105,39 +397,76 @@ func (b *Broker) InitInput(id int, exchangeNames []string, qNames []string) ([]Q
 	return qs, nil
 }
 
-// Creates the broker's infrastructure for the input of this particular node
-func (b *Broker) InitOutput(exchangeName string, qNames []string, qCopies []int) error {
-	if err := b.exchangeDeclare(exchangeName, "direct"); err != nil {
+// Creates the broker's infrastructure for the output of this particular node
+func (b *Broker) InitOutput(exchangeName string, exchangeDurable bool, qNames []string, qTypes []string, qCopies []int) error {
+	if err := b.exchangeDeclare(exchangeName, "direct", exchangeDurable); err != nil {
 		return err
 	}
 
+	b.outputExchangeName = exchangeName
 	for i := range qNames {
-		nameFmt := qNames[i] + "-%d"
+		b.outputQTypes[qNames[i]] = qTypes[i]
 
 		for id := range qCopies[i] {
-			qName := fmt.Sprintf(nameFmt, id)
-
-			q, err := b.queueDeclare(qName)
-			if err != nil {
-				return err
-			}
-
-			if err := b.queueBind(q.Name, q.Name, exchangeName); err != nil {
+			if err := b.declareOutput(fmt.Sprintf("%s-%d", qNames[i], id), qTypes[i]); err != nil {
 				return err
 			}
 		}
 	}
 
-	b.outputExchangeName = exchangeName
 	return nil
 }
 
+// Declares an output queue and binds it to the output exchange
+func (b *Broker) declareOutput(qName string, qType string) error {
+	q, err := b.queueDeclare(qName, qType)
+	if err != nil {
+		return err
+	}
+
+	// Messages are routed by queue name
+	b.persistent[q.Name] = qType != QUEUE_TRANSIENT
+	return b.queueBind(q.Name, q.Name, b.outputExchangeName)
+}
+
+// The queues of replicas added by a rescale are declared the first time they're published to
+func (b *Broker) ensureOutput(key string) error {
+	if _, ok := b.persistent[key]; ok {
+		return nil
+	}
+
+	i := strings.LastIndex(key, "-")
+	if i == -1 {
+		return nil
+	}
+
+	qType, ok := b.outputQTypes[key[:i]]
+	if !ok {
+		return nil
+	}
+
+	return b.declareOutput(key, qType)
+}
+
 // Declares an exchange with the given name and kind
-func (b *Broker) exchangeDeclare(name string, kind string) error {
+func (b *Broker) exchangeDeclare(name string, kind string, durable bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	decl := exchangeDecl{name, kind, durable}
+	if err := b.declareExchange(decl); err != nil {
+		return err
+	}
+
+	b.exchanges = append(b.exchanges, decl)
+	return nil
+}
+
+func (b *Broker) declareExchange(decl exchangeDecl) error {
 	return b.txCh.ExchangeDeclare(
-		name,
-		kind,
-		true,  // durable
+		decl.name,
+		decl.kind,
+		decl.durable,
 		false, // auto-deleted
 		false, // internal
 		false, // no-wait
@@ -145,40 +474,113 @@ func (b *Broker) exchangeDeclare(name string, kind string) error {
 	)
 }
 
-// Declares a queue ith the given name and returns it
-func (b *Broker) queueDeclare(name string) (Queue, error) {
-	_, err := b.txCh.QueueDeclare(
-		name,
-		false, // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+// Declares a queue with the given name and type and returns it
+func (b *Broker) queueDeclare(name string, qType string) (Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	if err != nil {
+	decl := queueDecl{name, qType}
+	if err := b.declareQueue(decl); err != nil {
 		return Queue{}, err
 	}
 
+	b.queues = append(b.queues, decl)
 	return NewQueue(name), nil
 }
 
+func (b *Broker) declareQueue(decl queueDecl) error {
+	var args amqp.Table
+	if decl.qType == QUEUE_QUORUM {
+		args = amqp.Table{amqp.QueueTypeArg: amqp.QueueTypeQuorum}
+	}
+
+	_, err := b.txCh.QueueDeclare(
+		decl.name,
+		decl.qType != QUEUE_TRANSIENT, // durable
+		false,                         // delete when unused
+		false,                         // exclusive
+		false,                         // no-wait
+		args,                          // arguments
+	)
+
+	return err
+}
+
 // Declares a queue binding from the given queue to the given exchange using `key`
 func (b *Broker) queueBind(qName, key, exchangeName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	decl := bindDecl{qName, key, exchangeName}
+	if err := b.bindQueue(decl); err != nil {
+		return err
+	}
+
+	b.bindings = append(b.bindings, decl)
+	return nil
+}
+
+func (b *Broker) bindQueue(decl bindDecl) error {
 	return b.txCh.QueueBind(
-		qName,
-		key,
-		exchangeName,
+		decl.qName,
+		decl.key,
+		decl.exchangeName,
 		false, // no-wait
 		nil,   // args
 	)
 }
 
-// Returns a channel used to consume deliveries sent by the broker server
-func (b *Broker) Consume(q Queue, consumer string) (<-chan amqp.Delivery, error) {
+// Returns a channel used to consume deliveries sent by the broker server,
+// at most `prefetch` deliveries will be left unacknowledged for this consumer.
+// The channel survives reconnections, it's only closed once the broker is
+// closed or gives up reconnecting. Deliveries received before a reconnection
+// can't be acked anymore, the broker server will deliver them again
+func (b *Broker) Consume(q Queue, name string, prefetch int) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := &consumer{
+		q:        q,
+		name:     name,
+		prefetch: prefetch,
+		resume:   make(chan (<-chan amqp.Delivery), 1),
+	}
+
+	dels, err := b.consume(c)
+	if err != nil {
+		return nil, err
+	}
+	b.consumers = append(b.consumers, c)
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+
+		for {
+			for del := range dels {
+				chaos.Point(chaos.POINT_CONSUME)
+				out <- del
+			}
+
+			var ok bool
+			if dels, ok = <-c.resume; !ok {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (b *Broker) consume(c *consumer) (<-chan amqp.Delivery, error) {
+	// Qos only applies to the consumers created after it on this channel
+	if err := b.rxCh.Qos(c.prefetch, 0, false); err != nil {
+		return nil, err
+	}
+
 	return b.rxCh.Consume(
-		q.Name,
-		consumer,
+		c.q.Name,
+		c.name,
 		false, // auto-ack
 		false, // exclusive
 		false, // no-local
@@ -187,32 +589,226 @@ func (b *Broker) Consume(q Queue, consumer string) (<-chan amqp.Delivery, error)
 	)
 }
 
-// Publishes a message to the broker server using the given key, will wait for server confirmation
+// Publishes a message to the broker server using the given key without waiting for its
+// confirmation, unless the window of unconfirmed messages is full. Messages routed to
+// durable queues are marked as persistent so they survive a broker restart.
+// `Confirm` must be called to make sure every published message made it
 func (b *Broker) Publish(key string, body []byte, headers amqp.Table) error {
-	waiter, err := b.txCh.PublishWithDeferredConfirm(
-		b.outputExchangeName,
-		key,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			ContentType: "application/octet-stream",
-			Body:        body,
-			Headers:     headers,
-		})
+	if err := b.ensureOutput(key); err != nil {
+		return fmt.Errorf("couldn't declare the output queue %s: %v", key, err)
+	}
+
+	deliveryMode := amqp.Transient
+	if b.persistent[key] {
+		deliveryMode = amqp.Persistent
+	}
+
+	return b.enqueue(b.outputExchangeName, key, amqp.Publishing{
+		ContentType:  "application/octet-stream",
+		DeliveryMode: deliveryMode,
+		Body:         body,
+		Headers:      headers,
+	})
+}
+
+// Publishes a message straight to the input queue of another replica of the same stage,
+// the queue is declared the first time in case that replica wasn't started yet
+func (b *Broker) PublishPeer(exchangeName string, qName string, qType string, body []byte, headers amqp.Table) error {
+	persistent, ok := b.peers[qName]
+	if !ok {
+		q, err := b.queueDeclare(qName, qType)
+		if err != nil {
+			return fmt.Errorf("couldn't declare the peer queue %s: %v", qName, err)
+		}
+		if err := b.queueBind(q.Name, q.Name, exchangeName); err != nil {
+			return fmt.Errorf("couldn't bind the peer queue %s: %v", qName, err)
+		}
+
+		persistent = qType != QUEUE_TRANSIENT
+		b.peers[qName] = persistent
+	}
+
+	deliveryMode := amqp.Transient
+	if persistent {
+		deliveryMode = amqp.Persistent
+	}
 
+	return b.enqueue(exchangeName, qName, amqp.Publishing{
+		ContentType:  "application/octet-stream",
+		DeliveryMode: deliveryMode,
+		Body:         body,
+		Headers:      headers,
+	})
+}
+
+// Declares the durable exchange and queue where the messages that couldn't be processed are parked
+func (b *Broker) InitDeadLetter(exchangeName string, qName string) error {
+	if err := b.exchangeDeclare(exchangeName, "direct", true); err != nil {
+		return err
+	}
+
+	q, err := b.queueDeclare(qName, QUEUE_DURABLE)
 	if err != nil {
 		return err
 	}
 
-	if !waiter.Wait() {
-		return fmt.Errorf("failed to wait on publishment")
+	if err := b.queueBind(q.Name, q.Name, exchangeName); err != nil {
+		return err
 	}
 
+	b.deadLetterExchangeName = exchangeName
+	b.deadLetterQName = q.Name
 	return nil
 }
 
+// Publishes a message that couldn't be processed to the dead letter queue, it's
+// confirmed along with the rest of the published messages
+func (b *Broker) DeadLetter(body []byte, headers amqp.Table) error {
+	if len(b.deadLetterQName) == 0 {
+		return fmt.Errorf("the dead letter queue was not initialized")
+	}
+
+	return b.enqueue(b.deadLetterExchangeName, b.deadLetterQName, amqp.Publishing{
+		ContentType:  "application/octet-stream",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+		Headers:      headers,
+	})
+}
+
+func (b *Broker) enqueue(exchange string, key string, msg amqp.Publishing) error {
+	p := &publishing{
+		exchange: exchange,
+		key:      key,
+		msg:      msg,
+	}
+
+	chaos.Point(chaos.POINT_PUBLISH)
+	if chaos.Drop(chaos.POINT_PUBLISH) {
+		return nil
+	}
+
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	if err := b.publish(p); err != nil {
+		return err
+	}
+	b.pending = append(b.pending, p)
+
+	for len(b.pending) > b.window {
+		if err := b.settleOldest(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Waits till every message published so far is confirmed by the broker server,
+// the nacked ones and the ones lost with the connection are published again
+func (b *Broker) Confirm() error {
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	for len(b.pending) > 0 {
+		if err := b.settleOldest(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Waits for the oldest pending message to be confirmed, must hold `pubMu`.
+// On failure every pending message is dropped, they are up to the caller now
+func (b *Broker) settleOldest() error {
+	p := b.pending[0]
+
+	for !p.confirm.Wait() {
+		// The channel being closed means the message was lost with the connection
+		if !p.ch.IsClosed() {
+			if p.nacks >= NACK_RETRIES {
+				b.pending = nil
+				return fmt.Errorf("message for %s was nacked %d times", p.key, p.nacks+1)
+			}
+			p.nacks++
+		}
+
+		if err := b.publish(p); err != nil {
+			b.pending = nil
+			return err
+		}
+	}
+
+	b.pending = b.pending[1:]
+	return nil
+}
+
+// Hands the message to the broker server, waiting for the channel to be
+// restored if it's lost. Gives up if it takes longer than the whole backoff
+func (b *Broker) publish(p *publishing) error {
+	for {
+		b.mu.RLock()
+		txCh, reconnected, closed, closeErr := b.txCh, b.reconnected, b.closed, b.err
+		b.mu.RUnlock()
+
+		if closed {
+			return fmt.Errorf("the broker is closed: %v", closeErr)
+		}
+
+		confirm, err := txCh.PublishWithDeferredConfirm(
+			p.exchange,
+			p.key,
+			false, // mandatory
+			false, // immediate
+			p.msg,
+		)
+
+		if err == nil {
+			p.ch = txCh
+			p.confirm = confirm
+			return nil
+		}
+
+		if !txCh.IsClosed() {
+			return err
+		}
+
+		select {
+		case <-reconnected:
+		case <-time.After(b.backoff.total()):
+			return fmt.Errorf("timed out waiting for the broker to reconnect: %v", err)
+		}
+	}
+}
+
+// Returns the amount of messages ready to be delivered from the given queue
+func (b *Broker) QueueLength(q Queue) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// Passive declarations only check the name, the rest is ignored
+	state, err := b.rxCh.QueueDeclarePassive(
+		q.Name,
+		false, // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return state.Messages, nil
+}
+
 // Clears the messages of a given queue
 func (b *Broker) Purge(q Queue) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	_, err := b.rxCh.QueuePurge(q.Name, false)
 	return err
 }
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"os"
 	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -8,11 +9,21 @@ import (
 
 type Table = amqp.Table
 
+// Headers carried by dead lettered deliveries
+const (
+	HEADER_FAILURES    = "failures"
+	HEADER_REPLAYED    = "replayed"
+	HEADER_DL_QUEUE    = "dl-queue"
+	HEADER_DL_EXCHANGE = "dl-exchange"
+	HEADER_DL_ERROR    = "dl-error"
+)
+
 // Id to unequivocally identify a delivery
 type DelId struct {
 	ReplicaId int
 	Seq       int
 	ClientId  int
+	Replayed  bool
 }
 
 // The headers of all deliveries
@@ -22,6 +33,17 @@ type Headers struct {
 	Seq       int
 	Query     int
 	Kind      int
+
+	// Times it was dead lettered and whether it's being replayed out of sequence
+	Failures int
+	Replayed bool
+
+	// Replicas each stage processes the client with and how many replicas
+	// of the sending stage there are, empty and zero if they weren't rescaled.
+	// The epoch counts the rescales the sender went through for the client
+	Scale  string
+	Copies int
+	Epoch  int
 }
 
 // Middleware delivery imlpementation
@@ -30,6 +52,10 @@ type Delivery struct {
 	Body    []byte
 	del     amqp.Delivery
 	mu      *sync.Mutex
+
+	// Path of the file holding this delivery if it was spilled to disk,
+	// the broker's delivery has already been acked in that case
+	spillPath string
 }
 
 // Creates a new delivery, the mutex will be unlocked when the delivery is acked
@@ -47,6 +73,21 @@ func NewDelivery(del amqp.Delivery, mu *sync.Mutex) Delivery {
 		headers.Query = -1
 	}
 
+	if failures, ok := del.Headers[HEADER_FAILURES]; ok {
+		headers.Failures = int(failures.(int32))
+	}
+	_, headers.Replayed = del.Headers[HEADER_REPLAYED]
+
+	if scale, ok := del.Headers[HEADER_SCALE]; ok {
+		headers.Scale = scale.(string)
+	}
+	if copies, ok := del.Headers[HEADER_COPIES]; ok {
+		headers.Copies = int(copies.(int32))
+	}
+	if epoch, ok := del.Headers[HEADER_EPOCH]; ok {
+		headers.Epoch = int(epoch.(int32))
+	}
+
 	return Delivery{
 		Headers: headers,
 		Body:    del.Body,
@@ -55,21 +96,77 @@ func NewDelivery(del amqp.Delivery, mu *sync.Mutex) Delivery {
 	}
 }
 
+// Creates a delivery out of one that was read back from disk, acking it
+// removes the file found at `path`
+func newSpilledDelivery(headers Headers, body []byte, path string, mu *sync.Mutex) Delivery {
+	return Delivery{
+		Headers:   headers,
+		Body:      body,
+		mu:        mu,
+		spillPath: path,
+	}
+}
+
 // Returns the id that corresponds with this delivery
 func (d Delivery) Id() DelId {
 	return DelId{
 		ReplicaId: d.Headers.ReplicaId,
 		Seq:       d.Headers.Seq,
 		ClientId:  d.Headers.ClientId,
+		Replayed:  d.Headers.Replayed,
 	}
 }
 
-// Sends an ack to the delivery's sender, waits till confirmation
+// Returns the headers this delivery was published with
+func (d Delivery) Table() Table {
+	table := Table{
+		"kind":       int32(d.Headers.Kind),
+		"replica-id": int32(d.Headers.ReplicaId),
+		"client-id":  int32(d.Headers.ClientId),
+		"seq":        int32(d.Headers.Seq),
+	}
+
+	if d.Headers.Query >= 0 {
+		table["query"] = int32(d.Headers.Query)
+	}
+	if len(d.Headers.Scale) > 0 {
+		table[HEADER_SCALE] = d.Headers.Scale
+	}
+	if d.Headers.Copies > 0 {
+		table[HEADER_COPIES] = int32(d.Headers.Copies)
+	}
+	if d.Headers.Epoch > 0 {
+		table[HEADER_EPOCH] = int32(d.Headers.Epoch)
+	}
+
+	return table
+}
+
+// Sends an ack to the delivery's sender, waits till confirmation. The mutex gets
+// unlocked even on failure, an unacked delivery is redelivered and discarded as a
+// duplicate as the receiver already moved past it
 func (d Delivery) Ack(multiple bool) error {
-	if err := d.del.Ack(multiple); err != nil {
+	defer d.mu.Unlock()
+
+	if len(d.spillPath) > 0 {
+		if err := os.Remove(d.spillPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := d.del.Ack(multiple); err != nil {
 		return err
 	}
 
-	d.mu.Unlock()
 	return nil
 }
+
+// Gives the delivery back to the broker to be delivered again, a spilled one is
+// kept on disk. The receiver already moved past it, so whoever nacks it must
+// restart without persisting its state for it to be processed again
+func (d Delivery) Nack() error {
+	defer d.mu.Unlock()
+
+	if len(d.spillPath) > 0 {
+		return nil
+	}
+	return d.del.Nack(false, true)
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"analyzer/comms"
+)
+
+// Keys are hashed into a fixed amount of slots, each slot is owned by a replica
+const PARTITION_SLOTS = 1024
+
+// Headers carrying the scale a client is processed with, and how many times it was
+// rescaled while it was being processed
+const (
+	HEADER_SCALE  = "scale"
+	HEADER_COPIES = "copies"
+	HEADER_EPOCH  = "epoch"
+)
+
+// Delivery types of the senders
+const (
+	DELIVERY_ROBIN     = "robin"
+	DELIVERY_SHARD     = "shard"
+	DELIVERY_BROADCAST = "broadcast"
+)
+
+// Owners of every slot for each amount of replicas
+var partitions sync.Map
+
+// Each slot is owned by the replica with the highest score for it (rendezvous hashing),
+// so going from n to n+1 replicas only moves the slots the new replica wins and going
+// from n to n-1 only moves the ones the removed replica had
+func slotOwners(replicas int) []int {
+	if owners, ok := partitions.Load(replicas); ok {
+		return owners.([]int)
+	}
+
+	owners := make([]int, PARTITION_SLOTS)
+	buf := make([]byte, 16)
+	for slot := range owners {
+		best := uint64(0)
+		for replica := range replicas {
+			binary.LittleEndian.PutUint64(buf[:8], uint64(slot))
+			binary.LittleEndian.PutUint64(buf[8:], uint64(replica))
+			if score := keyHash(string(buf)); replica == 0 || score > best {
+				best = score
+				owners[slot] = replica
+			}
+		}
+	}
+
+	partitions.Store(replicas, owners)
+	return owners
+}
+
+// Returns the replica out of `replicas` that owns the given key
+func Owner(key string, replicas int) int {
+	return slotOwners(replicas)[keyHash(key)%PARTITION_SLOTS]
+}
+
+// Returns the replicas out of `replicas` that get the rows with the given key from the
+// sender described by `rescale`, and whether each of them gets all of those rows or just
+// a part. `key` is the one the sender shards with, the rest of the senders ignore it
+func Placement(rescale comms.Rescale, key string, replicas int) ([]int, bool) {
+	if rescale.Delivery != DELIVERY_SHARD {
+		all := make([]int, replicas)
+		for i := range all {
+			all[i] = i
+		}
+		return all, rescale.Delivery == DELIVERY_BROADCAST
+	}
+
+	owner := Owner(key, replicas)
+	split := min(rescale.Split, replicas)
+	if split <= 1 || !slices.Contains(rescale.Hot, key) {
+		return []int{owner}, false
+	}
+
+	holders := make([]int, 0, split)
+	for j := range split {
+		holders = append(holders, (owner+j)%replicas)
+	}
+	return holders, rescale.Replicate
+}
+
+// Amount of replicas of each stage a client is processed with, by the name of the stage's queue
+type Scale map[string]int
+
+// Example: "groupby-actor_count=3,join-filter-id_id=2"
+func ParseScale(s string) (Scale, error) {
+	scale := make(Scale)
+	if len(s) == 0 {
+		return scale, nil
+	}
+
+	for entry := range strings.SplitSeq(s, ",") {
+		name, replicasStr, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || len(name) == 0 {
+			return nil, fmt.Errorf("the entry %q is not of the form <queue>=<replicas>", entry)
+		}
+
+		replicas, err := strconv.Atoi(replicasStr)
+		if err != nil || replicas <= 0 {
+			return nil, fmt.Errorf("the replicas of %s must be a positive number: %q", name, replicasStr)
+		}
+
+		scale[name] = replicas
+	}
+
+	return scale, nil
+}
+
+// Reads a scale written one entry per line, blank lines and the ones starting with '#' are
+// skipped. There's no scale if `path` is empty
+func LoadScale(path string) (Scale, error) {
+	if len(path) == 0 {
+		return Scale{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]string, 0)
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+
+	return ParseScale(strings.Join(entries, ","))
+}
+
+func (s Scale) String() string {
+	entries := make([]string, 0, len(s))
+	for _, name := range slices.Sorted(maps.Keys(s)) {
+		entries = append(entries, fmt.Sprintf("%s=%d", name, s[name]))
+	}
+
+	return strings.Join(entries, ",")
+}
+
+// Returns the replicas of the stage reading from the queue named `qName`, or
+// `copies` if the scale doesn't change them
+func (s Scale) Copies(qName string, copies int) int {
+	if replicas, ok := s[qName]; ok {
+		return replicas
+	}
+	return copies
+}
+
+// Returns the replicas of the stage reading from the queue named `qName` before and after the rescale
+func rescaled(rescale comms.Rescale, qName string, copies int) (int, int) {
+	from, _ := ParseScale(rescale.Old)
+	to, _ := ParseScale(rescale.New)
+	return from.Copies(qName, copies), to.Copies(qName, copies)
+}
+
+// Returns the scale found in the headers, it's empty if there's none or it's invalid
+func scaleOf(headers Table) Scale {
+	value, ok := headers[HEADER_SCALE].(string)
+	if !ok {
+		return Scale{}
+	}
+
+	scale, err := ParseScale(value)
+	if err != nil {
+		return Scale{}
+	}
+
+	return scale
+}
@@ -3,9 +3,12 @@ package middleware
 import (
 	"bytes"
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"analyzer/comms"
 
@@ -13,19 +16,29 @@ import (
 )
 
 type Receiver struct {
-	broker *Broker
-	mailer Dumpable
-	mu     *sync.Mutex
-	copies int
+	broker   *Broker
+	mailer   Dumpable
+	mu       *sync.Mutex
+	copies   int
+	prefetch int
+	bufSize  int
 
 	// Persisted
 	q         Queue
 	eofs      map[int]int
 	flushes   map[int]int
+	barriers  map[int]map[int]int
 	expecting []map[int]int
+	spill     *spill
+
+	// Out of order deliveries held in memory or spilled, read by the health checks
+	held atomic.Int64
 }
 
-func NewReceiver(broker *Broker, q Queue, copies int, mailer Dumpable, mu *sync.Mutex) *Receiver {
+// Creates a receiver that reorders the deliveries of `q`. At most `bufSize` out of order
+// deliveries are held in memory, the rest are spilled to disk and acked so they don't
+// take up the prefetch window. A non positive `bufSize` keeps every delivery in memory
+func NewReceiver(broker *Broker, q Queue, copies int, prefetch int, bufSize int, mailer Dumpable, mu *sync.Mutex) *Receiver {
 	expecting := make([]map[int]int, copies)
 	for i := range expecting {
 		expecting[i] = make(map[int]int)
@@ -34,17 +47,28 @@ func NewReceiver(broker *Broker, q Queue, copies int, mailer Dumpable, mu *sync.
 	return &Receiver{
 		broker:    broker,
 		copies:    copies,
+		prefetch:  prefetch,
+		bufSize:   bufSize,
 		mailer:    mailer,
 		mu:        mu,
 		q:         q,
 		expecting: expecting,
 		eofs:      make(map[int]int),
 		flushes:   make(map[int]int),
+		barriers:  make(map[int]map[int]int),
+		spill:     newSpill(q.Name, copies),
 	}
 }
 
 func (r *Receiver) Consume(consumer string) (<-chan Delivery, error) {
-	recv, err := r.broker.Consume(r.q, consumer)
+	if r.bufSize > 0 {
+		if err := r.spill.load(r.expecting); err != nil {
+			return nil, fmt.Errorf("couldn't load spilled deliveries for %s: %v", r.q.Name, err)
+		}
+		r.grow(len(r.spill.seqs) - 1)
+	}
+
+	recv, err := r.broker.Consume(r.q, consumer, r.prefetch)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't start consuming through receiver: %v", err)
 	}
@@ -52,70 +76,151 @@ func (r *Receiver) Consume(consumer string) (<-chan Delivery, error) {
 	ordered := make(chan Delivery)
 	go func() {
 		defer close(ordered)
-		copies := r.copies
+		buffered := 0
 
-		bufs := make([]map[int]map[int]amqp.Delivery, copies)
+		bufs := make([]map[int]map[int]amqp.Delivery, len(r.expecting))
 		for i := range bufs {
 			bufs[i] = make(map[int]map[int]amqp.Delivery)
 		}
 
-		for del := range recv {
+		// Handles a delivery, returning once it's held or handed over along with
+		// the ones it made ready
+		receive := func(del amqp.Delivery) {
 			replicaId := int(del.Headers["replica-id"].(int32))
 			clientId := int(del.Headers["client-id"].(int32))
 			seq := int(del.Headers["seq"].(int32))
+			kind := int(del.Headers["kind"].(int32))
+
+			// Handoffs come from the other replicas of this stage, out of the sequence
+			if kind == comms.HANDOFF {
+				r.mu.Lock()
+				ordered <- NewDelivery(del, r.mu)
+				return
+			}
+
+			// A replica added by a rescale of the sending stage
+			if replicaId >= len(bufs) {
+				r.mu.Lock()
+				r.grow(replicaId)
+				r.mu.Unlock()
+
+				for len(bufs) <= replicaId {
+					bufs = append(bufs, make(map[int]map[int]amqp.Delivery))
+				}
+			}
+
+			// Replayed dead letters are out of the sequence, hand them right away unless
+			// their client was already flushed or purged, the original was processed then
+			if _, ok := del.Headers[HEADER_REPLAYED]; ok {
+				if seq >= r.expecting[replicaId][clientId] {
+					del.Ack(false)
+					return
+				}
+
+				r.mu.Lock()
+				ordered <- NewDelivery(del, r.mu)
+				return
+			}
 
 			if _, ok := bufs[replicaId][clientId]; !ok {
 				bufs[replicaId][clientId] = make(map[int]amqp.Delivery)
 			}
 
-			if seq < r.expecting[replicaId][clientId] {
+			// Already processed, or a redelivery of one that's already held
+			if seq < r.expecting[replicaId][clientId] || r.spill.has(replicaId, clientId, seq) {
 				del.Ack(false)
-				continue
+				return
+			}
+
+			// Redelivered after a reconnection, the held one can't be acked anymore
+			if _, ok := bufs[replicaId][clientId][seq]; ok {
+				bufs[replicaId][clientId][seq] = del
+				return
+			}
+
+			// Only batches are spilled, control messages are few and must
+			// survive the clean up they trigger on the spilled files
+			outOfOrder := seq != r.expecting[replicaId][clientId]
+			if outOfOrder && kind == comms.BATCH && r.bufSize > 0 && buffered >= r.bufSize {
+				if err := r.spill.store(replicaId, clientId, seq, del); err != nil {
+					// Keep it in memory, the broker will hold on to it
+					bufs[replicaId][clientId][seq] = del
+					buffered++
+				} else {
+					del.Ack(false)
+				}
+				return
 			}
 
 			bufs[replicaId][clientId][seq] = del
+			buffered++
+
 			for {
 				expected := r.expecting[replicaId][clientId]
-				next, ok := bufs[replicaId][clientId][expected]
-				if !ok {
+				var next Delivery
+
+				if buffedDel, ok := bufs[replicaId][clientId][expected]; ok {
+					delete(bufs[replicaId][clientId], expected)
+					buffered--
+
+					// Stop here until worker has Ack'd it's last delivery
+					// so not to change `expecting` table before it got the
+					// chance to persist it's state.
+					r.mu.Lock()
+					next = NewDelivery(buffedDel, r.mu)
+				} else if r.spill.has(replicaId, clientId, expected) {
+					headers, body, path, err := r.spill.take(replicaId, clientId, expected)
+					if err != nil {
+						break
+					}
+
+					r.mu.Lock()
+					next = newSpilledDelivery(headers, body, path, r.mu)
+				} else {
 					break
 				}
 
-				delete(bufs[replicaId][clientId], expected)
-				kind := int(next.Headers["kind"].(int32))
-
-				// Stop here until worker has Ack'd it's last delivery
-				// so not to change `expecting` table before it got the
-				// chance to persist it's state.
-				r.mu.Lock()
-
-				switch kind {
+				switch next.Headers.Kind {
 				case comms.FLUSH:
+					buffered -= len(bufs[replicaId][clientId])
 					delete(r.expecting[replicaId], clientId)
 					delete(bufs[replicaId], clientId)
+					r.spill.flush(replicaId, clientId)
 				case comms.PURGE:
-					for i := range copies {
+					for i := range bufs {
 						r.expecting[i] = make(map[int]int)
 						bufs[i] = make(map[int]map[int]amqp.Delivery)
 					}
+					buffered = 0
+					r.spill.purge()
 				default:
 					r.expecting[replicaId][clientId]++
 				}
 
-				ordered <- NewDelivery(next, r.mu)
+				ordered <- next
 			}
 		}
+
+		for del := range recv {
+			receive(del)
+			r.held.Store(int64(buffered + r.spill.n))
+		}
 	}()
 
 	counted := make(chan Delivery)
 	go func() {
 		defer close(counted)
-		copies := r.copies
 
 		for del := range ordered {
 			kind := del.Headers.Kind
 			clientId := del.Headers.ClientId
 
+			// The sending stage may have been rescaled for this client
+			copies := r.copies
+			if del.Headers.Copies > 0 {
+				copies = del.Headers.Copies
+			}
+
 			switch kind {
 			case comms.EOF:
 				r.eofs[clientId]++
@@ -135,10 +240,28 @@ func (r *Receiver) Consume(consumer string) (<-chan Delivery, error) {
 
 				delete(r.eofs, clientId)
 				delete(r.flushes, clientId)
+				delete(r.barriers, clientId)
+
+			case comms.RESCALE:
+				// The barriers of the next rescale may come from replicas that are done with this one
+				epoch := del.Headers.Epoch
+				if _, ok := r.barriers[clientId]; !ok {
+					r.barriers[clientId] = make(map[int]int)
+				}
+
+				r.barriers[clientId][epoch]++
+				if r.barriers[clientId][epoch] < copies {
+					r.mailer.Dump(clientId)
+					del.Ack(false)
+					continue
+				}
+
+				delete(r.barriers[clientId], epoch)
 
 			case comms.PURGE:
 				r.eofs = make(map[int]int)
 				r.flushes = make(map[int]int)
+				r.barriers = make(map[int]map[int]int)
 			}
 
 			counted <- del
@@ -148,6 +271,18 @@ func (r *Receiver) Consume(consumer string) (<-chan Delivery, error) {
 	return counted, nil
 }
 
+// Returns the amount of out of order deliveries held in memory or spilled
+func (r *Receiver) Held() int {
+	return int(r.held.Load())
+}
+
+// Makes room for the sequence numbers of replicas added by a rescale
+func (r *Receiver) grow(replicaId int) {
+	for len(r.expecting) <= replicaId {
+		r.expecting = append(r.expecting, make(map[int]int))
+	}
+}
+
 // Example: "recv <qName> <eofs> <flushes> <seq> ... <seq>"
 func (r *Receiver) Encode(clientId int) []byte {
 	init := fmt.Appendf(nil, "recv %s %d %d", r.q.Name, r.eofs[clientId], r.flushes[clientId])
@@ -199,14 +334,60 @@ func DecodeLineRecv(line string) (string, int, int, []int, error) {
 	return qName, eofs, flushes, seqs, nil
 }
 
+// Example: "barriers <qName> <epoch>=<barriers> ... <epoch>=<barriers>", it's empty if
+// no rescale of the client is waiting on more barriers
+func (r *Receiver) EncodeBarriers(clientId int) []byte {
+	if len(r.barriers[clientId]) == 0 {
+		return nil
+	}
+
+	builder := bytes.NewBufferString("barriers " + r.q.Name)
+	for _, epoch := range slices.Sorted(maps.Keys(r.barriers[clientId])) {
+		fmt.Fprintf(builder, " %d=%d", epoch, r.barriers[clientId][epoch])
+	}
+
+	return builder.Bytes()
+}
+
+// Example: "barriers <qName> <epoch>=<barriers> ... <epoch>=<barriers>"
+func DecodeLineBarriers(line string) (string, map[int]int, error) {
+	line, _ = strings.CutPrefix(line, "barriers ")
+
+	parts := strings.Split(line, " ")
+	if len(parts) < 2 {
+		return "", nil, fmt.Errorf("the amount of parts is not enough: %s", line)
+	}
+
+	barriers := make(map[int]int, len(parts)-1)
+	for _, part := range parts[1:] {
+		epochStr, countStr, found := strings.Cut(part, "=")
+		epoch, err := strconv.Atoi(epochStr)
+		if err != nil || !found {
+			return "", nil, fmt.Errorf("epoch is not a number: %s", line)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil {
+			return "", nil, fmt.Errorf("barrier count is not a number: %s", line)
+		}
+		barriers[epoch] = count
+	}
+
+	return parts[0], barriers, nil
+}
+
+func (r *Receiver) SetBarriers(clientId int, barriers map[int]int) {
+	r.barriers[clientId] = barriers
+}
+
 func (r *Receiver) SetState(clientId, eofs, flushes int, seqs []int) error {
-	if len(seqs) != r.copies {
-		return fmt.Errorf("expected %d sequence numbers, got %d for client %d in receiver %s", r.copies, len(seqs), clientId, r.q.Name)
+	if len(seqs) < r.copies {
+		return fmt.Errorf("expected at least %d sequence numbers, got %d for client %d in receiver %s", r.copies, len(seqs), clientId, r.q.Name)
 	}
 
 	r.eofs[clientId] = eofs
 	r.flushes[clientId] = flushes
 
+	r.grow(len(seqs) - 1)
 	for replicaId, seq := range seqs {
 		r.expecting[replicaId][clientId] = seq
 	}
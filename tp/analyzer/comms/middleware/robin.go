@@ -13,6 +13,7 @@ type SenderRobin struct {
 	broker       *Broker
 	outputCopies int
 	fmt          string
+	name         string
 
 	// Persisted
 	cur map[int]int
@@ -28,12 +29,27 @@ func NewRobin(broker *Broker, fmt string, outputCopies int) *SenderRobin {
 	return &SenderRobin{
 		broker:       broker,
 		fmt:          fmt,
+		name:         strings.TrimSuffix(fmt, "-%d"),
 		outputCopies: outputCopies,
 		cur:          make(map[int]int),
 		seq:          seq,
 	}
 }
 
+// Returns the replicas the client's messages are spread over, the ones
+// beyond the initial copies get their sequence numbers on demand
+func (s *SenderRobin) copies(headers Table) int {
+	copies := scaleOf(headers).Copies(s.name, s.outputCopies)
+	s.grow(copies)
+	return copies
+}
+
+func (s *SenderRobin) grow(copies int) {
+	for len(s.seq) < copies {
+		s.seq = append(s.seq, make(map[int]int))
+	}
+}
+
 func (s *SenderRobin) Batch(batch comms.Batch, filterCols map[string]struct{}, headers Table) error {
 	body := batch.Encode(filterCols)
 	return s.Direct(body, headers)
@@ -49,7 +65,7 @@ func (s *SenderRobin) Flush(flush comms.Flush, headers Table) error {
 	err := s.Broadcast(body, headers)
 
 	clientId := int(headers["client-id"].(int32))
-	for replicaId := range s.outputCopies {
+	for replicaId := range s.seq {
 		delete(s.seq[replicaId], clientId)
 	}
 
@@ -59,7 +75,7 @@ func (s *SenderRobin) Flush(flush comms.Flush, headers Table) error {
 
 func (s *SenderRobin) Purge(purge comms.Purge, headers Table) error {
 	body := purge.Encode()
-	err := s.Broadcast(body, headers)
+	err := s.broadcast(body, headers, len(s.seq))
 
 	s.seq = make([]map[int]int, s.outputCopies)
 	for i := range s.seq {
@@ -70,26 +86,45 @@ func (s *SenderRobin) Purge(purge comms.Purge, headers Table) error {
 	return err
 }
 
-func (s *SenderRobin) nextKeySeq(clientId int) (string, int) {
-	i := s.cur[clientId]
+// Sends the barrier to the replicas of both the old and the new scale
+func (s *SenderRobin) Rescale(rescale comms.Rescale, headers Table) error {
+	rescale.From, rescale.To = rescaled(rescale, s.name, s.outputCopies)
+	rescale.Delivery = DELIVERY_ROBIN
+	rescale.Keys, rescale.Hot = nil, nil
+
+	copies := max(rescale.From, rescale.To)
+	s.grow(copies)
+	return s.broadcast(rescale.Encode(), headers, copies)
+}
+
+func (s *SenderRobin) nextKeySeq(clientId int, copies int) (string, int) {
+	i := s.cur[clientId] % copies
 	key := fmt.Sprintf(s.fmt, i)
 	seq := s.seq[i][clientId]
 
 	s.seq[i][clientId]++
-	s.cur[clientId] = (i + 1) % s.outputCopies
+	s.cur[clientId] = (i + 1) % copies
 	return key, seq
 }
 
 func (s *SenderRobin) Direct(body []byte, headers Table) error {
+	return s.direct(body, headers, s.copies(headers))
+}
+
+func (s *SenderRobin) direct(body []byte, headers Table, copies int) error {
 	clientId := int(headers["client-id"].(int32))
-	key, seq := s.nextKeySeq(clientId)
+	key, seq := s.nextKeySeq(clientId, copies)
 	headers["seq"] = seq
 	return s.broker.Publish(key, body, headers)
 }
 
 func (s *SenderRobin) Broadcast(body []byte, headers Table) error {
-	for range s.outputCopies {
-		if err := s.Direct(body, headers); err != nil {
+	return s.broadcast(body, headers, s.copies(headers))
+}
+
+func (s *SenderRobin) broadcast(body []byte, headers Table, copies int) error {
+	for range copies {
+		if err := s.direct(body, headers, copies); err != nil {
 			return err
 		}
 	}
@@ -139,14 +174,18 @@ func DecodeLineRobin(line string) (int, []int, error) {
 }
 
 func (s *SenderRobin) SetState(clientId int, cur int, seqs []int) error {
-	if len(seqs) != s.outputCopies {
-		return fmt.Errorf("expected %d seqs, got %d", s.outputCopies, len(seqs))
+	if len(seqs) < s.outputCopies {
+		return fmt.Errorf("expected at least %d seqs, got %d", s.outputCopies, len(seqs))
+	}
+
+	for len(s.seq) < len(seqs) {
+		s.seq = append(s.seq, make(map[int]int))
 	}
 
 	s.cur[clientId] = cur
 
-	for i := range s.seq {
-		s.seq[i][clientId] = seqs[i]
+	for i, seq := range seqs {
+		s.seq[i][clientId] = seq
 	}
 
 	return nil
@@ -9,5 +9,6 @@ type Sender interface {
 	Eof(comms.Eof, Table) error
 	Flush(comms.Flush, Table) error
 	Purge(comms.Purge, Table) error
+	Rescale(comms.Rescale, Table) error
 	Encode(int) []byte
 }
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"maps"
+	"slices"
 	"strconv"
 	"strings"
 
 	"analyzer/comms"
+	"analyzer/comms/chaos"
 
 	"github.com/op/go-logging"
 )
@@ -18,12 +21,22 @@ type SenderShard struct {
 	outputCopies int
 	keys         []string
 	fmt          string
+	name         string
+	hot          HotKeys
 
 	// Persisted
 	seq []map[int]int
 }
 
-func NewShard(broker *Broker, qFmt string, keys []string, outputCopies int, log *logging.Logger) *SenderShard {
+// Keys spread over several replicas so they don't make one of them the straggler, the
+// rows of a hot key are split among them or, for the small side of a join, replicated
+type HotKeys struct {
+	Keys      map[string]struct{}
+	Split     int
+	Replicate bool
+}
+
+func NewShard(broker *Broker, qFmt string, keys []string, outputCopies int, hot HotKeys, log *logging.Logger) *SenderShard {
 	seq := make([]map[int]int, outputCopies)
 	for i := range seq {
 		seq[i] = make(map[int]int)
@@ -33,12 +46,28 @@ func NewShard(broker *Broker, qFmt string, keys []string, outputCopies int, log
 		broker:       broker,
 		fmt:          qFmt,
 		keys:         keys,
+		name:         strings.TrimSuffix(qFmt, "-%d"),
+		hot:          hot,
 		outputCopies: outputCopies,
 		log:          log,
 		seq:          seq,
 	}
 }
 
+// Returns the replicas the client's messages are sharded to, the ones
+// beyond the initial copies get their sequence numbers on demand
+func (s *SenderShard) copies(headers Table) int {
+	copies := scaleOf(headers).Copies(s.name, s.outputCopies)
+	s.grow(copies)
+	return copies
+}
+
+func (s *SenderShard) grow(copies int) {
+	for len(s.seq) < copies {
+		s.seq = append(s.seq, make(map[int]int))
+	}
+}
+
 func (s *SenderShard) nextKeySeq(i int, clientId int) (string, int) {
 	key := fmt.Sprintf(s.fmt, i)
 	seq := s.seq[i][clientId]
@@ -53,16 +82,54 @@ func keyHash(str string) uint64 {
 	return h.Sum64()
 }
 
+// Returns the replicas each row goes to. A hot key starts at its owner and takes the
+// following replicas, rows are split among them by their position counting every message
+// sent before, which is persisted, so a batch is routed the same way when it's sent again
+func (s *SenderShard) shard(fieldMaps []map[string]string, clientId int, copies int) (map[int][]map[string]string, error) {
+	shards := make(map[int][]map[string]string)
+	split := min(s.hot.Split, copies)
+
+	sent := 0
+	for i := range s.seq {
+		sent += s.seq[i][clientId]
+	}
+
+	for i, fieldMap := range fieldMaps {
+		compKey, err := comms.ShardKey(fieldMap, s.keys)
+		if err != nil {
+			return nil, err
+		}
+
+		owner := Owner(compKey, copies)
+		if _, ok := s.hot.Keys[compKey]; !ok || split <= 1 {
+			shards[owner] = append(shards[owner], fieldMap)
+			continue
+		}
+
+		if s.hot.Replicate {
+			for j := range split {
+				replica := (owner + j) % copies
+				shards[replica] = append(shards[replica], fieldMap)
+			}
+			continue
+		}
+
+		replica := (owner + (sent+i)%split) % copies
+		shards[replica] = append(shards[replica], fieldMap)
+	}
+
+	return shards, nil
+}
+
 func (s *SenderShard) Batch(batch comms.Batch, filterCols map[string]struct{}, headers Table) error {
-	shards, err := comms.Shard(batch.FieldMaps, s.keys, func(str string) int {
-		return int(keyHash(str) % uint64(s.outputCopies))
-	})
+	copies := s.copies(headers)
+	clientId := int(headers["client-id"].(int32))
+
+	shards, err := s.shard(batch.FieldMaps, clientId, copies)
 	if err != nil {
 		return err
 	}
 
-	clientId := int(headers["client-id"].(int32))
-
 	for i, shard := range shards {
 		key, seq := s.nextKeySeq(i, clientId)
 		body := comms.NewBatch(shard).Encode(filterCols)
@@ -71,6 +138,7 @@ func (s *SenderShard) Batch(batch comms.Batch, filterCols map[string]struct{}, h
 			s.log.Errorf("error while publishing sharded message to %d: %v", i, err)
 			return err
 		}
+		chaos.Point(chaos.POINT_SHARD_BATCH)
 	}
 
 	return nil
@@ -86,7 +154,7 @@ func (s *SenderShard) Flush(flush comms.Flush, headers Table) error {
 	err := s.Broadcast(body, headers)
 
 	clientId := int(headers["client-id"].(int32))
-	for replicaId := range s.outputCopies {
+	for replicaId := range s.seq {
 		delete(s.seq[replicaId], clientId)
 	}
 
@@ -95,7 +163,7 @@ func (s *SenderShard) Flush(flush comms.Flush, headers Table) error {
 
 func (s *SenderShard) Purge(purge comms.Purge, headers Table) error {
 	body := purge.Encode()
-	err := s.Broadcast(body, headers)
+	err := s.broadcast(body, headers, len(s.seq))
 
 	s.seq = make([]map[int]int, s.outputCopies)
 	for i := range s.seq {
@@ -105,10 +173,29 @@ func (s *SenderShard) Purge(purge comms.Purge, headers Table) error {
 	return err
 }
 
+// Sends the barrier to the replicas of both the old and the new scale, along with
+// the keys and hot keys the rows are sharded with
+func (s *SenderShard) Rescale(rescale comms.Rescale, headers Table) error {
+	rescale.From, rescale.To = rescaled(rescale, s.name, s.outputCopies)
+	rescale.Delivery = DELIVERY_SHARD
+	rescale.Keys = s.keys
+	rescale.Hot = slices.Sorted(maps.Keys(s.hot.Keys))
+	rescale.Split = s.hot.Split
+	rescale.Replicate = s.hot.Replicate
+
+	copies := max(rescale.From, rescale.To)
+	s.grow(copies)
+	return s.broadcast(rescale.Encode(), headers, copies)
+}
+
 func (s *SenderShard) Broadcast(body []byte, headers Table) error {
+	return s.broadcast(body, headers, s.copies(headers))
+}
+
+func (s *SenderShard) broadcast(body []byte, headers Table, copies int) error {
 	clientId := int(headers["client-id"].(int32))
 
-	for i := range s.outputCopies {
+	for i := range copies {
 		key, seq := s.nextKeySeq(i, clientId)
 		headers["seq"] = seq
 		if err := s.broker.Publish(key, body, headers); err != nil {
@@ -156,8 +243,12 @@ func DecodeLineShard(line string) ([]int, error) {
 }
 
 func (s *SenderShard) SetState(clientId int, seqs []int) error {
-	if len(seqs) != s.outputCopies {
-		return fmt.Errorf("expected %d seqs, got %d", s.outputCopies, len(seqs))
+	if len(seqs) < s.outputCopies {
+		return fmt.Errorf("expected at least %d seqs, got %d", s.outputCopies, len(seqs))
+	}
+
+	for len(s.seq) < len(seqs) {
+		s.seq = append(s.seq, make(map[int]int))
 	}
 
 	for i, seq := range seqs {
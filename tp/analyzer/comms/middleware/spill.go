@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"analyzer/comms"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const SPILL_DIRNAME = "spill"
+
+// Out of order deliveries that were written to disk and acked to the broker,
+// laid out as "/spill/<qName>/<replicaId>/<clientId>/<seq>"
+type spill struct {
+	dirPath string
+	seqs    []map[int]map[int]struct{}
+	n       int
+}
+
+func newSpill(qName string, copies int) *spill {
+	seqs := make([]map[int]map[int]struct{}, copies)
+	for i := range seqs {
+		seqs[i] = make(map[int]map[int]struct{})
+	}
+
+	return &spill{
+		dirPath: fmt.Sprintf("/%s/%s", SPILL_DIRNAME, qName),
+		seqs:    seqs,
+	}
+}
+
+func (s *spill) clientDir(replicaId, clientId int) string {
+	return fmt.Sprintf("%s/%d/%d", s.dirPath, replicaId, clientId)
+}
+
+// Indexes every delivery found on disk, the ones that were already
+// processed according to `expecting` get removed
+func (s *spill) load(expecting []map[int]int) error {
+	replicaDirs, err := os.ReadDir(s.dirPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spilled replicas: %v", err)
+	}
+
+	for _, replicaDir := range replicaDirs {
+		replicaId, err := strconv.Atoi(replicaDir.Name())
+		if err != nil {
+			continue
+		}
+		s.grow(replicaId)
+
+		clientDirs, err := os.ReadDir(fmt.Sprintf("%s/%d", s.dirPath, replicaId))
+		if err != nil {
+			return fmt.Errorf("failed to read spilled clients of replica %d: %v", replicaId, err)
+		}
+
+		for _, clientDir := range clientDirs {
+			clientId, err := strconv.Atoi(clientDir.Name())
+			if err != nil {
+				continue
+			}
+
+			files, err := os.ReadDir(s.clientDir(replicaId, clientId))
+			if err != nil {
+				return fmt.Errorf("failed to read spilled deliveries of client %d: %v", clientId, err)
+			}
+
+			for _, file := range files {
+				name := file.Name()
+				if strings.HasSuffix(name, ".tmp") {
+					continue
+				}
+
+				seq, err := strconv.Atoi(name)
+				if err != nil {
+					continue
+				}
+
+				if replicaId < len(expecting) && seq < expecting[replicaId][clientId] {
+					os.Remove(fmt.Sprintf("%s/%s", s.clientDir(replicaId, clientId), name))
+					continue
+				}
+
+				s.index(replicaId, clientId, seq)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Makes room for the deliveries of replicas added by a rescale
+func (s *spill) grow(replicaId int) {
+	for len(s.seqs) <= replicaId {
+		s.seqs = append(s.seqs, make(map[int]map[int]struct{}))
+	}
+}
+
+func (s *spill) index(replicaId, clientId, seq int) {
+	s.grow(replicaId)
+	if _, ok := s.seqs[replicaId][clientId]; !ok {
+		s.seqs[replicaId][clientId] = make(map[int]struct{})
+	}
+	if _, ok := s.seqs[replicaId][clientId][seq]; !ok {
+		s.n++
+	}
+	s.seqs[replicaId][clientId][seq] = struct{}{}
+}
+
+// Example: "<kind> <query> <copies> <scale> <failures> <epoch>\n<body>", the scale is "-" if there's none
+func (s *spill) store(replicaId, clientId, seq int, del amqp.Delivery) error {
+	query := int32(-1)
+	if q, ok := del.Headers["query"]; ok {
+		query = q.(int32)
+	}
+
+	copies := int32(0)
+	if c, ok := del.Headers[HEADER_COPIES]; ok {
+		copies = c.(int32)
+	}
+
+	scale := "-"
+	if sc, ok := del.Headers[HEADER_SCALE].(string); ok && len(sc) > 0 {
+		scale = sc
+	}
+
+	failures := int32(0)
+	if f, ok := del.Headers[HEADER_FAILURES]; ok {
+		failures = f.(int32)
+	}
+
+	epoch := int32(0)
+	if e, ok := del.Headers[HEADER_EPOCH]; ok {
+		epoch = e.(int32)
+	}
+
+	data := fmt.Appendf(nil, "%d %d %d %s %d %d\n", del.Headers["kind"].(int32), query, copies, scale, failures, epoch)
+	data = append(data, del.Body...)
+
+	if err := comms.AtomicWrite(s.clientDir(replicaId, clientId), strconv.Itoa(seq), data); err != nil {
+		return err
+	}
+
+	s.index(replicaId, clientId, seq)
+	return nil
+}
+
+func (s *spill) has(replicaId, clientId, seq int) bool {
+	if replicaId >= len(s.seqs) {
+		return false
+	}
+	_, ok := s.seqs[replicaId][clientId][seq]
+	return ok
+}
+
+// Reads back a spilled delivery, its file is kept until the delivery gets acked.
+// The delivery stays indexed if it couldn't be read so it can be taken again
+func (s *spill) take(replicaId, clientId, seq int) (Headers, []byte, string, error) {
+	path := fmt.Sprintf("%s/%d", s.clientDir(replicaId, clientId), seq)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Headers{}, nil, "", fmt.Errorf("failed to read spilled delivery %s: %v", path, err)
+	}
+	delete(s.seqs[replicaId][clientId], seq)
+	s.n--
+
+	header, body, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return Headers{}, nil, "", fmt.Errorf("spilled delivery %s has no header", path)
+	}
+
+	// Deliveries spilled before the failures and the epoch were kept have 4 or 5 parts
+	parts := strings.Split(string(header), " ")
+	if len(parts) < 4 || len(parts) > 6 {
+		return Headers{}, nil, "", fmt.Errorf("the amount of parts is not enough: %s", header)
+	}
+
+	kind, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Headers{}, nil, "", fmt.Errorf("kind is not a number: %s", header)
+	}
+
+	query, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Headers{}, nil, "", fmt.Errorf("query is not a number: %s", header)
+	}
+
+	copies, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return Headers{}, nil, "", fmt.Errorf("copies is not a number: %s", header)
+	}
+
+	headers := Headers{
+		ReplicaId: replicaId,
+		ClientId:  clientId,
+		Seq:       seq,
+		Query:     query,
+		Kind:      kind,
+		Copies:    copies,
+	}
+	if parts[3] != "-" {
+		headers.Scale = parts[3]
+	}
+	if len(parts) >= 5 {
+		if headers.Failures, err = strconv.Atoi(parts[4]); err != nil {
+			return Headers{}, nil, "", fmt.Errorf("failures is not a number: %s", header)
+		}
+	}
+	if len(parts) == 6 {
+		if headers.Epoch, err = strconv.Atoi(parts[5]); err != nil {
+			return Headers{}, nil, "", fmt.Errorf("epoch is not a number: %s", header)
+		}
+	}
+
+	return headers, body, path, nil
+}
+
+func (s *spill) flush(replicaId, clientId int) error {
+	s.grow(replicaId)
+	s.n -= len(s.seqs[replicaId][clientId])
+	delete(s.seqs[replicaId], clientId)
+	return os.RemoveAll(s.clientDir(replicaId, clientId))
+}
+
+func (s *spill) purge() error {
+	for i := range s.seqs {
+		s.seqs[i] = make(map[int]map[int]struct{})
+	}
+	s.n = 0
+	return os.RemoveAll(s.dirPath)
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"analyzer/comms"
+	"analyzer/comms/chaos"
 	"analyzer/comms/middleware"
 
 	"github.com/op/go-logging"
@@ -18,12 +19,31 @@ import (
 
 type PersistedHeader struct {
 	Seqs []int
+
+	// Replayed deliveries are out of sequence, they are kept apart by the
+	// replica and seq they were originally sent with
+	Replays [][2]int
 }
 
 func (h PersistedHeader) IsDup(id middleware.DelId) bool {
-	replicaId := id.ReplicaId
-	seq := id.Seq
-	return seq <= h.Seqs[replicaId]
+	if id.Replayed {
+		return h.HasReplay(id)
+	}
+
+	return id.Seq <= h.Seq(id.ReplicaId)
+}
+
+func (h PersistedHeader) HasReplay(id middleware.DelId) bool {
+	return slices.Contains(h.Replays, [2]int{id.ReplicaId, id.Seq})
+}
+
+// Returns the last sequence number stored for the replica, replicas added
+// by a rescale may not have one yet
+func (h PersistedHeader) Seq(replicaId int) int {
+	if replicaId >= len(h.Seqs) {
+		return -1
+	}
+	return h.Seqs[replicaId]
 }
 
 type PersistedFile struct {
@@ -33,6 +53,13 @@ type PersistedFile struct {
 	State    []byte
 }
 
+// Marks the headers that start with their length, the ones written before it was
+// added have exactly one sequence number per replica and nothing else
+const HEADER_VERSION = "v2"
+
+// The header is a line with the version and the amount of sequence numbers and replays
+// followed by one line for each of them, there are at least `replicas` sequence numbers.
+// Example: "v2 <n> <r>\n<seq>\n...\n<replicaId> <seq>\n..."
 type Persistor struct {
 	dirName  string
 	replicas int
@@ -67,23 +94,45 @@ func (p Persistor) LoadHeader(clientId int, fileName string) (PersistedHeader, e
 		return empty, fmt.Errorf("couldn't read header of %s for client %d: %v", fileName, clientId, err)
 	}
 
-	seqs := make([]int, 0, p.replicas)
+	defer fp.Close()
+
 	reader := bufio.NewReader(fp)
-	for replicaId := range p.replicas {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return empty, fmt.Errorf("couldn't read lines of header of %s for clinet %d: %v", fileName, clientId, err)
+	}
+
+	n, r, versioned, err := p.parseHeaderLength(line)
+	if err != nil {
+		return empty, fmt.Errorf("couldn't parse the length of the header of %s for client %d: %v", fileName, clientId, err)
+	}
+
+	lines := make([][]byte, 0, n+r)
+	if !versioned {
+		lines = append(lines, line)
+	}
+	for len(lines) < n+r {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
 			return empty, fmt.Errorf("couldn't read lines of header of %s for clinet %d: %v", fileName, clientId, err)
 		}
+		lines = append(lines, line)
+	}
 
-		seq, err := p.parseHeaderLine(line)
-		if err != nil {
-			return empty, fmt.Errorf("couldn't parse seq number of header for replica %d client %d in file %s: %v", replicaId, clientId, fileName, err)
-		}
-
-		seqs = append(seqs, seq)
+	header, err := p.parseHeader(lines[:n], lines[n:])
+	if err != nil {
+		return empty, fmt.Errorf("couldn't parse header of %s for client %d: %v", fileName, clientId, err)
 	}
 
-	return PersistedHeader{seqs}, nil
+	return header, nil
+}
+
+// Makes room for the sequence numbers of `n` replicas
+func (p Persistor) grow(header PersistedHeader, n int) PersistedHeader {
+	for len(header.Seqs) < n {
+		header.Seqs = append(header.Seqs, -1)
+	}
+	return header
 }
 
 func (p Persistor) parseHeaderLine(header []byte) (int, error) {
@@ -96,11 +145,36 @@ func (p Persistor) parseHeaderLine(header []byte) (int, error) {
 	return seq, nil
 }
 
-func (p Persistor) parseHeader(header [][]byte) (PersistedHeader, error) {
+// Returns the amount of sequence numbers and replays, and whether the first line of the
+// header is its length. Otherwise the header is one of `replicas` sequence numbers
+func (p Persistor) parseHeaderLength(line []byte) (int, int, bool, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 || fields[0] != HEADER_VERSION {
+		return p.replicas, 0, false, nil
+	}
+
+	if len(fields) != 3 {
+		return 0, 0, false, fmt.Errorf("the amount of parts is not enough: %s", line)
+	}
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to parse the amount of seq numbers: %v", err)
+	}
+
+	r, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to parse the amount of replays: %v", err)
+	}
+
+	return n, r, true, nil
+}
+
+func (p Persistor) parseHeader(seqLines [][]byte, replayLines [][]byte) (PersistedHeader, error) {
 	empty := PersistedHeader{}
 
 	seqs := make([]int, 0, p.replicas)
-	for _, line := range header {
+	for _, line := range seqLines {
 		seq, err := p.parseHeaderLine(line)
 		if err != nil {
 			return empty, err
@@ -109,17 +183,32 @@ func (p Persistor) parseHeader(header [][]byte) (PersistedHeader, error) {
 		seqs = append(seqs, seq)
 	}
 
-	return PersistedHeader{seqs}, nil
+	replays := make([][2]int, 0, len(replayLines))
+	for _, line := range replayLines {
+		var replicaId, seq int
+		if _, err := fmt.Sscanf(string(line), "%d %d", &replicaId, &seq); err != nil {
+			return empty, fmt.Errorf("failed to parse replay from header: %v", err)
+		}
+
+		replays = append(replays, [2]int{replicaId, seq})
+	}
+
+	return p.grow(PersistedHeader{seqs, replays}, p.replicas), nil
 }
 
 func (p Persistor) encodeHeader(header PersistedHeader) []byte {
-	buf := bytes.NewBuffer(nil)
+	buf := bytes.NewBuffer(fmt.Appendf(nil, "%s %d %d\n", HEADER_VERSION, len(header.Seqs), len(header.Replays)))
 
 	for _, seq := range header.Seqs {
 		str := fmt.Sprintf("%d\n", seq)
 		buf.WriteString(str)
 	}
 
+	for _, replay := range header.Replays {
+		str := fmt.Sprintf("%d %d\n", replay[0], replay[1])
+		buf.WriteString(str)
+	}
+
 	return buf.Bytes()
 }
 
@@ -131,15 +220,23 @@ func (p Persistor) Store(id middleware.DelId, fileName string, data []byte, head
 	header := PersistedHeader{}
 	if len(headers) > 1 {
 		return fmt.Errorf("invalid argument count in persistor.Store")
-	} else if len(headers) == 1 && len(headers[0].Seqs) == p.replicas {
-		header = headers[0]
+	} else if len(headers) == 1 && len(headers[0].Seqs) >= p.replicas {
+		header = PersistedHeader{slices.Clone(headers[0].Seqs), slices.Clone(headers[0].Replays)}
 	} else {
 		header, _ = p.LoadHeader(clientId, fileName)
 	}
 
-	header.Seqs[replicaId] = seq
+	if id.Replayed {
+		if !header.HasReplay(id) {
+			header.Replays = append(header.Replays, [2]int{replicaId, seq})
+		}
+	} else {
+		header = p.grow(header, replicaId+1)
+		header.Seqs[replicaId] = seq
+	}
 	encodedHeader := p.encodeHeader(header)
 
+	chaos.Point(chaos.POINT_PERSISTOR_STORE)
 	dirPath := fmt.Sprintf("/%s/%d", p.dirName, id.ClientId)
 	return comms.AtomicWrite(dirPath, fileName, append(encodedHeader, data...))
 }
@@ -154,9 +251,25 @@ func (p Persistor) Load(clientId int, fileName string) (PersistedFile, error) {
 		return empty, fmt.Errorf("failed to read persistor file %s for client %d: %v", fileName, clientId, err)
 	}
 
-	fields := bytes.SplitN(data, []byte("\n"), p.replicas+1)
+	lenLine, rest, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return empty, fmt.Errorf("file %s for client %d has no header", fileName, clientId)
+	}
 
-	header, err := p.parseHeader(fields[:p.replicas])
+	n, r, versioned, err := p.parseHeaderLength(lenLine)
+	if err != nil {
+		return empty, fmt.Errorf("failed to parse the length of the header at file %s for client %d: %v", fileName, clientId, err)
+	}
+	if !versioned {
+		rest = data
+	}
+
+	fields := bytes.SplitN(rest, []byte("\n"), n+r+1)
+	if len(fields) < n+r+1 {
+		return empty, fmt.Errorf("the header at file %s for client %d is cut short", fileName, clientId)
+	}
+
+	header, err := p.parseHeader(fields[:n], fields[n:n+r])
 	if err != nil {
 		return empty, fmt.Errorf("failed to parse header at file %s for client %d: %v", fileName, clientId, err)
 	}
@@ -171,9 +284,18 @@ func (p Persistor) Load(clientId int, fileName string) (PersistedFile, error) {
 	}, nil
 }
 
+// A client without a directory has nothing persisted
 func (p Persistor) RecoverFor(clientId int) (iter.Seq[PersistedFile], error) {
+	return p.recoverFor(clientId, nil)
+}
+
+// Only the files whose name `keep` accepts are loaded, all of them if it's nil
+func (p Persistor) recoverFor(clientId int, keep func(fileName string) bool) (iter.Seq[PersistedFile], error) {
 	dirPath := fmt.Sprintf("/%s/%d", p.dirName, clientId)
 	files, err := os.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return slices.Values([]PersistedFile{}), nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read files in directory %d: %v", clientId, err)
 	}
@@ -185,7 +307,7 @@ func (p Persistor) RecoverFor(clientId int) (iter.Seq[PersistedFile], error) {
 			}
 
 			name := file.Name()
-			if strings.HasSuffix(name, ".tmp") {
+			if strings.HasSuffix(name, ".tmp") || (keep != nil && !keep(name)) {
 				continue
 			}
 
@@ -203,6 +325,11 @@ func (p Persistor) RecoverFor(clientId int) (iter.Seq[PersistedFile], error) {
 }
 
 func (p Persistor) Recover() (iter.Seq[PersistedFile], error) {
+	return p.RecoverFunc(nil)
+}
+
+// Recovers the files of every client whose name `keep` accepts, the rest aren't read
+func (p Persistor) RecoverFunc(keep func(fileName string) bool) (iter.Seq[PersistedFile], error) {
 	dirPath := fmt.Sprintf("/%s", p.dirName)
 	files, err := os.ReadDir(dirPath)
 	if err != nil {
@@ -221,7 +348,12 @@ func (p Persistor) Recover() (iter.Seq[PersistedFile], error) {
 				continue
 			}
 
-			files, err := p.RecoverFor(clientId)
+			files, err := p.recoverFor(clientId, keep)
+			if err != nil {
+				p.log.Errorf("failed to recover files for client %d: %v", clientId, err)
+				continue
+			}
+
 			for file := range files {
 				if !yield(file) {
 					return
@@ -231,6 +363,71 @@ func (p Persistor) Recover() (iter.Seq[PersistedFile], error) {
 	}, nil
 }
 
+// Returns the name of every file persisted for the client, without reading them
+func (p Persistor) FileNames(clientId int) ([]string, error) {
+	dirPath := fmt.Sprintf("/%s/%d", p.dirName, clientId)
+	files, err := os.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read files in directory %d: %v", clientId, err)
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasSuffix(file.Name(), ".tmp") {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (p Persistor) Remove(clientId int, fileName string) error {
+	path := fmt.Sprintf("/%s/%d/%s", p.dirName, clientId, fileName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Packs the name and state of the files so they can be handed to another replica, the
+// headers are left out. Example: "<fileName> <length>\n<state>..." for each file
+func EncodeFiles(files []PersistedFile) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, file := range files {
+		fmt.Fprintf(buf, "%s %d\n", file.FileName, len(file.State))
+		buf.Write(file.State)
+	}
+	return buf.Bytes()
+}
+
+func DecodeFiles(data []byte) ([]PersistedFile, error) {
+	files := make([]PersistedFile, 0)
+	for len(data) > 0 {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			return nil, fmt.Errorf("the file header %q has no end", line)
+		}
+
+		i := bytes.LastIndexByte(line, ' ')
+		if i == -1 {
+			return nil, fmt.Errorf("the amount of parts is not enough: %s", line)
+		}
+
+		n, err := strconv.Atoi(string(line[i+1:]))
+		if err != nil || n > len(rest) {
+			return nil, fmt.Errorf("the length of the file is invalid: %s", line)
+		}
+
+		files = append(files, PersistedFile{FileName: string(line[:i]), State: rest[:n]})
+		data = rest[n:]
+	}
+
+	return files, nil
+}
+
 func (p Persistor) Flush(clientId int) error {
 	dirPath := fmt.Sprintf("/%s/%d", p.dirName, clientId)
 	return os.RemoveAll(dirPath)
@@ -34,6 +34,24 @@ var name2Id = map[string]int{
 	"country":             15,
 	"actor":               16,
 	"count":               17,
+	"rows":                18,
+	"window_start":        19,
+	"window_end":          20,
+	"min":                 21,
+	"max":                 22,
+	"sum":                 23,
+	"mean":                24,
+	"variance":            25,
+	"stddev":              26,
+	"count_distinct":      27,
+	"median":              28,
+	"p25":                 29,
+	"p75":                 30,
+	"p90":                 31,
+	"p95":                 32,
+	"p99":                 33,
+	"sentiment_score":     34,
+	"confidence":          35,
 }
 
 var id2Name = []string{
@@ -62,6 +80,30 @@ var id2Name = []string{
 	"country",
 	"actor",
 	"count",
+	"rows",
+	"window_start",
+	"window_end",
+	"min",
+	"max",
+	"sum",
+	"mean",
+	"variance",
+	"stddev",
+	"count_distinct",
+	"median",
+	"p25",
+	"p75",
+	"p90",
+	"p95",
+	"p99",
+	"sentiment_score",
+	"confidence",
+}
+
+// Returns whether the protocol can encode the column
+func IsColumn(name string) bool {
+	_, ok := name2Id[name]
+	return ok
 }
 
 const (
@@ -69,6 +111,8 @@ const (
 	EOF
 	FLUSH
 	PURGE
+	RESCALE
+	HANDOFF
 )
 
 type Batch struct {
@@ -261,3 +305,94 @@ func DecodePurge([]byte) Purge {
 func (m Purge) Encode() []byte {
 	return []byte{}
 }
+
+// Barrier sent through the pipeline when the replicas a client is processed with change
+// while it's being processed. Each stage forwards it once it got it from every input, so
+// what was sent before it is routed with the `Old` scale and what comes after it with the
+// `New` one. `From` and `To` are the replicas of the receiving stage before and after it,
+// the rest tells how the sender routes the rows so the state can follow them
+type Rescale struct {
+	Epoch     int
+	From      int
+	To        int
+	Delivery  string
+	Keys      []string
+	Split     int
+	Replicate bool
+	Hot       []string
+	Old       string
+	New       string
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Example: "<epoch> <from> <to> <delivery> <split> <replicate>\n<keys>\n<old>\n<new>\n<hot key>\n..."
+// with the keys joined by ';', there's a line for each hot key
+func (m Rescale) Encode() []byte {
+	buf := bytes.NewBuffer(fmt.Appendf(nil, "%d %d %d %s %d %d\n", m.Epoch, m.From, m.To, m.Delivery, m.Split, boolToInt(m.Replicate)))
+	buf.WriteString(strings.Join(m.Keys, ";"))
+	buf.WriteByte('\n')
+	buf.WriteString(m.Old)
+	buf.WriteByte('\n')
+	buf.WriteString(m.New)
+
+	for _, key := range m.Hot {
+		buf.WriteByte('\n')
+		buf.WriteString(key)
+	}
+
+	return buf.Bytes()
+}
+
+func DecodeRescale(data []byte) (Rescale, error) {
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 4 {
+		return Rescale{}, fmt.Errorf("the amount of lines is not enough: %q", data)
+	}
+
+	var m Rescale
+	var replicate int
+	if _, err := fmt.Sscanf(lines[0], "%d %d %d %s %d %d", &m.Epoch, &m.From, &m.To, &m.Delivery, &m.Split, &replicate); err != nil {
+		return Rescale{}, fmt.Errorf("invalid rescale header %q: %v", lines[0], err)
+	}
+	m.Replicate = replicate == 1
+
+	if len(lines[1]) > 0 {
+		m.Keys = strings.Split(lines[1], ";")
+	}
+	m.Old = lines[2]
+	m.New = lines[3]
+	m.Hot = lines[4:]
+
+	return m, nil
+}
+
+// State a replica hands over to another one of its stage during a rescale
+type Handoff struct {
+	Epoch int
+	State []byte
+}
+
+// Example: "<epoch>\n<state>"
+func (m Handoff) Encode() []byte {
+	return append(fmt.Appendf(nil, "%d\n", m.Epoch), m.State...)
+}
+
+func DecodeHandoff(data []byte) (Handoff, error) {
+	epochStr, state, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return Handoff{}, fmt.Errorf("the handoff has no epoch")
+	}
+
+	epoch, err := strconv.Atoi(string(epochStr))
+	if err != nil {
+		return Handoff{}, fmt.Errorf("epoch is not a number: %s", epochStr)
+	}
+
+	return Handoff{epoch, state}, nil
+}
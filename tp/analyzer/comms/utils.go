@@ -5,25 +5,37 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+
+	"analyzer/comms/chaos"
 )
 
 const SEP = "<|>"
 
+// Returns the values of the keys joined by SEP
+func ShardKey(fieldMap map[string]string, shardKeys []string) (string, error) {
+	keys := make([]string, 0, len(shardKeys))
+	for _, key := range shardKeys {
+		field, ok := fieldMap[key]
+		if !ok {
+			return "", fmt.Errorf("key %v was not found in field map while sharding", key)
+		}
+		keys = append(keys, field)
+	}
+
+	return strings.Join(keys, SEP), nil
+}
+
 func Shard[T comparable](fieldMaps []map[string]string, shardKeys []string, hash func(str string) T) (map[T][]map[string]string, error) {
 	shards := make(map[T][]map[string]string)
 
 	for _, fieldMap := range fieldMaps {
-		keys := make([]string, 0, len(shardKeys))
-		for _, key := range shardKeys {
-			field, ok := fieldMap[key]
-			if !ok {
-				return nil, fmt.Errorf("key %v was not found in field map while sharding", key)
-			}
-			keys = append(keys, field)
+		compKey, err := ShardKey(fieldMap, shardKeys)
+		if err != nil {
+			return nil, err
 		}
 
-		compKey := strings.Join(keys, SEP)
 		shardKey := hash(compKey)
 		shards[shardKey] = append(shards[shardKey], fieldMap)
 	}
@@ -64,6 +76,9 @@ func AtomicWrite(dirPath, fileName string, data []byte) error {
 		return fmt.Errorf("Coudn't sync temp file for path %s/%s: %v", dirPath, fileName, err)
 	}
 
+	// Written but not in place yet
+	chaos.Point(chaos.POINT_ATOMIC_WRITE)
+
 	newFileName := fmt.Sprintf("%s/%s", dirPath, fileName)
 	return os.Rename(tmpFileName, newFileName)
 }
@@ -81,3 +96,15 @@ func IndexN(s []byte, sep rune, n int) int {
 	}
 	return bytes.IndexFunc(s, f)
 }
+
+// Column with the amount of rows a combined row stands for
+const ROWS = "rows"
+
+// Returns the amount of rows the field map stands for, more than one if it was combined upstream
+func Rows(fieldMap map[string]string) int {
+	rows, err := strconv.Atoi(fieldMap[ROWS])
+	if err != nil {
+		return 1
+	}
+	return rows
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const PREVIEW_LEN = 80
+
+// Headers that are only meaningful while the message is dead lettered
+var dlHeaders = []string{
+	middleware.HEADER_DL_QUEUE,
+	middleware.HEADER_DL_EXCHANGE,
+	middleware.HEADER_DL_ERROR,
+}
+
+// Headers kept as strings when a saved message is read back, the rest are numbers
+var stringHeaders = append(slices.Clone(dlHeaders), middleware.HEADER_SCALE)
+
+type DeadLetters struct {
+	conn  *amqp.Connection
+	ch    *amqp.Channel
+	qName string
+}
+
+func NewDeadLetters(url string, qName string) (*DeadLetters, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &DeadLetters{conn, ch, qName}, nil
+}
+
+// Closing the channel gives back every message that was taken but not acked
+func (d *DeadLetters) Close() {
+	d.ch.Close()
+	d.conn.Close()
+}
+
+// Calls `f` for every message that was dead lettered when called, they are kept unacked
+// until `Close` unless `f` acks them, so none of them is seen twice. The ones that get
+// dead lettered meanwhile, like replays that failed again, are left for the next time
+func (d *DeadLetters) forEach(f func(amqp.Delivery) error) error {
+	q, err := d.ch.QueueDeclarePassive(
+		d.qName,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	for range q.Messages {
+		del, ok, err := d.ch.Get(d.qName, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		if err := f(del); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes a line for every dead lettered message
+func (d *DeadLetters) List(w io.Writer) error {
+	n := 0
+	err := d.forEach(func(del amqp.Delivery) error {
+		preview := del.Body
+		if len(preview) > PREVIEW_LEN {
+			preview = preview[:PREVIEW_LEN]
+		}
+
+		fmt.Fprintf(w, "#%d queue=%v client=%v replica=%v seq=%v failures=%v error=%q\n\t%q\n",
+			n,
+			del.Headers[middleware.HEADER_DL_QUEUE],
+			del.Headers["client-id"],
+			del.Headers["replica-id"],
+			del.Headers["seq"],
+			del.Headers[middleware.HEADER_FAILURES],
+			del.Headers[middleware.HEADER_DL_ERROR],
+			preview,
+		)
+
+		n++
+		return nil
+	})
+
+	fmt.Fprintf(w, "%d dead lettered messages\n", n)
+	return err
+}
+
+// Moves every dead lettered message to its own file inside `dirPath`
+func (d *DeadLetters) Export(dirPath string) error {
+	n := 0
+	err := d.forEach(func(del amqp.Delivery) error {
+		fileName := fmt.Sprintf("%d.msg", n)
+		if err := comms.AtomicWrite(dirPath, fileName, encodeMessage(del.Headers, del.Body)); err != nil {
+			return err
+		}
+
+		n++
+		return del.Ack(false)
+	})
+
+	log.Infof("Exported %d messages to %s", n, dirPath)
+	return err
+}
+
+// Sends the dead lettered messages back to the queue they came from, the ones
+// that failed at least `maxFailures` times are left in place. A negative
+// `maxFailures` replays every message
+func (d *DeadLetters) Replay(maxFailures int) error {
+	replayed, skipped := 0, 0
+	err := d.forEach(func(del amqp.Delivery) error {
+		failures, _ := del.Headers[middleware.HEADER_FAILURES].(int32)
+		if maxFailures >= 0 && int(failures) >= maxFailures {
+			skipped++
+			return nil
+		}
+
+		if err := d.replay(del.Headers, del.Body); err != nil {
+			return err
+		}
+
+		replayed++
+		return del.Ack(false)
+	})
+
+	log.Infof("Replayed %d messages, skipped %d", replayed, skipped)
+	return err
+}
+
+// Sends the messages found in `dirPath` back to the queue they came from,
+// each file is removed once its message is confirmed
+func (d *DeadLetters) ReplayDir(dirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".msg") {
+			continue
+		}
+
+		path := fmt.Sprintf("%s/%s", dirPath, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		headers, body, err := decodeMessage(data)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %v", path, err)
+		}
+
+		if err := d.replay(headers, body); err != nil {
+			return err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		replayed++
+	}
+
+	log.Infof("Replayed %d messages from %s", replayed, dirPath)
+	return nil
+}
+
+func (d *DeadLetters) replay(headers amqp.Table, body []byte) error {
+	exchange, ok := headers[middleware.HEADER_DL_EXCHANGE].(string)
+	if !ok {
+		return fmt.Errorf("message has no %s header", middleware.HEADER_DL_EXCHANGE)
+	}
+
+	key, ok := headers[middleware.HEADER_DL_QUEUE].(string)
+	if !ok {
+		return fmt.Errorf("message has no %s header", middleware.HEADER_DL_QUEUE)
+	}
+
+	replayHeaders := make(amqp.Table, len(headers))
+	for k, v := range headers {
+		if !slices.Contains(dlHeaders, k) {
+			replayHeaders[k] = v
+		}
+	}
+	replayHeaders[middleware.HEADER_REPLAYED] = true
+
+	confirm, err := d.ch.PublishWithDeferredConfirm(
+		exchange,
+		key,
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			ContentType:  "application/octet-stream",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+			Headers:      replayHeaders,
+		})
+	if err != nil {
+		return err
+	}
+
+	if !confirm.Wait() {
+		return fmt.Errorf("replay to %s was nacked", key)
+	}
+
+	return nil
+}
+
+// Discards every dead lettered message
+func (d *DeadLetters) Drop() error {
+	n, err := d.ch.QueuePurge(d.qName, false)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Dropped %d messages", n)
+	return nil
+}
+
+// Example: "<key>=<value>\n...\n\n<body>", values are numbers except the dead letter ones and the scale
+func encodeMessage(headers amqp.Table, body []byte) []byte {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	buf := bytes.NewBuffer(nil)
+	for _, k := range keys {
+		value := strings.ReplaceAll(fmt.Sprint(headers[k]), "\n", " ")
+		fmt.Fprintf(buf, "%s=%s\n", k, value)
+	}
+	buf.WriteByte('\n')
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+// Example: "<key>=<value>\n...\n\n<body>", values are numbers except the dead letter ones and the scale
+func decodeMessage(data []byte) (amqp.Table, []byte, error) {
+	head, body, found := bytes.Cut(data, []byte("\n\n"))
+	if !found {
+		return nil, nil, fmt.Errorf("the headers are not followed by an empty line")
+	}
+
+	headers := make(amqp.Table)
+	for _, line := range strings.Split(string(head), "\n") {
+		k, v, found := strings.Cut(line, "=")
+		if !found {
+			return nil, nil, fmt.Errorf("header is not a key value pair: %s", line)
+		}
+
+		if slices.Contains(stringHeaders, k) {
+			headers[k] = v
+			continue
+		}
+
+		// A message that was already replayed once
+		if k == middleware.HEADER_REPLAYED {
+			replayed, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("header %s is not a boolean: %s", k, v)
+			}
+			headers[k] = replayed
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("header %s is not a number: %s", k, v)
+		}
+		headers[k] = int32(n)
+	}
+
+	return headers, body, nil
+}
@@ -5,28 +5,43 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"analyzer/comms/middleware"
 
 	"github.com/op/go-logging"
 )
 
 type Config struct {
 	// .env
-	Url                string
-	Host               string
-	Port               int
-	Backlog            int
-	InputExchangeNames []string
-	InputQueueNames    []string
-	OutputExchangeName string
-	OutputQueueNames   []string
-	HealthCheckPort    uint16
-	LogLevel           logging.Level
-	KeepAliveRetries   int
+	Url                   string
+	Host                  string
+	Port                  int
+	Backlog               int
+	InputExchangeNames    []string
+	InputExchangeDurables []bool
+	InputQueueNames       []string
+	InputQueueTypes       []string
+	OutputExchangeName    string
+	OutputExchangeDurable bool
+	OutputQueueNames      []string
+	OutputQueueTypes      []string
+	HealthCheckPort       uint16
+	LogLevel              logging.Level
+	KeepAliveRetries      int
+	PrefetchPerCopy       int
+	BrokerBackoff         middleware.Backoff
+	PublishWindow         int
+	ScaleFile             string
 
 	// compose
 	Id           int
 	InputCopies  []int
 	OutputCopies []int
+
+	// chaos runner
+	ChaosScenario string
+	NodeName      string
 }
 
 func Create() (Config, error) {
@@ -73,6 +88,18 @@ func Create() (Config, error) {
 		return Config{}, fmt.Errorf("the length of input exchange names and input queue names don't match (exch: %d, names: %d)", len(inputExchangeNames), len(inputQueueNames))
 	}
 
+	// INPUT_EXCHANGE_DURABLE
+	inputExchangeDurables, err := middleware.ParseExchangeDurability(os.Getenv("INPUT_EXCHANGE_DURABLE"), len(inputExchangeNames))
+	if err != nil {
+		return Config{}, fmt.Errorf("the input exchange durabilities are invalid: %v", err)
+	}
+
+	// INPUT_QUEUE_TYPES
+	inputQueueTypes, err := middleware.ParseQueueTypes(os.Getenv("INPUT_QUEUE_TYPES"), len(inputQueueNames))
+	if err != nil {
+		return Config{}, fmt.Errorf("the input queue types are invalid: %v", err)
+	}
+
 	// INPUT_COPIES
 	inputCopies := make([]int, 0)
 	inputCopiesStrings := strings.Split(os.Getenv("INPUT_COPIES"), ",")
@@ -96,6 +123,18 @@ func Create() (Config, error) {
 		return Config{}, fmt.Errorf("no output queue names were provided")
 	}
 
+	// OUTPUT_EXCHANGE_DURABLE
+	outputExchangeDurable, err := middleware.ParseExchangeDurability(os.Getenv("OUTPUT_EXCHANGE_DURABLE"), 1)
+	if err != nil {
+		return Config{}, fmt.Errorf("the output exchange durability is invalid: %v", err)
+	}
+
+	// OUTPUT_QUEUE_TYPES
+	outputQueueTypes, err := middleware.ParseQueueTypes(os.Getenv("OUTPUT_QUEUE_TYPES"), len(outputQueueNames))
+	if err != nil {
+		return Config{}, fmt.Errorf("the output queue types are invalid: %v", err)
+	}
+
 	// OUTPUT_COPIES
 	outputCopies := make([]int, 0)
 	outputCopiesString := strings.Split(os.Getenv("OUTPUT_COPIES"), ",")
@@ -119,6 +158,59 @@ func Create() (Config, error) {
 		return Config{}, fmt.Errorf("the provided keep alive retries value is invalid: %v", err)
 	}
 
+	// PREFETCH_PER_COPY
+	prefetchPerCopy, err := strconv.Atoi(os.Getenv("PREFETCH_PER_COPY"))
+	if err != nil || prefetchPerCopy <= 0 {
+		return Config{}, fmt.Errorf("the provided prefetch per copy value is invalid: %v", os.Getenv("PREFETCH_PER_COPY"))
+	}
+
+	// BROKER_RETRIES
+	brokerRetries, err := strconv.Atoi(os.Getenv("BROKER_RETRIES"))
+	if err != nil || brokerRetries < 0 {
+		return Config{}, fmt.Errorf("the provided broker retries value is invalid: %v", os.Getenv("BROKER_RETRIES"))
+	}
+
+	// BROKER_RETRY_DELAY
+	brokerRetryDelayInt, err := strconv.Atoi(os.Getenv("BROKER_RETRY_DELAY"))
+	if err != nil || brokerRetryDelayInt < 0 {
+		return Config{}, fmt.Errorf("the provided broker retry delay is invalid: %v", os.Getenv("BROKER_RETRY_DELAY"))
+	}
+
+	// BROKER_MAX_RETRY_DELAY
+	brokerMaxRetryDelayInt, err := strconv.Atoi(os.Getenv("BROKER_MAX_RETRY_DELAY"))
+	if err != nil || brokerMaxRetryDelayInt < brokerRetryDelayInt {
+		return Config{}, fmt.Errorf("the provided broker max retry delay is invalid: %v", os.Getenv("BROKER_MAX_RETRY_DELAY"))
+	}
+
+	brokerBackoff := middleware.Backoff{
+		Retries: brokerRetries,
+		Initial: time.Duration(brokerRetryDelayInt) * time.Second,
+		Max:     time.Duration(brokerMaxRetryDelayInt) * time.Second,
+	}
+
+	// PUBLISH_WINDOW
+	publishWindow, err := strconv.Atoi(os.Getenv("PUBLISH_WINDOW"))
+	if err != nil || publishWindow <= 0 {
+		return Config{}, fmt.Errorf("the provided publish window is invalid: %v", os.Getenv("PUBLISH_WINDOW"))
+	}
+
+	// SCALE_FILE
+	scaleFile := os.Getenv("SCALE_FILE")
+	if len(scaleFile) > 0 {
+		if _, err := middleware.LoadScale(scaleFile); err != nil {
+			return Config{}, fmt.Errorf("the provided scale file is invalid: %v", err)
+		}
+	}
+
+	// CHAOS_SCENARIO
+	chaosScenario := os.Getenv("CHAOS_SCENARIO")
+
+	// NODE_NAME
+	nodeName := os.Getenv("NODE_NAME")
+	if len(nodeName) == 0 {
+		nodeName, _ = os.Hostname()
+	}
+
 	// LOG_LEVEL
 	logLevelString := strings.ToUpper(os.Getenv("LOG_LEVEL"))
 	logLevel, err := logging.LogLevel(logLevelString)
@@ -127,19 +219,29 @@ func Create() (Config, error) {
 	}
 
 	return Config{
-		Url:                url,
-		Host:               host,
-		Port:               port,
-		Backlog:            backlog,
-		Id:                 id,
-		InputExchangeNames: inputExchangeNames,
-		InputQueueNames:    inputQueueNames,
-		InputCopies:        inputCopies,
-		OutputExchangeName: outputExchangeName,
-		OutputQueueNames:   outputQueueNames,
-		OutputCopies:       outputCopies,
-		HealthCheckPort:    uint16(healthCheckPort),
-		KeepAliveRetries:   keepAliveRetries,
-		LogLevel:           logLevel,
+		Url:                   url,
+		Host:                  host,
+		Port:                  port,
+		Backlog:               backlog,
+		Id:                    id,
+		InputExchangeNames:    inputExchangeNames,
+		InputExchangeDurables: inputExchangeDurables,
+		InputQueueNames:       inputQueueNames,
+		InputQueueTypes:       inputQueueTypes,
+		InputCopies:           inputCopies,
+		OutputExchangeName:    outputExchangeName,
+		OutputExchangeDurable: outputExchangeDurable[0],
+		OutputQueueNames:      outputQueueNames,
+		OutputQueueTypes:      outputQueueTypes,
+		OutputCopies:          outputCopies,
+		HealthCheckPort:       uint16(healthCheckPort),
+		KeepAliveRetries:      keepAliveRetries,
+		PrefetchPerCopy:       prefetchPerCopy,
+		BrokerBackoff:         brokerBackoff,
+		PublishWindow:         publishWindow,
+		ScaleFile:             scaleFile,
+		LogLevel:              logLevel,
+		ChaosScenario:         chaosScenario,
+		NodeName:              nodeName,
 	}, nil
 }
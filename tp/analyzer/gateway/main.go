@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"analyzer/comms/chaos"
 	"analyzer/gateway/config"
 	"analyzer/gateway/protocol"
 
@@ -28,6 +29,13 @@ func main() {
 	}
 	configLog(con.LogLevel)
 
+	if len(con.ChaosScenario) > 0 {
+		if err := chaos.Init(con.ChaosScenario, con.NodeName, log); err != nil {
+			log.Errorf("Couldn't load chaos: %v", err)
+			return
+		}
+	}
+
 	sv, err := protocol.NewServer(con, log)
 	if err != nil {
 		log.Errorf("Couldn't start server: %v", err)
@@ -21,7 +21,7 @@ type RxMailer struct {
 }
 
 func NewRxMailer(con config.Config, log *logging.Logger) (*RxMailer, error) {
-	broker, err := middleware.NewBroker(con.Url)
+	broker, err := middleware.NewBroker(con.Url, con.BrokerBackoff, con.PublishWindow)
 	if err != nil {
 		return nil, err
 	}
@@ -38,7 +38,9 @@ func (m *RxMailer) initReceivers(inputQs []middleware.Queue, inputCopies []int)
 	mu := new(sync.Mutex)
 
 	for i := range inputQs {
-		recv := middleware.NewReceiver(m.broker, inputQs[i], inputCopies[i], m, mu)
+		// The gateway doesn't persist it's receivers, so nothing is spilled
+		prefetch := m.con.PrefetchPerCopy * inputCopies[i]
+		recv := middleware.NewReceiver(m.broker, inputQs[i], inputCopies[i], prefetch, 0, m, mu)
 		receivers = append(receivers, recv)
 	}
 
@@ -48,10 +50,12 @@ func (m *RxMailer) initReceivers(inputQs []middleware.Queue, inputCopies []int)
 func (m *RxMailer) Init() error {
 	id := m.con.Id
 	inExchNames := m.con.InputExchangeNames
+	inExchDurables := m.con.InputExchangeDurables
 	inQNames := m.con.InputQueueNames
+	inQTypes := m.con.InputQueueTypes
 	inputCopies := m.con.InputCopies
 
-	inputQs, err := m.broker.InitInput(id, inExchNames, inQNames)
+	inputQs, err := m.broker.InitInput(id, inExchNames, inExchDurables, inQNames, inQTypes)
 	if err != nil {
 		return err
 	}
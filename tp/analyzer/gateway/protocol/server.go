@@ -7,6 +7,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	checker "analyzer/checker/impl"
 	"analyzer/comms"
@@ -79,6 +80,16 @@ func (s *Server) clientHandler(conn *CsvTransferStream, clientId int) error {
 		return err
 	}
 	defer mailer.DeInit()
+
+	// Read on every connection so the pipeline can be rescaled while it's running
+	modTime := s.scaleModTime()
+	scale, err := middleware.LoadScale(s.con.ScaleFile)
+	if err != nil {
+		s.log.Errorf("[%d] couldn't read the scale file, using the initial replicas: %v", clientId, err)
+	} else if len(scale) > 0 {
+		s.log.Infof("[%d] Processed with scale %v", clientId, scale)
+	}
+	mailer.SetScale(scale)
 	defer mailer.PublishFlush(clientId, []byte{})
 
 	for range 3 {
@@ -104,6 +115,9 @@ func (s *Server) clientHandler(conn *CsvTransferStream, clientId int) error {
 				break
 
 			} else if msg.Kind == MSG_BATCH {
+				if err := s.rescale(mailer, clientId, &modTime); err != nil {
+					s.log.Errorf("[%d] couldn't rescale the client: %v", clientId, err)
+				}
 				mailer.PublishBatch(fileName, clientId, msg.Data)
 
 			} else if msg.Kind == MSG_ERR {
@@ -120,6 +134,40 @@ func (s *Server) clientHandler(conn *CsvTransferStream, clientId int) error {
 	return nil
 }
 
+// Returns when the scale file was last modified, the zero time if there's none
+func (s *Server) scaleModTime() time.Time {
+	if len(s.con.ScaleFile) == 0 {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(s.con.ScaleFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Rescales the client if the scale file changed since it was last read, so the
+// stages can grow or shrink while it's being sent
+func (s *Server) rescale(mailer *TxMailer, clientId int, modTime *time.Time) error {
+	current := s.scaleModTime()
+	if !current.After(*modTime) {
+		return nil
+	}
+	*modTime = current
+
+	scale, err := middleware.LoadScale(s.con.ScaleFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read the scale file: %v", err)
+	}
+	if len(scale) == 0 || scale.String() == mailer.scale.String() {
+		return nil
+	}
+
+	s.log.Infof("[%d] Rescaled from %v to %v", clientId, mailer.scale, scale)
+	return mailer.Rescale(clientId, scale)
+}
+
 func (s *Server) hasToTerminate() bool {
 	if s.end.Load() {
 		isEmpty := true
@@ -134,7 +182,7 @@ func (s *Server) hasToTerminate() bool {
 
 func (s *Server) recvResults() error {
 	eofsRecv := make(map[int]int)
-	skipped := map[int]struct{}{comms.FLUSH: {}, comms.PURGE: {}}
+	skipped := map[int]struct{}{comms.FLUSH: {}, comms.PURGE: {}, comms.RESCALE: {}, comms.HANDOFF: {}}
 
 	for del := range s.recvChan {
 		kind := del.Headers.Kind
@@ -16,10 +16,15 @@ type TxMailer struct {
 	broker      *middleware.Broker
 	senders     []*middleware.SenderRobin
 	filename2Id map[string]int
+
+	// Replicas the client is processed with, empty if no stage was rescaled, and the
+	// amount of times they changed while it was being sent
+	scale middleware.Scale
+	epoch int
 }
 
 func NewTxMailer(con config.Config, log *logging.Logger) (*TxMailer, error) {
-	broker, err := middleware.NewBroker(con.Url)
+	broker, err := middleware.NewBroker(con.Url, con.BrokerBackoff, con.PublishWindow)
 	if err != nil {
 		return nil, err
 	}
@@ -52,10 +57,12 @@ func (s *TxMailer) initSenders() []*middleware.SenderRobin {
 
 func (s *TxMailer) Init() error {
 	outExchName := s.con.OutputExchangeName
+	outExchDurable := s.con.OutputExchangeDurable
 	outQNames := s.con.OutputQueueNames
+	outQTypes := s.con.OutputQueueTypes
 	outCopies := s.con.OutputCopies
 
-	err := s.broker.InitOutput(outExchName, outQNames, outCopies)
+	err := s.broker.InitOutput(outExchName, outExchDurable, outQNames, outQTypes, outCopies)
 	if err != nil {
 		return err
 	}
@@ -64,30 +71,64 @@ func (s *TxMailer) Init() error {
 	return nil
 }
 
-func (s *TxMailer) PublishBatch(fileName string, clientId int, body []byte) error {
-	baseHeaders := middleware.Table{
-		"kind":       comms.BATCH,
+// Sets the replicas each stage has for the client when it connects
+func (s *TxMailer) SetScale(scale middleware.Scale) {
+	s.scale = scale
+}
+
+// Moves the client to the new replicas while it's being sent, the barrier goes through every
+// stage after the rows sent so far so each one hands its state over before the new rows arrive
+func (s *TxMailer) Rescale(clientId int, scale middleware.Scale) error {
+	s.epoch++
+	rescale := comms.Rescale{
+		Epoch: s.epoch,
+		Old:   s.scale.String(),
+		New:   scale.String(),
+	}
+	s.scale = scale
+
+	baseHeaders := s.headers(comms.RESCALE, clientId)
+	for _, sender := range s.senders {
+		if err := sender.Rescale(rescale, baseHeaders); err != nil {
+			return err
+		}
+	}
+
+	return s.broker.Confirm()
+}
+
+func (s *TxMailer) headers(kind int, clientId int) middleware.Table {
+	headers := middleware.Table{
+		"kind":       kind,
 		"replica-id": s.con.Id,
 		"client-id":  int32(clientId),
 	}
+	if len(s.scale) > 0 {
+		headers[middleware.HEADER_SCALE] = s.scale.String()
+	}
+	if s.epoch > 0 {
+		headers[middleware.HEADER_EPOCH] = int32(s.epoch)
+	}
+
+	return headers
+}
+
+func (s *TxMailer) PublishBatch(fileName string, clientId int, body []byte) error {
+	baseHeaders := s.headers(comms.BATCH, clientId)
 	return s.senders[s.filename2Id[fileName]].Direct(body, baseHeaders)
 }
 
 func (s *TxMailer) PublishEof(fileName string, clientId int, body []byte) error {
-	baseHeaders := middleware.Table{
-		"kind":       comms.EOF,
-		"replica-id": s.con.Id,
-		"client-id":  int32(clientId),
+	baseHeaders := s.headers(comms.EOF, clientId)
+	if err := s.senders[s.filename2Id[fileName]].Broadcast(body, baseHeaders); err != nil {
+		return err
 	}
-	return s.senders[s.filename2Id[fileName]].Broadcast(body, baseHeaders)
+
+	return s.broker.Confirm()
 }
 
 func (s *TxMailer) PublishFlush(clientId int, body []byte) error {
-	baseHeaders := middleware.Table{
-		"kind":       comms.FLUSH,
-		"replica-id": s.con.Id,
-		"client-id":  int32(clientId),
-	}
+	baseHeaders := s.headers(comms.FLUSH, clientId)
 
 	for _, sender := range s.senders {
 		if err := sender.Broadcast(body, baseHeaders); err != nil {
@@ -95,7 +136,7 @@ func (s *TxMailer) PublishFlush(clientId int, body []byte) error {
 		}
 	}
 
-	return nil
+	return s.broker.Confirm()
 }
 
 func (s *TxMailer) PublishPurge(body []byte) error {
@@ -111,7 +152,7 @@ func (s *TxMailer) PublishPurge(body []byte) error {
 		}
 	}
 
-	return nil
+	return s.broker.Confirm()
 }
 
 func (s *TxMailer) DeInit() {
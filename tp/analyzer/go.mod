@@ -3,12 +3,9 @@ module analyzer
 go 1.24.2
 
 require (
+	github.com/cdipaolo/goml v0.0.0-20220715001353-00e0c845ae1c
 	github.com/cdipaolo/sentiment v0.0.0-20200617002423-c697f64e7f10
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/rabbitmq/amqp091-go v1.10.0
-)
-
-require (
-	github.com/cdipaolo/goml v0.0.0-20220715001353-00e0c845ae1c // indirect
-	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/text v0.3.6
 )
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type row struct {
+	key   string
+	value float64
+}
+
+// Values are relatively close, or absolutely for the ones near zero
+func approxEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance*max(1, math.Abs(b))
+}
+
+func readLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// The value is the last column, the key may have commas itself
+func parseRows(lines []string) ([]row, []string) {
+	rows := make([]row, 0, len(lines))
+	problems := make([]string, 0)
+
+	for _, line := range lines {
+		i := strings.LastIndex(line, ",")
+		if i == -1 {
+			problems = append(problems, fmt.Sprintf("line %q has no value", line))
+			continue
+		}
+
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %q has a value that is not a number", line))
+			continue
+		}
+
+		rows = append(rows, row{line[:i], value})
+	}
+
+	return rows, problems
+}
+
+// Same lines in any order
+func checkLines(expected []string, got []string) []string {
+	problems := make([]string, 0)
+
+	counts := make(map[string]int)
+	for _, line := range expected {
+		counts[line]++
+	}
+	for _, line := range got {
+		counts[line]--
+	}
+
+	for _, line := range slices.Sorted(func(yield func(string) bool) {
+		for line := range counts {
+			if !yield(line) {
+				return
+			}
+		}
+	}) {
+		switch n := counts[line]; {
+		case n > 0:
+			problems = append(problems, fmt.Sprintf("missing %q (%d times)", line, n))
+		case n < 0:
+			problems = append(problems, fmt.Sprintf("unexpected %q (%d times)", line, -n))
+		}
+	}
+
+	return problems
+}
+
+// The highest `amount` values in any order, any of the keys tied on the last value is fine
+func checkTop(expected map[string]float64, amount int, got []string, tolerance float64) []string {
+	rows, problems := parseRows(got)
+
+	want := make([]float64, 0, len(expected))
+	for _, value := range expected {
+		want = append(want, value)
+	}
+	slices.Sort(want)
+	slices.Reverse(want)
+	want = want[:min(amount, len(want))]
+
+	if len(rows) != len(want) {
+		problems = append(problems, fmt.Sprintf("expected %d rows, got %d", len(want), len(rows)))
+	}
+
+	seen := make(map[string]bool)
+	values := make([]float64, 0, len(rows))
+	for _, r := range rows {
+		if seen[r.key] {
+			problems = append(problems, fmt.Sprintf("%q appears more than once", r.key))
+		}
+		seen[r.key] = true
+		values = append(values, r.value)
+
+		value, ok := expected[r.key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%q is not expected at all", r.key))
+		} else if !approxEqual(r.value, value, tolerance) {
+			problems = append(problems, fmt.Sprintf("%q has %v, expected %v", r.key, r.value, value))
+		}
+	}
+
+	slices.Sort(values)
+	slices.Reverse(values)
+	for i := range min(len(values), len(want)) {
+		if !approxEqual(values[i], want[i], tolerance) {
+			problems = append(problems, fmt.Sprintf("the value at position %d is %v, expected %v", i+1, values[i], want[i]))
+		}
+	}
+
+	return problems
+}
+
+// The lowest and the highest value, any of the keys tied on them is fine
+func checkMinMax(expected map[string][]float64, got []string, tolerance float64) []string {
+	rows, problems := parseRows(got)
+
+	want := make([]float64, 0)
+	for _, values := range expected {
+		want = append(want, values...)
+	}
+	if len(want) == 0 {
+		if len(rows) > 0 {
+			problems = append(problems, fmt.Sprintf("expected no rows, got %d", len(rows)))
+		}
+		return problems
+	}
+
+	lowest, highest := slices.Min(want), slices.Max(want)
+	if len(rows) != 2 {
+		return append(problems, fmt.Sprintf("expected 2 rows, got %d", len(rows)))
+	}
+
+	values := []float64{rows[0].value, rows[1].value}
+	slices.Sort(values)
+	if !approxEqual(values[0], lowest, tolerance) {
+		problems = append(problems, fmt.Sprintf("the lowest value is %v, expected %v", values[0], lowest))
+	}
+	if !approxEqual(values[1], highest, tolerance) {
+		problems = append(problems, fmt.Sprintf("the highest value is %v, expected %v", values[1], highest))
+	}
+
+	for _, r := range rows {
+		if !slices.ContainsFunc(expected[r.key], func(value float64) bool { return approxEqual(r.value, value, tolerance) }) {
+			problems = append(problems, fmt.Sprintf("%q never has %v", r.key, r.value))
+		}
+	}
+
+	return problems
+}
+
+// A value for every key in any order
+func checkValues(expected map[string]float64, got []string, tolerance float64) []string {
+	rows, problems := parseRows(got)
+
+	seen := make(map[string]bool)
+	for _, r := range rows {
+		if seen[r.key] {
+			problems = append(problems, fmt.Sprintf("%q appears more than once", r.key))
+		}
+		seen[r.key] = true
+
+		value, ok := expected[r.key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%q is not expected at all", r.key))
+		} else if !approxEqual(r.value, value, tolerance) {
+			problems = append(problems, fmt.Sprintf("%q has %v, expected %v", r.key, r.value, value))
+		}
+	}
+
+	for key := range expected {
+		if !seen[key] {
+			problems = append(problems, fmt.Sprintf("%q is missing", key))
+		}
+	}
+
+	return problems
+}
+
+// Returns the problems found on each query's result file in `resultsDir`
+func Verify(ref *Reference, resultsDir string, tolerance float64) map[int][]string {
+	checks := map[int]func([]string) []string{
+		1: func(got []string) []string { return checkLines(ref.Titles, got) },
+		2: func(got []string) []string { return checkTop(ref.Budgets, TOP_BUDGET_AMOUNT, got, tolerance) },
+		3: func(got []string) []string { return checkMinMax(ref.Ratings, got, tolerance) },
+		4: func(got []string) []string { return checkTop(ref.Actors, TOP_ACTORS_AMOUNT, got, tolerance) },
+		5: func(got []string) []string { return checkValues(ref.Rates, got, tolerance) },
+	}
+
+	problems := make(map[int][]string, len(checks))
+	for query, check := range checks {
+		got, err := readLines(fmt.Sprintf("%s/%d.csv", resultsDir, query))
+		if err != nil {
+			problems[query] = []string{err.Error()}
+			continue
+		}
+		problems[query] = check(got)
+	}
+
+	return problems
+}
+
+// Writes the reference results as the client does, ties are broken by key
+func Write(ref *Reference, dirPath string) error {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return err
+	}
+
+	top := func(values map[string]float64, amount int, format string) []string {
+		keys := slices.Sorted(func(yield func(string) bool) {
+			for key := range values {
+				if !yield(key) {
+					return
+				}
+			}
+		})
+		slices.SortStableFunc(keys, func(a, b string) int { return -cmpFloat(values[a], values[b]) })
+
+		lines := make([]string, 0, amount)
+		for _, key := range keys[:min(amount, len(keys))] {
+			lines = append(lines, fmt.Sprintf(format, key, values[key]))
+		}
+		return lines
+	}
+
+	ratings := make([]row, 0)
+	for title, values := range ref.Ratings {
+		for _, value := range values {
+			ratings = append(ratings, row{title, value})
+		}
+	}
+	slices.SortStableFunc(ratings, func(a, b row) int {
+		if c := cmpFloat(a.value, b.value); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	minmax := make([]string, 0, 2)
+	if len(ratings) > 0 {
+		for _, r := range []row{ratings[0], ratings[len(ratings)-1]} {
+			minmax = append(minmax, fmt.Sprintf("%s,%.4f", r.key, r.value))
+		}
+	}
+
+	results := map[int][]string{
+		1: ref.Titles,
+		2: top(ref.Budgets, TOP_BUDGET_AMOUNT, "%s,%.0f"),
+		3: minmax,
+		4: top(ref.Actors, TOP_ACTORS_AMOUNT, "%s,%.0f"),
+		5: top(ref.Rates, len(ref.Rates), "%s,%.4f"),
+	}
+
+	for query, lines := range results {
+		path := fmt.Sprintf("%s/%d.csv", dirPath, query)
+		data := strings.Join(lines, "\n")
+		if len(lines) > 0 {
+			data += "\n"
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"analyzer/workers/sentiment/config"
+
+	"github.com/op/go-logging"
+)
+
+const MAX_SHOWN_PROBLEMS = 10
+
+var log = logging.MustGetLogger("log")
+
+func configLog(logLevel logging.Level) {
+	backend := logging.NewLogBackend(os.Stderr, "", 0)
+	format := logging.MustStringFormatter(`%{time:2006-01-02 15:04:05}	%{level:.4s}	%{message}`)
+	backendFormatter := logging.NewBackendFormatter(backend, format)
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	backendLeveled.SetLevel(logLevel, "log")
+	logging.SetBackend(backendLeveled)
+}
+
+// Sets the variables of an env file that aren't already set, so they can be overridden
+func loadEnv(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if _, set := os.LookupEnv(key); ok && !set {
+			os.Setenv(key, value)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <results dir>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [flags] -write <dir>\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Computes the queries from the raw csv files and checks the results of a client against them.")
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	dataDir := flag.String("data", ".data", "directory with movies.csv, credits.csv and ratings.csv")
+	tolerance := flag.Float64("tolerance", 1e-4, "relative tolerance for sums and means")
+	writeDir := flag.String("write", "", "write the expected results to this directory instead of checking")
+	sentimentEnv := flag.String("sentiment", "../configs/workers/sentiment/.env.overview", "env file of the sentiment workers, with their SCORER, LEXICON_FILE and NEUTRAL_THRESHOLD")
+	flag.Usage = usage
+	flag.Parse()
+	configLog(logging.INFO)
+
+	if len(*writeDir) == 0 && flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := loadEnv(*sentimentEnv); err != nil {
+		log.Fatalf("couldn't read the sentiment config: %v", err)
+	}
+	scorerCon, err := config.CreateScorer()
+	if err != nil {
+		log.Fatalf("couldn't read the sentiment config: %v", err)
+	}
+
+	ref, err := Compute(*dataDir, scorerCon)
+	if err != nil {
+		log.Fatalf("couldn't compute the queries: %v", err)
+	}
+
+	if len(*writeDir) > 0 {
+		if err := Write(ref, *writeDir); err != nil {
+			log.Fatalf("couldn't write the expected results: %v", err)
+		}
+		log.Infof("Wrote the expected results in %s", *writeDir)
+		return
+	}
+
+	ok := true
+	problems := Verify(ref, flag.Arg(0), *tolerance)
+	for query := 1; query <= len(problems); query++ {
+		if len(problems[query]) == 0 {
+			fmt.Printf("Query %d: OK\n", query)
+			continue
+		}
+
+		ok = false
+		fmt.Printf("Query %d: %d discrepancies\n", query, len(problems[query]))
+		for _, problem := range problems[query][:min(len(problems[query]), MAX_SHOWN_PROBLEMS)] {
+			fmt.Printf("  %s\n", problem)
+		}
+		if rest := len(problems[query]) - MAX_SHOWN_PROBLEMS; rest > 0 {
+			fmt.Printf("  ... and %d more\n", rest)
+		}
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
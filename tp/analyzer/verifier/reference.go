@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"analyzer/comms"
+	sanitize "analyzer/workers/sanitize/impl"
+	"analyzer/workers/sentiment/config"
+	sentiment "analyzer/workers/sentiment/impl"
+)
+
+const (
+	TOP_BUDGET_AMOUNT = 5
+	TOP_ACTORS_AMOUNT = 10
+)
+
+// Columns kept by each sanitizer
+var sanitizeSelects = map[string][]string{
+	"movies":  {"id", "title", "genres", "release_date", "overview", "production_countries", "spoken_languages", "budget", "revenue"},
+	"credits": {"id", "cast"},
+	"ratings": {"movieId", "rating"},
+}
+
+// Results of the five queries computed by a single process
+type Reference struct {
+	Titles  []string             // 1: "title,[genres]" of the argentinian and spanish movies of the 2000s
+	Budgets map[string]float64   // 2: budget invested by each country on its own
+	Ratings map[string][]float64 // 3: mean rating of each argentinian movie since 2000, by title
+	Actors  map[string]float64   // 4: appearances of each actor in argentinian movies since 2000
+	Rates   map[string]float64   // 5: mean revenue over budget by sentiment of the overview
+}
+
+type mean struct {
+	sum float64
+	n   int
+}
+
+// Reads the file as the client sends it and the sanitizer gets it, the sanitized
+// rows go through the protocol's encoding the same way they do between workers
+func readRows(path string, kind string, yield func(map[string]string)) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	reader := csv.NewReader(bufio.NewReader(fp))
+	reader.Read() // Skip header line
+
+	handler := sanitize.Handlers[kind]
+	selectCols := make(map[string]struct{})
+	for _, col := range sanitizeSelects[kind] {
+		selectCols[col] = struct{}{}
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok && parseErr.Err == csv.ErrFieldCount {
+			continue
+		}
+		if len(row) == 0 {
+			continue
+		}
+
+		buf.Reset()
+		writer.Write(row)
+		writer.Flush()
+
+		line, _ := csv.NewReader(&buf).Read()
+		fieldMap := handler(line)
+		if fieldMap == nil {
+			continue
+		}
+
+		encoded := comms.NewBatch([]map[string]string{fieldMap}).Encode(selectCols)
+		batch, err := comms.DecodeBatch(encoded)
+		if err != nil || len(batch.FieldMaps) == 0 {
+			continue
+		}
+
+		yield(batch.FieldMaps[0])
+	}
+
+	return nil
+}
+
+func year(date string) (int, bool) {
+	year, err := strconv.Atoi(strings.Split(date, "-")[0])
+	return year, err == nil
+}
+
+func containsAll(values string, wanted ...string) bool {
+	set := strings.Split(values, ",")
+	for _, value := range wanted {
+		if !slices.Contains(set, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Keeps the precision the workers write numbers with
+func round(value float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'f', 4, 64), 64)
+	return rounded
+}
+
+// The overviews are classified with the same scorer and threshold as the sentiment workers
+func Compute(dataDir string, scorerCon config.ScorerConfig) (*Reference, error) {
+	scorer, err := sentiment.NewScorer(scorerCon.Scorer, scorerCon.LexiconFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the sentiment scorer: %v", err)
+	}
+
+	ref := &Reference{
+		Titles:  make([]string, 0),
+		Budgets: make(map[string]float64),
+		Ratings: make(map[string][]float64),
+		Actors:  make(map[string]float64),
+		Rates:   make(map[string]float64),
+	}
+
+	// Titles of the argentinian movies since 2000 by id, joined with credits and ratings
+	argentinian := make(map[string][]string)
+	rates := make(map[string]mean)
+
+	log.Infof("Reading movies")
+	err = readRows(dataDir+"/movies.csv", "movies", func(movie map[string]string) {
+		if y, ok := year(movie["release_date"]); ok && y >= 2000 {
+			if containsAll(movie["production_countries"], "Argentina", "Spain") && y < 2010 {
+				line := fmt.Sprintf("%s,[%s]", strings.TrimSpace(movie["title"]), movie["genres"])
+				ref.Titles = append(ref.Titles, line)
+			}
+
+			if containsAll(movie["production_countries"], "Argentina") {
+				argentinian[movie["id"]] = append(argentinian[movie["id"]], movie["title"])
+			}
+		}
+
+		if countries := movie["production_countries"]; strings.Count(countries, ",") == 0 {
+			if budget, err := strconv.Atoi(movie["budget"]); err == nil {
+				ref.Budgets[strings.TrimSpace(countries)] += float64(budget)
+			}
+		}
+
+		revenue, revenueErr := strconv.Atoi(movie["revenue"])
+		budget, budgetErr := strconv.Atoi(movie["budget"])
+		if revenueErr == nil && budgetErr == nil && revenue != 0 && budget != 0 && len(movie["overview"]) > 0 {
+			label := sentiment.Classify(scorer.Score(movie["overview"]), scorerCon.NeutralThreshold)
+
+			m := rates[label]
+			rates[label] = mean{m.sum + round(float64(revenue)/float64(budget)), m.n + 1}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read movies: %v", err)
+	}
+
+	for label, m := range rates {
+		ref.Rates[label] = m.sum / float64(m.n)
+	}
+
+	log.Infof("Reading credits")
+	err = readRows(dataDir+"/credits.csv", "credits", func(credit map[string]string) {
+		for range argentinian[credit["id"]] {
+			for actor := range strings.SplitSeq(credit["cast"], ",") {
+				ref.Actors[strings.TrimSpace(actor)]++
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read credits: %v", err)
+	}
+
+	log.Infof("Reading ratings")
+	ratings := make(map[string]map[string]mean)
+	err = readRows(dataDir+"/ratings.csv", "ratings", func(rating map[string]string) {
+		titles, ok := argentinian[rating["movieId"]]
+		if !ok {
+			return
+		}
+
+		value, err := strconv.ParseFloat(rating["rating"], 64)
+		if err != nil {
+			return
+		}
+
+		id := rating["movieId"]
+		if _, ok := ratings[id]; !ok {
+			ratings[id] = make(map[string]mean)
+		}
+		for _, title := range titles {
+			m := ratings[id][title]
+			ratings[id][title] = mean{m.sum + value, m.n + 1}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read ratings: %v", err)
+	}
+
+	for _, byTitle := range ratings {
+		for title, m := range byTitle {
+			title = strings.TrimSpace(title)
+			ref.Ratings[title] = append(ref.Ratings[title], round(m.sum/float64(m.n)))
+		}
+	}
+
+	return ref, nil
+}
@@ -0,0 +1,241 @@
+package workers
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+)
+
+// Pre-aggregates the rows published during a window of batches, so the ones sharing
+// the same keys travel as a single row with their sums and the amount of rows they
+// stand for. Only rows published with the same headers are combined, the window is
+// published as soon as the headers change. It's persisted along with the rest of the
+// mailer's state
+type Combiner struct {
+	keys   []string
+	sums   []string
+	window int
+
+	// Persisted
+	pending map[int]int
+	groups  map[int]map[string]map[string]string
+	headers map[int]middleware.Table
+}
+
+func NewCombiner(keys []string, sums []string, window int) *Combiner {
+	return &Combiner{
+		keys:    keys,
+		sums:    sums,
+		window:  window,
+		pending: make(map[int]int),
+		groups:  make(map[int]map[string]map[string]string),
+		headers: make(map[int]middleware.Table),
+	}
+}
+
+// Sums two values, they stay integers if both of them are
+func addValues(a, b string) (string, error) {
+	aInt, aErr := strconv.Atoi(a)
+	bInt, bErr := strconv.Atoi(b)
+	if aErr == nil && bErr == nil {
+		return strconv.Itoa(aInt + bInt), nil
+	}
+
+	aFloat, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return "", fmt.Errorf("the value %v is not numerical", a)
+	}
+	bFloat, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return "", fmt.Errorf("the value %v is not numerical", b)
+	}
+
+	return strconv.FormatFloat(aFloat+bFloat, 'f', -1, 64), nil
+}
+
+func (c *Combiner) add(clientId int, fieldMap map[string]string) error {
+	keys := make([]string, 0, len(c.keys))
+	for _, key := range c.keys {
+		value, ok := fieldMap[key]
+		if !ok {
+			return fmt.Errorf("key %v was not found in field map while combining", key)
+		}
+		keys = append(keys, value)
+	}
+	compKey := strings.Join(keys, comms.SEP)
+
+	if _, ok := c.groups[clientId]; !ok {
+		c.groups[clientId] = make(map[string]map[string]string)
+	}
+
+	prev, ok := c.groups[clientId][compKey]
+	if !ok {
+		combined := map[string]string{comms.ROWS: strconv.Itoa(comms.Rows(fieldMap))}
+		for _, key := range c.keys {
+			combined[key] = fieldMap[key]
+		}
+		for _, key := range c.sums {
+			if _, err := addValues(fieldMap[key], "0"); err != nil {
+				return err
+			}
+			combined[key] = fieldMap[key]
+		}
+
+		c.groups[clientId][compKey] = combined
+		return nil
+	}
+
+	sums := make(map[string]string, len(c.sums))
+	for _, key := range c.sums {
+		sum, err := addValues(prev[key], fieldMap[key])
+		if err != nil {
+			return err
+		}
+		sums[key] = sum
+	}
+
+	for key, sum := range sums {
+		prev[key] = sum
+	}
+	prev[comms.ROWS] = strconv.Itoa(comms.Rows(prev) + comms.Rows(fieldMap))
+	return nil
+}
+
+// Whether there are rows combined for the client that were published with other headers
+func (c *Combiner) Differs(clientId int, headers middleware.Table) bool {
+	if len(c.groups[clientId]) == 0 {
+		return false
+	}
+
+	return !maps.EqualFunc(c.headers[clientId], headers, func(a, b any) bool {
+		return reflect.DeepEqual(a, b)
+	})
+}
+
+// Combines the rows of a batch published with the given headers, returns whether the
+// window is over for the client
+func (c *Combiner) Add(clientId int, fieldMaps []map[string]string, headers middleware.Table) (bool, []error) {
+	c.headers[clientId] = headers
+
+	errs := make([]error, 0)
+	for _, fieldMap := range fieldMaps {
+		if err := c.add(clientId, fieldMap); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	c.pending[clientId]++
+	return c.pending[clientId] >= c.window, errs
+}
+
+// Returns the rows combined so far for the client along with the headers they were
+// published with, and starts a new window
+func (c *Combiner) Take(clientId int) ([]map[string]string, middleware.Table) {
+	fieldMaps := make([]map[string]string, 0, len(c.groups[clientId]))
+	for _, fieldMap := range c.groups[clientId] {
+		fieldMaps = append(fieldMaps, fieldMap)
+	}
+	headers := c.headers[clientId]
+
+	c.Flush(clientId)
+	return fieldMaps, headers
+}
+
+func (c *Combiner) Flush(clientId int) {
+	delete(c.pending, clientId)
+	delete(c.groups, clientId)
+	delete(c.headers, clientId)
+}
+
+func (c *Combiner) Purge() {
+	c.pending = make(map[int]int)
+	c.groups = make(map[int]map[string]map[string]string)
+	c.headers = make(map[int]middleware.Table)
+}
+
+// Example: "combine <pending>" followed by a "combineheader <key> <type> <value>" line
+// for every header and a "combined <fieldMap>" line for every row
+func (c *Combiner) Encode(clientId int) []byte {
+	buf := bytes.NewBuffer(fmt.Appendf(nil, "combine %d", c.pending[clientId]))
+
+	headers := c.headers[clientId]
+	for _, key := range slices.Sorted(maps.Keys(headers)) {
+		fmt.Fprintf(buf, "\ncombineheader %s %T %v", key, headers[key], headers[key])
+	}
+
+	for _, fieldMap := range c.groups[clientId] {
+		buf.WriteString("\ncombined ")
+		buf.Write(comms.NewBatch([]map[string]string{fieldMap}).Encode(nil))
+	}
+
+	return buf.Bytes()
+}
+
+// Example: "combine <pending>"
+func DecodeLineCombine(line string) (int, error) {
+	line, _ = strings.CutPrefix(line, "combine ")
+
+	pending, err := strconv.Atoi(line)
+	if err != nil {
+		return 0, fmt.Errorf("pending is not a number: %s", line)
+	}
+
+	return pending, nil
+}
+
+func (c *Combiner) SetPending(clientId int, pending int) {
+	c.pending[clientId] = pending
+}
+
+// Example: "combineheader <key> <type> <value>", only integer and string headers are kept
+func (c *Combiner) SetHeader(clientId int, line string) error {
+	line, _ = strings.CutPrefix(line, "combineheader ")
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("the amount of parts is not enough: %s", line)
+	}
+	key, kind, valueStr := parts[0], parts[1], parts[2]
+
+	var value any
+	switch kind {
+	case "string":
+		value = valueStr
+	case "int", "int32":
+		n, err := strconv.Atoi(valueStr)
+		if err != nil {
+			return fmt.Errorf("header %s is not a number: %s", key, valueStr)
+		}
+		value = n
+		if kind == "int32" {
+			value = int32(n)
+		}
+	default:
+		return fmt.Errorf("header %s has an unsupported type %s", key, kind)
+	}
+
+	if _, ok := c.headers[clientId]; !ok {
+		c.headers[clientId] = make(middleware.Table)
+	}
+	c.headers[clientId][key] = value
+	return nil
+}
+
+// Example: "combined <fieldMap>"
+func (c *Combiner) SetCombined(clientId int, line string) error {
+	line, _ = strings.CutPrefix(line, "combined ")
+
+	fieldMap, err := comms.DecodeLine([]byte(line))
+	if err != nil {
+		return err
+	}
+
+	return c.add(clientId, fieldMap)
+}
@@ -5,27 +5,63 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/workers/expr"
 
 	"github.com/op/go-logging"
 )
 
+// A column computed from the ones of the row when it's published
+type SelectColumn struct {
+	Name string
+	Expr *expr.Expr
+}
+
 type Config struct {
 	// .env
 	Url                   string
 	InputExchangeNames    []string
+	InputExchangeDurables []bool
 	InputQueueNames       []string
+	InputQueueTypes       []string
 	OutputExchangeName    string
+	OutputExchangeDurable bool
 	OutputQueueNames      []string
+	OutputQueueTypes      []string
 	OutputDeliveryTypes   []string
 	RussianRouletteChance float64
 	HealthCheckPort       uint16
 	Select                map[string]struct{}
+	SelectColumns         []SelectColumn
 	KeepAliveRetries      int
+	PrefetchPerCopy       int
+	ReorderBufferSize     int
+	BrokerBackoff         middleware.Backoff
+	PublishWindow         int
+	DeadLetterExchange    string
+	DeadLetterQueue       string
+
+	// combiner
+	CombineKeys   []string
+	CombineSums   []string
+	CombineWindow int
+
+	// hot keys
+	HotKeys     map[string]struct{}
+	HotKeySplit int
+	HotKeyMode  string
 
 	// compose
 	Id           int
 	InputCopies  []int
 	OutputCopies []int
+
+	// chaos runner
+	ChaosScenario string
+	NodeName      string
 }
 
 func configLog(logLevel logging.Level) {
@@ -84,6 +120,18 @@ func Create() (Config, error) {
 		return Config{}, fmt.Errorf("the length of input queue names and input copies per queue don't match (names: %v, copies: %v)", len(inputQueueNames), len(inputCopiesPerQueueSlice))
 	}
 
+	// INPUT_EXCHANGE_DURABLE
+	inputExchangeDurables, err := middleware.ParseExchangeDurability(os.Getenv("INPUT_EXCHANGE_DURABLE"), len(inputExchangeNames))
+	if err != nil {
+		return Config{}, fmt.Errorf("the input exchange durabilities are invalid: %v", err)
+	}
+
+	// INPUT_QUEUE_TYPES
+	inputQueueTypes, err := middleware.ParseQueueTypes(os.Getenv("INPUT_QUEUE_TYPES"), len(inputQueueNames))
+	if err != nil {
+		return Config{}, fmt.Errorf("the input queue types are invalid: %v", err)
+	}
+
 	// OUTPUT_EXCHANGE_NAME
 	outputExchangeName := os.Getenv("OUTPUT_EXCHANGE_NAME")
 	if len(outputExchangeName) == 0 {
@@ -97,10 +145,22 @@ func Create() (Config, error) {
 	}
 	outputQueueNames := strings.Split(outputQueueNamesString, ",")
 
+	// OUTPUT_EXCHANGE_DURABLE
+	outputExchangeDurable, err := middleware.ParseExchangeDurability(os.Getenv("OUTPUT_EXCHANGE_DURABLE"), 1)
+	if err != nil {
+		return Config{}, fmt.Errorf("the output exchange durability is invalid: %v", err)
+	}
+
+	// OUTPUT_QUEUE_TYPES
+	outputQueueTypes, err := middleware.ParseQueueTypes(os.Getenv("OUTPUT_QUEUE_TYPES"), len(outputQueueNames))
+	if err != nil {
+		return Config{}, fmt.Errorf("the output queue types are invalid: %v", err)
+	}
+
 	// OUTPUT_DELIVERY_TYPES
 	outputDeliveryTypes := strings.Split(os.Getenv("OUTPUT_DELIVERY_TYPES"), ",")
 	for _, delType := range outputDeliveryTypes {
-		if delType == "robin" {
+		if delType == "robin" || delType == "broadcast" {
 			continue
 		}
 
@@ -142,13 +202,40 @@ func Create() (Config, error) {
 	}
 
 	// SELECT
+	// Example: "title,rating,rate_revenue_budget=format(revenue / budget, 4)"
 	selectString := os.Getenv("SELECT")
 	if len(selectString) == 0 {
 		return Config{}, fmt.Errorf("the select were not provided")
 	}
+	// "*" publishes every column, as a worker that already projects its rows
 	selectMap := make(map[string]struct{})
-	for field := range strings.SplitSeq(selectString, ",") {
-		selectMap[field] = struct{}{}
+	selectColumns := make([]SelectColumn, 0)
+	keepAll := false
+	for _, field := range expr.SplitList(selectString) {
+		field = strings.TrimSpace(field)
+		if field == "*" {
+			keepAll = true
+			continue
+		}
+
+		name, src, computed := strings.Cut(field, "=")
+		name = strings.TrimSpace(name)
+		selectMap[name] = struct{}{}
+		if !computed {
+			continue
+		}
+
+		if !comms.IsColumn(name) {
+			return Config{}, fmt.Errorf("the selected column %v is not a column of the protocol", name)
+		}
+		e, err := expr.Compile(src)
+		if err != nil {
+			return Config{}, fmt.Errorf("the select expression of %v is invalid: %v", name, err)
+		}
+		selectColumns = append(selectColumns, SelectColumn{name, e})
+	}
+	if keepAll {
+		selectMap = make(map[string]struct{})
 	}
 
 	// HEALTH_CHECK_PORT
@@ -163,6 +250,140 @@ func Create() (Config, error) {
 		return Config{}, fmt.Errorf("the provided keep alive retries value is invalid: %v", err)
 	}
 
+	// PREFETCH_PER_COPY
+	prefetchPerCopy, err := strconv.Atoi(os.Getenv("PREFETCH_PER_COPY"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the provided prefetch per copy value is invalid: %v", err)
+	}
+	if prefetchPerCopy <= 0 {
+		return Config{}, fmt.Errorf("the prefetch per copy value must be a positive number")
+	}
+
+	// REORDER_BUFFER_SIZE
+	reorderBufferSize, err := strconv.Atoi(os.Getenv("REORDER_BUFFER_SIZE"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the provided reorder buffer size is invalid: %v", err)
+	}
+	if reorderBufferSize >= prefetchPerCopy {
+		return Config{}, fmt.Errorf("the reorder buffer size must be smaller than the prefetch per copy value (buffer: %d, prefetch: %d)", reorderBufferSize, prefetchPerCopy)
+	}
+
+	// BROKER_RETRIES
+	brokerRetries, err := strconv.Atoi(os.Getenv("BROKER_RETRIES"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the provided broker retries value is invalid: %v", err)
+	}
+	if brokerRetries < 0 {
+		return Config{}, fmt.Errorf("the broker retries value must be a positive number or zero")
+	}
+
+	// BROKER_RETRY_DELAY
+	brokerRetryDelayInt, err := strconv.Atoi(os.Getenv("BROKER_RETRY_DELAY"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the provided broker retry delay is invalid: %v", err)
+	}
+	if brokerRetryDelayInt < 0 {
+		return Config{}, fmt.Errorf("the broker retry delay must be a positive number or zero")
+	}
+
+	// BROKER_MAX_RETRY_DELAY
+	brokerMaxRetryDelayInt, err := strconv.Atoi(os.Getenv("BROKER_MAX_RETRY_DELAY"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the provided broker max retry delay is invalid: %v", err)
+	}
+	if brokerMaxRetryDelayInt < brokerRetryDelayInt {
+		return Config{}, fmt.Errorf("the broker max retry delay must not be less than the broker retry delay")
+	}
+
+	brokerBackoff := middleware.Backoff{
+		Retries: brokerRetries,
+		Initial: time.Duration(brokerRetryDelayInt) * time.Second,
+		Max:     time.Duration(brokerMaxRetryDelayInt) * time.Second,
+	}
+
+	// PUBLISH_WINDOW
+	publishWindow, err := strconv.Atoi(os.Getenv("PUBLISH_WINDOW"))
+	if err != nil {
+		return Config{}, fmt.Errorf("the provided publish window is invalid: %v", err)
+	}
+	if publishWindow <= 0 {
+		return Config{}, fmt.Errorf("the publish window must be a positive number")
+	}
+
+	// DEAD_LETTER_EXCHANGE_NAME
+	deadLetterExchangeName := os.Getenv("DEAD_LETTER_EXCHANGE_NAME")
+	if len(deadLetterExchangeName) == 0 {
+		return Config{}, fmt.Errorf("the dead letter exchange name was not provided")
+	}
+
+	// DEAD_LETTER_QUEUE_NAME
+	deadLetterQueueName := os.Getenv("DEAD_LETTER_QUEUE_NAME")
+	if len(deadLetterQueueName) == 0 {
+		return Config{}, fmt.Errorf("the dead letter queue name was not provided")
+	}
+
+	// COMBINE_KEY
+	combineKeys := make([]string, 0)
+	if combineKeysVar := os.Getenv("COMBINE_KEY"); len(combineKeysVar) > 0 {
+		combineKeys = strings.Split(combineKeysVar, ",")
+	}
+
+	// COMBINE_SUM
+	combineSums := make([]string, 0)
+	if combineSumsVar := os.Getenv("COMBINE_SUM"); len(combineSumsVar) > 0 {
+		combineSums = strings.Split(combineSumsVar, ",")
+	}
+
+	// COMBINE_WINDOW
+	combineWindow := 1
+	if combineWindowVar := os.Getenv("COMBINE_WINDOW"); len(combineWindowVar) > 0 {
+		combineWindow, err = strconv.Atoi(combineWindowVar)
+		if err != nil {
+			return Config{}, fmt.Errorf("the provided combine window is invalid: %v", err)
+		}
+		if combineWindow <= 0 {
+			return Config{}, fmt.Errorf("the combine window must be a positive number")
+		}
+	}
+
+	// HOT_KEYS
+	hotKeys := make(map[string]struct{})
+	if hotKeysVar := os.Getenv("HOT_KEYS"); len(hotKeysVar) > 0 {
+		for hotKey := range strings.SplitSeq(hotKeysVar, ",") {
+			hotKeys[strings.ReplaceAll(hotKey, ";", comms.SEP)] = struct{}{}
+		}
+	}
+
+	// HOT_KEY_SPLIT
+	hotKeySplit := 2
+	if hotKeySplitVar := os.Getenv("HOT_KEY_SPLIT"); len(hotKeySplitVar) > 0 {
+		hotKeySplit, err = strconv.Atoi(hotKeySplitVar)
+		if err != nil {
+			return Config{}, fmt.Errorf("the provided hot key split is invalid: %v", err)
+		}
+		if hotKeySplit <= 0 {
+			return Config{}, fmt.Errorf("the hot key split must be a positive number")
+		}
+	}
+
+	// HOT_KEY_MODE
+	hotKeyMode := os.Getenv("HOT_KEY_MODE")
+	if len(hotKeyMode) == 0 {
+		hotKeyMode = "split"
+	}
+	if hotKeyMode != "split" && hotKeyMode != "replicate" {
+		return Config{}, fmt.Errorf("the provided hot key mode is invalid: %v", hotKeyMode)
+	}
+
+	// CHAOS_SCENARIO
+	chaosScenario := os.Getenv("CHAOS_SCENARIO")
+
+	// NODE_NAME
+	nodeName := os.Getenv("NODE_NAME")
+	if len(nodeName) == 0 {
+		nodeName, _ = os.Hostname()
+	}
+
 	// LOG_LEVEL
 	logLevelVar := strings.ToUpper(os.Getenv("LOG_LEVEL"))
 	logLevel, err := logging.LogLevel(logLevelVar)
@@ -175,15 +396,34 @@ func Create() (Config, error) {
 		Id:                    id,
 		Url:                   url,
 		InputExchangeNames:    inputExchangeNames,
+		InputExchangeDurables: inputExchangeDurables,
 		InputQueueNames:       inputQueueNames,
+		InputQueueTypes:       inputQueueTypes,
 		InputCopies:           inputCopies,
 		OutputExchangeName:    outputExchangeName,
+		OutputExchangeDurable: outputExchangeDurable[0],
 		OutputQueueNames:      outputQueueNames,
+		OutputQueueTypes:      outputQueueTypes,
 		OutputCopies:          outputCopies,
 		OutputDeliveryTypes:   outputDeliveryTypes,
 		RussianRouletteChance: russianRouletteChance,
 		HealthCheckPort:       uint16(healthCheckPort),
 		KeepAliveRetries:      keepAliveRetries,
+		PrefetchPerCopy:       prefetchPerCopy,
+		ReorderBufferSize:     reorderBufferSize,
+		BrokerBackoff:         brokerBackoff,
+		PublishWindow:         publishWindow,
+		DeadLetterExchange:    deadLetterExchangeName,
+		DeadLetterQueue:       deadLetterQueueName,
 		Select:                selectMap,
+		SelectColumns:         selectColumns,
+		CombineKeys:           combineKeys,
+		CombineSums:           combineSums,
+		CombineWindow:         combineWindow,
+		HotKeys:               hotKeys,
+		HotKeySplit:           hotKeySplit,
+		HotKeyMode:            hotKeyMode,
+		ChaosScenario:         chaosScenario,
+		NodeName:              nodeName,
 	}, nil
 }
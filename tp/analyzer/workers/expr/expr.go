@@ -0,0 +1,152 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// An expression compiled once and evaluated for every row, either a predicate as
+// `budget > 1e6 and year(release_date) in [2000,2010)` or a computed column as
+// `format(revenue / budget, 4)`
+type Expr struct {
+	src  string
+	root node
+}
+
+func Compile(src string) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != EOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+
+	return &Expr{src, root}, nil
+}
+
+func (e *Expr) Eval(row map[string]string) (bool, error) {
+	return evalBool(e.root, row)
+}
+
+// Returns the value of the expression as it goes in a column
+func (e *Expr) Value(row map[string]string) (string, error) {
+	v, err := e.root(row)
+	if err != nil {
+		return "", err
+	}
+	return toString(v), nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Splits a list of expressions by the commas outside of calls, lists and strings,
+// so "a,format(b, 4)" is two expressions
+func SplitList(src string) []string {
+	items := make([]string, 0)
+	depth, start := 0, 0
+	var quote rune
+
+	for i, r := range src {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(' || r == '[' || r == '{':
+			depth++
+		case r == ')' || r == ']' || r == '}':
+			depth--
+		case r == ',' && depth == 0:
+			items = append(items, src[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(items, src[start:])
+}
+
+func evalBool(n node, row map[string]string) (bool, error) {
+	v, err := n(row)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%v is not a boolean", v)
+	}
+	return b, nil
+}
+
+func evalNumber(n node, row map[string]string) (float64, error) {
+	v, err := n(row)
+	if err != nil {
+		return 0, err
+	}
+
+	f, ok := toNumber(v)
+	if !ok {
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+	return f, nil
+}
+
+func toNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toString(v any) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// Values are compared as numbers when both of them are, and as strings otherwise
+func compare(a, b any) int {
+	if aNum, ok := toNumber(a); ok {
+		if bNum, ok := toNumber(b); ok {
+			switch {
+			case aNum < bNum:
+				return -1
+			case aNum > bNum:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	return strings.Compare(toString(a), toString(b))
+}
+
+// Lists are the comma separated values of columns like genres
+func splitList(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,104 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// An arity of -1 takes any amount of arguments
+type function struct {
+	arity int
+	call  func(args []any) (any, error)
+}
+
+var functions = map[string]function{
+	// Date parts of "YYYY-MM-DD" dates
+	"year":  {1, datePart(0)},
+	"month": {1, datePart(1)},
+	"day":   {1, datePart(2)},
+
+	// Strings
+	"len":   {1, func(args []any) (any, error) { return float64(utf8.RuneCountInString(toString(args[0]))), nil }},
+	"lower": {1, func(args []any) (any, error) { return strings.ToLower(toString(args[0])), nil }},
+	"upper": {1, func(args []any) (any, error) { return strings.ToUpper(toString(args[0])), nil }},
+	"trim":  {1, func(args []any) (any, error) { return strings.TrimSpace(toString(args[0])), nil }},
+	"contains": {2, func(args []any) (any, error) {
+		return strings.Contains(toString(args[0]), toString(args[1])), nil
+	}},
+	"startswith": {2, func(args []any) (any, error) {
+		return strings.HasPrefix(toString(args[0]), toString(args[1])), nil
+	}},
+	"endswith": {2, func(args []any) (any, error) {
+		return strings.HasSuffix(toString(args[0]), toString(args[1])), nil
+	}},
+
+	"replace": {3, func(args []any) (any, error) {
+		return strings.ReplaceAll(toString(args[0]), toString(args[1]), toString(args[2])), nil
+	}},
+	"concat": {-1, func(args []any) (any, error) {
+		var builder strings.Builder
+		for _, arg := range args {
+			builder.WriteString(toString(arg))
+		}
+		return builder.String(), nil
+	}},
+
+	// Casts, int truncates towards zero
+	"int": {1, func(args []any) (any, error) {
+		n, err := number(args[0])
+		return math.Trunc(n), err
+	}},
+	"float": {1, func(args []any) (any, error) { return number(args[0]) }},
+	"str":   {1, func(args []any) (any, error) { return toString(args[0]), nil }},
+
+	// Numbers with a fixed amount of decimals, as "1.5000"
+	"format": {2, func(args []any) (any, error) {
+		n, err := number(args[0])
+		if err != nil {
+			return nil, err
+		}
+		decimals, err := number(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return strconv.FormatFloat(n, 'f', int(decimals), 64), nil
+	}},
+	"round": {1, func(args []any) (any, error) {
+		n, err := number(args[0])
+		return math.Round(n), err
+	}},
+	"abs": {1, func(args []any) (any, error) {
+		n, err := number(args[0])
+		return math.Abs(n), err
+	}},
+
+	// Lists of comma separated values
+	"size": {1, func(args []any) (any, error) { return float64(len(splitList(toString(args[0])))), nil }},
+}
+
+func number(v any) (float64, error) {
+	n, ok := toNumber(v)
+	if !ok {
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+	return n, nil
+}
+
+func datePart(i int) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		date := toString(args[0])
+		parts := strings.Split(date, "-")
+		if len(parts) <= i {
+			return nil, fmt.Errorf("the date is invalid: %v", date)
+		}
+
+		part, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("the date is invalid: %v", date)
+		}
+		return float64(part), nil
+	}
+}
@@ -0,0 +1,518 @@
+package expr
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Evaluates a node of the expression for a row, values are float64, string or bool
+type node func(row map[string]string) (any, error)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != EOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	return t.kind == OP && slices.Contains(ops, t.text)
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == IDENT && t.text == keyword
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != OP || t.text != op {
+		return fmt.Errorf("expected %q at %d, got %q", op, t.pos, t.text)
+	}
+	return nil
+}
+
+// or := and ("or" and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, true)
+	}
+
+	return left, nil
+}
+
+// and := not ("and" not)*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, false)
+	}
+
+	return left, nil
+}
+
+// Both sides are only evaluated if needed, "or" stops at the first true and "and" at the first false
+func logical(left, right node, or bool) node {
+	return func(row map[string]string) (any, error) {
+		l, err := evalBool(left, row)
+		if err != nil || l == or {
+			return l, err
+		}
+		return evalBool(right, row)
+	}
+}
+
+// not := "not" not | comparison
+func (p *parser) parseNot() (node, error) {
+	if !p.isKeyword("not") {
+		return p.parseComparison()
+	}
+
+	p.next()
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(row map[string]string) (any, error) {
+		v, err := evalBool(operand, row)
+		return !v, err
+	}, nil
+}
+
+// comparison := sum (<op> sum | ["not"] "in" membership)?
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isOp("==", "!=", "<", "<=", ">", ">=") {
+		op := p.next().text
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return comparison(op, left, right), nil
+	}
+
+	negate := false
+	if p.isKeyword("not") && p.tokens[p.pos+1].kind == IDENT && p.tokens[p.pos+1].text == "in" {
+		p.next()
+		negate = true
+	}
+	if !p.isKeyword("in") {
+		return left, nil
+	}
+	p.next()
+
+	in, err := p.parseMembership(left)
+	if err != nil {
+		return nil, err
+	}
+	if !negate {
+		return in, nil
+	}
+
+	return func(row map[string]string) (any, error) {
+		v, err := evalBool(in, row)
+		return !v, err
+	}, nil
+}
+
+func comparison(op string, left, right node) node {
+	return func(row map[string]string) (any, error) {
+		l, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(row)
+		if err != nil {
+			return nil, err
+		}
+
+		c := compare(l, r)
+		switch op {
+		case "==":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+}
+
+// membership := interval | "{" sum ("," sum)* "}" | sum
+//
+// Intervals are "[a,b)" like, with optional bounds as in "[2000,)". Any other
+// value is a list of comma separated values, as the columns with lists
+func (p *parser) parseMembership(left node) (node, error) {
+	switch {
+	case p.isOp("[", "("):
+		return p.parseInterval(left)
+
+	case p.isOp("{"):
+		p.next()
+		elems := make([]node, 0)
+		for !p.isOp("}") {
+			if len(elems) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			elem, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		p.next()
+
+		return func(row map[string]string) (any, error) {
+			l, err := left(row)
+			if err != nil {
+				return nil, err
+			}
+			for _, elem := range elems {
+				e, err := elem(row)
+				if err != nil {
+					return nil, err
+				}
+				if compare(l, e) == 0 {
+					return true, nil
+				}
+			}
+			return false, nil
+		}, nil
+
+	default:
+		list, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(row map[string]string) (any, error) {
+			l, err := left(row)
+			if err != nil {
+				return nil, err
+			}
+			r, err := list(row)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Contains(splitList(toString(r)), toString(l)), nil
+		}, nil
+	}
+}
+
+func (p *parser) parseInterval(left node) (node, error) {
+	lowerInclusive := p.next().text == "["
+
+	var lower, upper node
+	var err error
+	if !p.isOp(",") {
+		if lower, err = p.parseSum(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	if !p.isOp("]", ")") {
+		if upper, err = p.parseSum(); err != nil {
+			return nil, err
+		}
+	}
+	if !p.isOp("]", ")") {
+		t := p.peek()
+		return nil, fmt.Errorf("expected the end of the interval at %d, got %q", t.pos, t.text)
+	}
+	upperInclusive := p.next().text == "]"
+
+	return func(row map[string]string) (any, error) {
+		l, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+
+		if lower != nil {
+			b, err := lower(row)
+			if err != nil {
+				return nil, err
+			}
+			if c := compare(l, b); c < 0 || (c == 0 && !lowerInclusive) {
+				return false, nil
+			}
+		}
+
+		if upper != nil {
+			b, err := upper(row)
+			if err != nil {
+				return nil, err
+			}
+			if c := compare(l, b); c > 0 || (c == 0 && !upperInclusive) {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	}, nil
+}
+
+// sum := product (("+" | "-") product)*
+func (p *parser) parseSum() (node, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("+", "-") {
+		op := p.next().text
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(op, left, right)
+	}
+
+	return left, nil
+}
+
+// product := unary (("*" | "/") unary)*
+func (p *parser) parseProduct() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("*", "/") {
+		op := p.next().text
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(op, left, right)
+	}
+
+	return left, nil
+}
+
+func arithmetic(op string, left, right node) node {
+	return func(row map[string]string) (any, error) {
+		l, err := evalNumber(left, row)
+		if err != nil {
+			return nil, err
+		}
+		r, err := evalNumber(right, row)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		default:
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return l / r, nil
+		}
+	}
+}
+
+// unary := "-" unary | primary
+func (p *parser) parseUnary() (node, error) {
+	if !p.isOp("-") {
+		return p.parsePrimary()
+	}
+
+	p.next()
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(row map[string]string) (any, error) {
+		v, err := evalNumber(operand, row)
+		return -v, err
+	}, nil
+}
+
+// primary := number | string | "true" | "false" | column | function "(" args ")" | "(" or ")"
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case NUMBER:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return constant(v), nil
+
+	case STRING:
+		return constant(t.text), nil
+
+	case IDENT:
+		switch t.text {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "and", "or", "not", "in":
+			return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+		}
+
+		if p.isOp("(") {
+			return p.parseCall(t)
+		}
+		return column(t.text), nil
+
+	case OP:
+		if t.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+	}
+
+	if t.kind == EOF {
+		return nil, fmt.Errorf("unexpected end of the expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	if strings.ToLower(name.text) == "if" {
+		return p.parseIf()
+	}
+
+	f, ok := functions[strings.ToLower(name.text)]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.text, name.pos)
+	}
+
+	p.next()
+	args := make([]node, 0)
+	for !p.isOp(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+
+	if f.arity >= 0 && len(args) != f.arity {
+		return nil, fmt.Errorf("%v expects %d arguments, got %d", name.text, f.arity, len(args))
+	}
+
+	return func(row map[string]string) (any, error) {
+		values := make([]any, 0, len(args))
+		for _, arg := range args {
+			v, err := arg(row)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return f.call(values)
+	}, nil
+}
+
+// if(cond, then, else) only evaluates the branch it returns
+func (p *parser) parseIf() (node, error) {
+	p.next()
+
+	args := make([]node, 0, 3)
+	for i := range 3 {
+		if i > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	cond, then, otherwise := args[0], args[1], args[2]
+	return func(row map[string]string) (any, error) {
+		c, err := evalBool(cond, row)
+		if err != nil {
+			return nil, err
+		}
+		if c {
+			return then(row)
+		}
+		return otherwise(row)
+	}, nil
+}
+
+func constant(v any) node {
+	return func(map[string]string) (any, error) { return v, nil }
+}
+
+func column(name string) node {
+	return func(row map[string]string) (any, error) {
+		v, ok := row[name]
+		if !ok {
+			return nil, fmt.Errorf("key %v is not in message", name)
+		}
+		return v, nil
+	}
+}
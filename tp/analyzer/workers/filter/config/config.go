@@ -13,6 +13,7 @@ type FilterConfig struct {
 	Handler string
 	Key     string
 	Value   string
+	Expr    string
 }
 
 func Create() (*FilterConfig, error) {
@@ -21,12 +22,21 @@ func Create() (*FilterConfig, error) {
 		return nil, err
 	}
 
-	validFilterHandlers := []string{"length", "range", "contains"}
+	validFilterHandlers := []string{"length", "range", "contains", "expr"}
 	handler := os.Getenv("HANDLER")
 	if !slices.Contains(validFilterHandlers, handler) {
 		return nil, fmt.Errorf("no filter handler was provided")
 	}
 
+	// The expression replaces the key and the value
+	if handler == "expr" {
+		expr := os.Getenv("EXPR")
+		if len(expr) == 0 {
+			return nil, fmt.Errorf("no filter expression was provided")
+		}
+		return &FilterConfig{Config: con, Handler: handler, Expr: expr}, nil
+	}
+
 	key := os.Getenv("KEY")
 	if len(key) == 0 {
 		return nil, fmt.Errorf("no filter key was provided")
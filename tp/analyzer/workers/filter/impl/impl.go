@@ -8,6 +8,7 @@ import (
 	"analyzer/comms"
 	"analyzer/comms/middleware"
 	"analyzer/workers"
+	"analyzer/workers/expr"
 	"analyzer/workers/filter/config"
 
 	"github.com/op/go-logging"
@@ -18,6 +19,10 @@ type Filter struct {
 	Con     *config.FilterConfig
 	Handler func(*Filter, map[string]string) (map[string]string, error)
 	count   int
+
+	// Compiled once at startup by the handlers that need them
+	yearRange *Range
+	expr      *expr.Expr
 }
 
 func New(con *config.FilterConfig, log *logging.Logger) (*Filter, error) {
@@ -30,9 +35,23 @@ func New(con *config.FilterConfig, log *logging.Logger) (*Filter, error) {
 		"range":    handleRange,
 		"contains": handleContains,
 		"length":   handleLength,
+		"expr":     handleExpr,
 	}[con.Handler]
 
-	return &Filter{base, con, handler, 0}, nil
+	w := &Filter{Worker: base, Con: con, Handler: handler}
+
+	switch con.Handler {
+	case "range":
+		if w.yearRange, err = parseMathRange(con.Value); err != nil {
+			return nil, err
+		}
+	case "expr":
+		if w.expr, err = expr.Compile(con.Expr); err != nil {
+			return nil, fmt.Errorf("the filter expression is invalid: %v", err)
+		}
+	}
+
+	return w, nil
 }
 
 func (w *Filter) Run() error {
@@ -40,11 +59,6 @@ func (w *Filter) Run() error {
 }
 
 func handleRange(w *Filter, msg map[string]string) (map[string]string, error) {
-	yearRange, err := parseMathRange(w.Con.Value)
-	if err != nil {
-		return nil, err
-	}
-
 	date, ok := msg[w.Con.Key]
 	if !ok {
 		return nil, fmt.Errorf("key %v is not in message", w.Con.Key)
@@ -55,7 +69,7 @@ func handleRange(w *Filter, msg map[string]string) (map[string]string, error) {
 		return nil, fmt.Errorf("given year is not a number")
 	}
 
-	if !yearRange.Contains(year) {
+	if !w.yearRange.Contains(year) {
 		return nil, nil
 	}
 
@@ -100,13 +114,23 @@ func handleContains(w *Filter, msg map[string]string) (map[string]string, error)
 	return msg, nil
 }
 
+func handleExpr(w *Filter, msg map[string]string) (map[string]string, error) {
+	ok, err := w.expr.Eval(msg)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
 func (w *Filter) Batch(qId int, del middleware.Delivery) {
 	clientId := del.Headers.ClientId
 	body := del.Body
 
 	batch, err := comms.DecodeBatch(body)
 	if err != nil {
-		w.Log.Fatalf("failed to decode batch: %v", err)
+		w.DeadLetter(qId, del, err)
+		return
 	}
 	responseFieldMaps := make([]map[string]string, 0, len(batch.FieldMaps))
 
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"analyzer/comms"
+)
+
+// Aggregators with their own handler, the rest are computed by the generic one
+var basicAggregators = []string{"count", "sum", "mean"}
+
+var aggregators = []string{"count", "sum", "mean", "min", "max", "variance", "stddev", "count_distinct", "median"}
+
+// One of the aggregations computed by a generic groupby
+type Aggregation struct {
+	Aggregator string
+	Key        string
+	Storage    string
+	// Between 0 and 1, only for "median" and "p<NN>"
+	Quantile float64
+}
+
+// Returns the quantile of a "median" or "p<NN>" aggregator, -1 for the rest
+func quantile(aggregator string) float64 {
+	if aggregator == "median" {
+		return 0.5
+	}
+
+	nStr, ok := strings.CutPrefix(aggregator, "p")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.Atoi(nStr)
+	if err != nil || n <= 0 || n >= 100 {
+		return -1
+	}
+	return float64(n) / 100
+}
+
+func isAggregator(aggregator string) bool {
+	return slices.Contains(aggregators, aggregator) || quantile(aggregator) >= 0
+}
+
+func newAggregation(aggregator, key, storage string) (Aggregation, error) {
+	if !isAggregator(aggregator) {
+		return Aggregation{}, fmt.Errorf("the given aggregator is invalid %v", aggregator)
+	}
+	if len(key) == 0 && aggregator != "count" {
+		return Aggregation{}, fmt.Errorf("no aggregator key was specified for %v", aggregator)
+	}
+
+	if len(storage) == 0 {
+		storage = aggregator
+	}
+	if !comms.IsColumn(storage) {
+		return Aggregation{}, fmt.Errorf("the storage %v is not a column of the protocol", storage)
+	}
+
+	return Aggregation{aggregator, key, storage, quantile(aggregator)}, nil
+}
+
+// Example: "mean:rating:mean,count::count,p90:rating:p90"
+func parseAggregations(s string) ([]Aggregation, error) {
+	aggregations := make([]Aggregation, 0)
+
+	for part := range strings.SplitSeq(s, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid aggregation, should be <aggregator>:<key>:<storage>: %v", part)
+		}
+
+		aggregation, err := newAggregation(fields[0], fields[1], fields[2])
+		if err != nil {
+			return nil, err
+		}
+		aggregations = append(aggregations, aggregation)
+	}
+
+	return aggregations, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 
 	"analyzer/workers/config"
@@ -15,6 +16,12 @@ type GroupByConfig struct {
 	Aggregator string
 	AggKey     string
 	Storage    string
+	Partial    bool
+	Window     WindowConfig
+
+	// Computed by the generic handler, empty for the basic aggregators
+	Aggregations []Aggregation
+	Merge        bool
 }
 
 func Create() (*GroupByConfig, error) {
@@ -29,21 +36,155 @@ func Create() (*GroupByConfig, error) {
 	}
 	groupKeys := strings.Split(groupKeysVar, ",")
 
-	validAggregators := []string{"count", "sum", "mean"}
 	aggregator := os.Getenv("AGGREGATOR")
-	if !slices.Contains(validAggregators, aggregator) {
-		return nil, fmt.Errorf("the given aggregator is invalid %v", aggregator)
+	aggregatorKey := os.Getenv("AGGREGATOR_KEY")
+	storage := os.Getenv("STORAGE")
+
+	// AGGREGATIONS
+	var aggregations []Aggregation
+	if aggregationsVar := os.Getenv("AGGREGATIONS"); len(aggregationsVar) > 0 {
+		aggregations, err = parseAggregations(aggregationsVar)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !isAggregator(aggregator) {
+			return nil, fmt.Errorf("the given aggregator is invalid %v", aggregator)
+		}
+
+		if len(aggregatorKey) == 0 && aggregator != "count" {
+			return nil, fmt.Errorf("no aggregator key was specified")
+		}
+
+		if len(storage) == 0 {
+			storage = aggregator
+		}
+
+		if !slices.Contains(basicAggregators, aggregator) {
+			aggregation, err := newAggregation(aggregator, aggregatorKey, storage)
+			if err != nil {
+				return nil, err
+			}
+			aggregations = []Aggregation{aggregation}
+		}
 	}
 
-	aggregatorKey := os.Getenv("AGGREGATOR_KEY")
-	if len(aggregatorKey) == 0 && aggregator != "count" {
-		return nil, fmt.Errorf("no aggregator key was specified")
+	// Partial results can be merged by a groupby with the same aggregator downstream
+	partial := false
+	if partialVar := os.Getenv("PARTIAL"); len(partialVar) > 0 {
+		partial, err = strconv.ParseBool(partialVar)
+		if err != nil {
+			return nil, fmt.Errorf("the partial value is invalid: %v", err)
+		}
 	}
 
-	storage := os.Getenv("STORAGE")
-	if len(storage) == 0 {
-		storage = aggregator
+	// Rows carry the partial states of a generic groupby upstream with the same aggregations
+	merge := false
+	if mergeVar := os.Getenv("MERGE"); len(mergeVar) > 0 {
+		merge, err = strconv.ParseBool(mergeVar)
+		if err != nil {
+			return nil, fmt.Errorf("the merge value is invalid: %v", err)
+		}
+	}
+	if merge && len(aggregations) == 0 {
+		return nil, fmt.Errorf("merge is only supported by the generic aggregators")
+	}
+
+	// COMBINED
+	combined := false
+	if combinedVar := os.Getenv("COMBINED"); len(combinedVar) > 0 {
+		combined, err = strconv.ParseBool(combinedVar)
+		if err != nil {
+			return nil, fmt.Errorf("the combined value is invalid: %v", err)
+		}
+	}
+
+	// Combined rows only carry the sum of their values and how many rows they are
+	if combined {
+		for _, aggregation := range aggregations {
+			if !slices.Contains(basicAggregators, aggregation.Aggregator) {
+				return nil, fmt.Errorf("combined rows only support the %v aggregators, got %v", basicAggregators, aggregation.Aggregator)
+			}
+		}
+	}
+
+	window, err := createWindow()
+	if err != nil {
+		return nil, err
+	}
+	if window.Type == WINDOW_SESSION && partial {
+		return nil, fmt.Errorf("partial results are not supported with session windows")
+	}
+	if window.Type == WINDOW_SESSION && len(aggregations) > 0 {
+		return nil, fmt.Errorf("session windows only support the %v aggregators", basicAggregators)
+	}
+
+	// Tumbling and sliding windows are grouped as one more key
+	if window.Type == WINDOW_TUMBLING || window.Type == WINDOW_SLIDING {
+		groupKeys = append(groupKeys, WINDOW_START, WINDOW_END)
+	}
+
+	return &GroupByConfig{con, groupKeys, aggregator, aggregatorKey, storage, partial, window, aggregations, merge}, nil
+}
+
+func createWindow() (WindowConfig, error) {
+	// WINDOW
+	windowType := os.Getenv("WINDOW")
+	validWindows := []string{WINDOW_NONE, WINDOW_TUMBLING, WINDOW_SLIDING, WINDOW_SESSION}
+	if !slices.Contains(validWindows, windowType) {
+		return WindowConfig{}, fmt.Errorf("the given window is invalid %v", windowType)
+	}
+	if windowType == WINDOW_NONE {
+		return WindowConfig{}, nil
+	}
+
+	// WINDOW_KEY
+	windowKey := os.Getenv("WINDOW_KEY")
+	if len(windowKey) == 0 {
+		return WindowConfig{}, fmt.Errorf("no window key was specified")
+	}
+
+	window := WindowConfig{Type: windowType, Key: windowKey}
+
+	if windowType == WINDOW_SESSION {
+		// WINDOW_GAP
+		gap, err := ParseSpan(os.Getenv("WINDOW_GAP"))
+		if err != nil {
+			return WindowConfig{}, fmt.Errorf("the window gap is invalid: %v", err)
+		}
+		if gap.Months > 0 {
+			return WindowConfig{}, fmt.Errorf("the window gap should be a fixed duration")
+		}
+		window.Gap = gap.Duration
+		return window, nil
+	}
+
+	// WINDOW_SIZE
+	size, err := ParseSpan(os.Getenv("WINDOW_SIZE"))
+	if err != nil {
+		return WindowConfig{}, fmt.Errorf("the window size is invalid: %v", err)
+	}
+	window.Size = size
+	window.Slide = size
+
+	// WINDOW_SLIDE
+	if windowType == WINDOW_SLIDING {
+		slide, err := ParseSpan(os.Getenv("WINDOW_SLIDE"))
+		if err != nil {
+			return WindowConfig{}, fmt.Errorf("the window slide is invalid: %v", err)
+		}
+		window.Slide = slide
+	}
+
+	if (window.Size.Months > 0) != (window.Slide.Months > 0) {
+		return WindowConfig{}, fmt.Errorf("the window size and slide should both be months or both be fixed durations")
+	}
+	if window.Slide.longerThan(window.Size) {
+		return WindowConfig{}, fmt.Errorf("the window slide should not be longer than its size")
+	}
+	if n := window.Size.windowsPer(window.Slide); n > MAX_WINDOWS_PER_EVENT {
+		return WindowConfig{}, fmt.Errorf("the window size and slide put every event in %d windows, at most %d are allowed", n, MAX_WINDOWS_PER_EVENT)
 	}
 
-	return &GroupByConfig{con, groupKeys, aggregator, aggregatorKey, storage}, nil
+	return window, nil
 }
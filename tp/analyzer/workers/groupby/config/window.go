@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WINDOW_NONE     = ""
+	WINDOW_TUMBLING = "tumbling"
+	WINDOW_SLIDING  = "sliding"
+	WINDOW_SESSION  = "session"
+)
+
+// Every event is copied once per window it belongs to, so sliding windows are
+// limited to this many per event
+const MAX_WINDOWS_PER_EVENT = 1000
+
+// Columns with the bounds of the window a result belongs to
+const (
+	WINDOW_START = "window_start"
+	WINDOW_END   = "window_end"
+)
+
+// Length of a window, either a fixed duration or a number of calendar months
+type Span struct {
+	Duration time.Duration
+	Months   int
+}
+
+// Examples: "90m", "24h", "7d", "month", "3month", "year"
+func ParseSpan(s string) (Span, error) {
+	for _, unit := range []struct {
+		suffix string
+		months int
+	}{{"month", 1}, {"year", 12}} {
+		if nStr, ok := strings.CutSuffix(s, unit.suffix); ok {
+			n := 1
+			if len(nStr) > 0 {
+				var err error
+				if n, err = strconv.Atoi(nStr); err != nil {
+					return Span{}, err
+				}
+			}
+			if n <= 0 {
+				return Span{}, fmt.Errorf("should be positive: %v", s)
+			}
+			return Span{Months: n * unit.months}, nil
+		}
+	}
+
+	if nStr, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(nStr)
+		if err != nil {
+			return Span{}, err
+		}
+		s = fmt.Sprintf("%dh", n*24)
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return Span{}, err
+	}
+	if d <= 0 {
+		return Span{}, fmt.Errorf("should be positive: %v", s)
+	}
+
+	return Span{Duration: d}, nil
+}
+
+// Returns the start of the span aligned window that contains t, in UTC
+func (s Span) Floor(t time.Time) time.Time {
+	t = t.UTC()
+	if s.Months > 0 {
+		months := t.Year()*12 + int(t.Month()) - 1
+		months -= months % s.Months
+		return time.Date(months/12, time.Month(months%12+1), 1, 0, 0, 0, 0, time.UTC)
+	}
+	nanos := t.UnixNano()
+	return time.Unix(0, nanos-nanos%int64(s.Duration)).UTC()
+}
+
+func (s Span) Add(t time.Time, n int) time.Time {
+	if s.Months > 0 {
+		return t.AddDate(0, n*s.Months, 0)
+	}
+	return t.Add(time.Duration(n) * s.Duration)
+}
+
+// Both spans should be in the same unit
+func (s Span) longerThan(o Span) bool {
+	if s.Months > 0 {
+		return s.Months > o.Months
+	}
+	return s.Duration > o.Duration
+}
+
+// Number of windows of size s that contain an event when they start every slide
+func (s Span) windowsPer(slide Span) int64 {
+	if s.Months > 0 {
+		return int64((s.Months + slide.Months - 1) / slide.Months)
+	}
+	return int64((s.Duration + slide.Duration - 1) / slide.Duration)
+}
+
+type WindowConfig struct {
+	Type  string
+	Key   string
+	Size  Span
+	Slide Span
+	Gap   time.Duration
+}
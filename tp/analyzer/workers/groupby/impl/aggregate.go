@@ -0,0 +1,323 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"analyzer/workers/groupby/config"
+)
+
+// Mergeable state of an aggregation for a single key. Encoded states go in a
+// line of the persisted file and in the columns of the partial results, so
+// they can't have '\n', ';' nor '='
+type aggregate interface {
+	add(value string, rows int) error
+	merge(other aggregate)
+	encode() string
+	decode(string) error
+	result() string
+}
+
+func newAggregate(agg config.Aggregation) aggregate {
+	switch {
+	case agg.Quantile >= 0:
+		return &quantileAgg{newTDigest(), agg.Quantile}
+	case agg.Aggregator == "count":
+		return &countAgg{}
+	case agg.Aggregator == "sum":
+		return &sumAgg{}
+	case agg.Aggregator == "mean":
+		return &meanAgg{}
+	case agg.Aggregator == "min":
+		return &extremeAgg{less: func(a, b float64) bool { return a < b }}
+	case agg.Aggregator == "max":
+		return &extremeAgg{less: func(a, b float64) bool { return a > b }}
+	case agg.Aggregator == "variance":
+		return &varianceAgg{}
+	case agg.Aggregator == "stddev":
+		return &varianceAgg{stddev: true}
+	case agg.Aggregator == "count_distinct":
+		return &distinctAgg{newHyperLogLog()}
+	}
+	return nil
+}
+
+func decodeAggregate(agg config.Aggregation, s string) (aggregate, error) {
+	a := newAggregate(agg)
+	if err := a.decode(s); err != nil {
+		return nil, fmt.Errorf("invalid %v state %q: %v", agg.Aggregator, s, err)
+	}
+	return a, nil
+}
+
+func parseValue(value string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("the value is not numerical %v", value)
+	}
+	return v, nil
+}
+
+// Combined rows only carry the sum of their values, which isn't enough for the rest
+func single(rows int) error {
+	if rows != 1 {
+		return fmt.Errorf("combined rows can only be counted, summed or averaged")
+	}
+	return nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 4, 64)
+}
+
+type countAgg struct {
+	n int
+}
+
+func (a *countAgg) add(_ string, rows int) error {
+	a.n += rows
+	return nil
+}
+
+func (a *countAgg) merge(other aggregate) { a.n += other.(*countAgg).n }
+func (a *countAgg) encode() string        { return strconv.Itoa(a.n) }
+func (a *countAgg) result() string        { return strconv.Itoa(a.n) }
+
+func (a *countAgg) decode(s string) (err error) {
+	a.n, err = strconv.Atoi(s)
+	return err
+}
+
+type sumAgg struct {
+	sum float64
+}
+
+func (a *sumAgg) add(value string, _ int) error {
+	v, err := parseValue(value)
+	a.sum += v
+	return err
+}
+
+func (a *sumAgg) merge(other aggregate) { a.sum += other.(*sumAgg).sum }
+func (a *sumAgg) encode() string        { return strconv.FormatFloat(a.sum, 'g', -1, 64) }
+func (a *sumAgg) result() string        { return strconv.FormatFloat(a.sum, 'f', -1, 64) }
+
+func (a *sumAgg) decode(s string) (err error) {
+	a.sum, err = strconv.ParseFloat(s, 64)
+	return err
+}
+
+type meanAgg struct {
+	sum float64
+	n   int
+}
+
+func (a *meanAgg) add(value string, rows int) error {
+	v, err := parseValue(value)
+	a.sum += v
+	a.n += rows
+	return err
+}
+
+func (a *meanAgg) merge(other aggregate) {
+	o := other.(*meanAgg)
+	a.sum += o.sum
+	a.n += o.n
+}
+
+func (a *meanAgg) encode() string {
+	return strconv.FormatFloat(a.sum, 'g', -1, 64) + " " + strconv.Itoa(a.n)
+}
+
+func (a *meanAgg) result() string {
+	return formatFloat(a.sum / float64(a.n))
+}
+
+func (a *meanAgg) decode(s string) error {
+	_, err := fmt.Sscanf(s, "%g %d", &a.sum, &a.n)
+	return err
+}
+
+// Keeps the value that's less than the rest, min and max differ in the comparison
+type extremeAgg struct {
+	value float64
+	set   bool
+	less  func(a, b float64) bool
+}
+
+func (a *extremeAgg) add(value string, rows int) error {
+	if err := single(rows); err != nil {
+		return err
+	}
+	v, err := parseValue(value)
+	if err != nil {
+		return err
+	}
+	a.keep(v)
+	return nil
+}
+
+func (a *extremeAgg) keep(v float64) {
+	if !a.set || a.less(v, a.value) {
+		a.value = v
+		a.set = true
+	}
+}
+
+func (a *extremeAgg) merge(other aggregate) {
+	if o := other.(*extremeAgg); o.set {
+		a.keep(o.value)
+	}
+}
+
+func (a *extremeAgg) encode() string {
+	if !a.set {
+		return "-"
+	}
+	return strconv.FormatFloat(a.value, 'g', -1, 64)
+}
+
+func (a *extremeAgg) result() string {
+	return strconv.FormatFloat(a.value, 'f', -1, 64)
+}
+
+func (a *extremeAgg) decode(s string) (err error) {
+	if s == "-" {
+		return nil
+	}
+	a.value, err = strconv.ParseFloat(s, 64)
+	a.set = err == nil
+	return err
+}
+
+// Welford's running mean and sum of squared differences, merged with Chan's formula
+type varianceAgg struct {
+	n      int
+	mean   float64
+	m2     float64
+	stddev bool
+}
+
+func (a *varianceAgg) add(value string, rows int) error {
+	if err := single(rows); err != nil {
+		return err
+	}
+	v, err := parseValue(value)
+	if err != nil {
+		return err
+	}
+
+	a.n++
+	delta := v - a.mean
+	a.mean += delta / float64(a.n)
+	a.m2 += delta * (v - a.mean)
+	return nil
+}
+
+func (a *varianceAgg) merge(other aggregate) {
+	o := other.(*varianceAgg)
+	if o.n == 0 {
+		return
+	}
+
+	n := a.n + o.n
+	delta := o.mean - a.mean
+	a.m2 += o.m2 + delta*delta*float64(a.n)*float64(o.n)/float64(n)
+	a.mean += delta * float64(o.n) / float64(n)
+	a.n = n
+}
+
+func (a *varianceAgg) encode() string {
+	return fmt.Sprintf("%d %s %s", a.n,
+		strconv.FormatFloat(a.mean, 'g', -1, 64), strconv.FormatFloat(a.m2, 'g', -1, 64))
+}
+
+// Population variance
+func (a *varianceAgg) result() string {
+	variance := 0.0
+	if a.n > 0 {
+		variance = a.m2 / float64(a.n)
+	}
+	if a.stddev {
+		return formatFloat(math.Sqrt(variance))
+	}
+	return formatFloat(variance)
+}
+
+func (a *varianceAgg) decode(s string) error {
+	_, err := fmt.Sscanf(s, "%d %g %g", &a.n, &a.mean, &a.m2)
+	return err
+}
+
+type distinctAgg struct {
+	hll *hyperLogLog
+}
+
+// A combined row is still a single value
+func (a *distinctAgg) add(value string, _ int) error {
+	a.hll.add(value)
+	return nil
+}
+
+func (a *distinctAgg) merge(other aggregate) { a.hll.merge(other.(*distinctAgg).hll) }
+func (a *distinctAgg) encode() string        { return a.hll.encode() }
+func (a *distinctAgg) result() string        { return strconv.FormatUint(a.hll.estimate(), 10) }
+
+func (a *distinctAgg) decode(s string) (err error) {
+	a.hll, err = decodeHyperLogLog(s)
+	return err
+}
+
+type quantileAgg struct {
+	digest *tDigest
+	q      float64
+}
+
+func (a *quantileAgg) add(value string, rows int) error {
+	if err := single(rows); err != nil {
+		return err
+	}
+	v, err := parseValue(value)
+	if err != nil {
+		return err
+	}
+	a.digest.add(v, 1)
+	return nil
+}
+
+func (a *quantileAgg) merge(other aggregate) { a.digest.merge(other.(*quantileAgg).digest) }
+func (a *quantileAgg) encode() string        { return a.digest.encode() }
+func (a *quantileAgg) result() string        { return formatFloat(a.digest.quantile(a.q)) }
+
+func (a *quantileAgg) decode(s string) (err error) {
+	a.digest, err = decodeTDigest(s)
+	return err
+}
+
+// Example: a line per aggregation with its encoded state
+func encodeAggregates(aggregates []aggregate) []byte {
+	lines := make([]string, 0, len(aggregates))
+	for _, a := range aggregates {
+		lines = append(lines, a.encode())
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func decodeAggregates(aggs []config.Aggregation, state []byte) ([]aggregate, error) {
+	lines := strings.Split(strings.TrimSuffix(string(state), "\n"), "\n")
+	if len(lines) != len(aggs) {
+		return nil, fmt.Errorf("invalid amount of aggregations, should be %d: %d", len(aggs), len(lines))
+	}
+
+	aggregates := make([]aggregate, 0, len(aggs))
+	for i, line := range lines {
+		a, err := decodeAggregate(aggs[i], line)
+		if err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, a)
+	}
+	return aggregates, nil
+}
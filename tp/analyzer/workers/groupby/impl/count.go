@@ -26,7 +26,9 @@ func NewCount(w *GroupBy) GroupByHandler {
 
 func (w *Count) add(shards map[string][]map[string]string, con config.GroupByConfig) error {
 	for compKey, fieldMaps := range shards {
-		w.state[compKey] += len(fieldMaps)
+		for _, fieldMap := range fieldMaps {
+			w.state[compKey] += comms.Rows(fieldMap)
+		}
 	}
 
 	return nil
@@ -51,7 +53,11 @@ func (w *Count) result(clientId int, con config.GroupByConfig, persistor persist
 			fieldMap[con.GroupKeys[i]] = key
 		}
 
-		fieldMap[con.Storage] = strconv.Itoa(count)
+		if con.Partial {
+			fieldMap[comms.ROWS] = strconv.Itoa(count)
+		} else {
+			fieldMap[con.Storage] = strconv.Itoa(count)
+		}
 		fieldMaps = append(fieldMaps, fieldMap)
 	}
 
@@ -81,7 +87,9 @@ func (w *Count) store(id middleware.DelId, persistor *persistance.Persistor) err
 		exists := err == nil
 		if !exists {
 			newState := w.encode(partialCount)
-			persistor.Store(id, compKey, newState)
+			if err := persistor.Store(id, compKey, newState); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -97,7 +105,9 @@ func (w *Count) store(id middleware.DelId, persistor *persistance.Persistor) err
 		}
 
 		newState := w.encode(prevCount + partialCount)
-		persistor.Store(id, compKey, newState, header)
+		if err := persistor.Store(id, compKey, newState, header); err != nil {
+			return err
+		}
 	}
 
 	return nil
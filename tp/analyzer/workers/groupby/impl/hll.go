@@ -0,0 +1,89 @@
+package impl
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// 2^HLL_PRECISION registers, a standard error of about 1.6%
+const HLL_PRECISION = 12
+
+// HyperLogLog sketch for approximate count-distinct, two of them merge by
+// keeping the max of every register
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{make([]uint8, 1<<HLL_PRECISION)}
+}
+
+// Hashes are the same in every replica, so sketches of different replicas can be merged
+func hash64(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+
+	// Mixes the bits, fnv alone leaves the higher ones poorly distributed
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *hyperLogLog) add(value string) {
+	x := hash64(value)
+	i := x >> (64 - HLL_PRECISION)
+	rank := uint8(bits.LeadingZeros64(x<<HLL_PRECISION|1<<(HLL_PRECISION-1)) + 1)
+	h.registers[i] = max(h.registers[i], rank)
+}
+
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		h.registers[i] = max(h.registers[i], rank)
+	}
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Linear counting is more precise for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// Encoded without padding, the protocol doesn't allow '=' in values
+func (h *hyperLogLog) encode() string {
+	return base64.RawURLEncoding.EncodeToString(h.registers)
+}
+
+func decodeHyperLogLog(s string) (*hyperLogLog, error) {
+	registers, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(registers) != 1<<HLL_PRECISION {
+		return nil, fmt.Errorf("invalid amount of registers: %d", len(registers))
+	}
+	return &hyperLogLog{registers}, nil
+}
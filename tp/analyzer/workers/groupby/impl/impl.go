@@ -36,6 +36,11 @@ func New(con *config.GroupByConfig, log *logging.Logger) (*GroupBy, error) {
 		"sum":   NewSum,
 		"mean":  NewMean,
 	}[con.Aggregator]
+	if con.Window.Type == config.WINDOW_SESSION {
+		handler = NewSession
+	} else if len(con.Aggregations) > 0 {
+		handler = NewMulti
+	}
 
 	w := &GroupBy{
 		Worker:    base,
@@ -57,11 +62,17 @@ func (w *GroupBy) Batch(qId int, del middleware.Delivery) {
 
 	batch, err := comms.DecodeBatch(body)
 	if err != nil {
-		w.Log.Fatalf("failed to decode batch: %v", err)
+		w.DeadLetter(qId, del, err)
+		return
+	}
+
+	fieldMaps := batch.FieldMaps
+	if w.con.Window.Type == config.WINDOW_TUMBLING || w.con.Window.Type == config.WINDOW_SLIDING {
+		fieldMaps = w.windows(fieldMaps)
 	}
 
 	shardKeys := w.con.GroupKeys
-	shards, err := comms.Shard(batch.FieldMaps, shardKeys, func(s string) string { return s })
+	shards, err := comms.Shard(fieldMaps, shardKeys, func(s string) string { return s })
 	if err != nil {
 		w.Log.Errorf("failed to shard batch: %v", err)
 		return
@@ -73,7 +84,9 @@ func (w *GroupBy) Batch(qId int, del middleware.Delivery) {
 	}
 
 	// Persist once the entire delivery is processed
-	w.handler.store(del.Id(), &w.persistor)
+	if err := w.handler.store(del.Id(), &w.persistor); err != nil {
+		w.Log.Errorf("failed to store state: %v", err)
+	}
 }
 
 func (w *GroupBy) Eof(qId int, del middleware.Delivery) {
@@ -43,7 +43,7 @@ func (w *Mean) add(shards map[string][]map[string]string, con config.GroupByConf
 			}
 
 			tup := w.state[compKey]
-			w.state[compKey] = tuple{tup.sum + sumValue, tup.n + 1}
+			w.state[compKey] = tuple{tup.sum + sumValue, tup.n + comms.Rows(fieldMap)}
 		}
 	}
 
@@ -92,7 +92,12 @@ func (w *Mean) result(clientId int, con config.GroupByConfig, persistor persista
 			fieldMap[con.GroupKeys[i]] = key
 		}
 
-		fieldMap[con.Storage] = strconv.FormatFloat(sum/float64(n), 'f', 4, 64)
+		if con.Partial {
+			fieldMap[con.AggKey] = strconv.FormatFloat(sum, 'f', -1, 64)
+			fieldMap[comms.ROWS] = strconv.Itoa(n)
+		} else {
+			fieldMap[con.Storage] = strconv.FormatFloat(sum/float64(n), 'f', 4, 64)
+		}
 		fieldMaps = append(fieldMaps, fieldMap)
 	}
 
@@ -109,7 +114,9 @@ func (w *Mean) store(id middleware.DelId, persistor *persistance.Persistor) erro
 		exists := err == nil
 		if !exists {
 			newState := w.encode(partialTup.sum, partialTup.n)
-			persistor.Store(id, compKey, newState)
+			if err := persistor.Store(id, compKey, newState); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -125,7 +132,9 @@ func (w *Mean) store(id middleware.DelId, persistor *persistance.Persistor) erro
 		}
 
 		newState := w.encode(prevSum+partialTup.sum, prevCount+partialTup.n)
-		persistor.Store(id, compKey, newState, header)
+		if err := persistor.Store(id, compKey, newState, header); err != nil {
+			return err
+		}
 	}
 
 	return nil
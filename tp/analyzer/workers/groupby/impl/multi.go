@@ -0,0 +1,140 @@
+package impl
+
+import (
+	"fmt"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/comms/persistance"
+	"analyzer/workers/groupby/config"
+)
+
+// Computes several aggregations at once, each key is persisted as a line per
+// aggregation with its mergeable state
+type Multi struct {
+	*GroupBy
+	state map[string][]aggregate
+}
+
+func NewMulti(w *GroupBy) GroupByHandler {
+	return &Multi{
+		GroupBy: w,
+		state:   make(map[string][]aggregate),
+	}
+}
+
+func newAggregates(aggs []config.Aggregation) []aggregate {
+	aggregates := make([]aggregate, 0, len(aggs))
+	for _, agg := range aggs {
+		aggregates = append(aggregates, newAggregate(agg))
+	}
+	return aggregates
+}
+
+// The batch is aggregated apart and only kept if all of its rows are valid, so a
+// failed batch doesn't leave its first rows to be stored with the next delivery
+func (w *Multi) add(shards map[string][]map[string]string, con config.GroupByConfig) error {
+	state := make(map[string][]aggregate, len(shards))
+	for compKey, fieldMaps := range shards {
+		aggregates, ok := state[compKey]
+		if !ok {
+			aggregates = newAggregates(con.Aggregations)
+			state[compKey] = aggregates
+		}
+
+		for _, fieldMap := range fieldMaps {
+			for i, agg := range con.Aggregations {
+				if con.Merge {
+					other, err := decodeAggregate(agg, fieldMap[agg.Storage])
+					if err != nil {
+						return err
+					}
+					aggregates[i].merge(other)
+					continue
+				}
+
+				value, ok := fieldMap[agg.Key]
+				if !ok && agg.Aggregator != "count" {
+					return fmt.Errorf("value %v was not found", agg.Key)
+				}
+				if err := aggregates[i].add(value, comms.Rows(fieldMap)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	w.state = state
+	return nil
+}
+
+func (w *Multi) result(clientId int, con config.GroupByConfig, persistor persistance.Persistor) ([]map[string]string, error) {
+	persistedFiles, err := persistor.RecoverFor(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldMaps := make([]map[string]string, 0)
+	for pf := range persistedFiles {
+		aggregates, err := decodeAggregates(con.Aggregations, pf.State)
+		if err != nil {
+			continue
+		}
+
+		fieldMap := make(map[string]string)
+		keys := strings.Split(pf.FileName, comms.SEP)
+		for i, key := range keys {
+			fieldMap[con.GroupKeys[i]] = key
+		}
+
+		// Partial results carry the states, a groupby with MERGE downstream merges them
+		for i, agg := range con.Aggregations {
+			if con.Partial {
+				fieldMap[agg.Storage] = aggregates[i].encode()
+			} else {
+				fieldMap[agg.Storage] = aggregates[i].result()
+			}
+		}
+		fieldMaps = append(fieldMaps, fieldMap)
+	}
+
+	return fieldMaps, nil
+}
+
+func (w *Multi) store(id middleware.DelId, persistor *persistance.Persistor) error {
+	defer func() { w.state = make(map[string][]aggregate) }()
+
+	clientId := id.ClientId
+
+	for compKey, partialAggregates := range w.state {
+		pf, err := persistor.Load(clientId, compKey)
+		exists := err == nil
+		if !exists {
+			if err := persistor.Store(id, compKey, encodeAggregates(partialAggregates)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header := pf.Header
+		if header.IsDup(id) {
+			continue
+		}
+
+		aggregates, err := decodeAggregates(w.con.Aggregations, pf.State)
+		if err != nil {
+			w.Log.Errorf("failed to decode state: %v", err)
+			continue
+		}
+
+		for i := range aggregates {
+			aggregates[i].merge(partialAggregates[i])
+		}
+		if err := persistor.Store(id, compKey, encodeAggregates(aggregates), header); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
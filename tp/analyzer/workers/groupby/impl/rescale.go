@@ -0,0 +1,134 @@
+package impl
+
+import (
+	"slices"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/comms/persistance"
+	"analyzer/workers"
+)
+
+// Returns the files of the client that change owner with the rescale, by the replica they go to
+func (w *GroupBy) moved(clientId int, rescale comms.Rescale) (map[int][]string, []string, error) {
+	fileNames, err := w.persistor.FileNames(clientId)
+	if err != nil {
+		return nil, nil, err
+	}
+	slices.Sort(fileNames)
+
+	moved := make(map[int][]string)
+	dropped := make([]string, 0)
+	for _, fileName := range fileNames {
+		fieldMap := make(map[string]string, len(w.con.GroupKeys))
+		for i, value := range strings.Split(fileName, comms.SEP) {
+			if i < len(w.con.GroupKeys) {
+				fieldMap[w.con.GroupKeys[i]] = value
+			}
+		}
+
+		key, _ := comms.ShardKey(fieldMap, rescale.Keys)
+		dests, keeps := workers.Destinations(w.con.Id, rescale, key)
+		for _, j := range dests {
+			moved[j] = append(moved[j], fileName)
+		}
+		if !keeps {
+			dropped = append(dropped, fileName)
+		}
+	}
+
+	return moved, dropped, nil
+}
+
+// The groups that change owner are handed over as they're persisted. A partial groupby
+// publishes their results instead, they're merged downstream with the rest
+func (w *GroupBy) HandOff(clientId int, rescales []comms.Rescale) (map[int][]byte, error) {
+	moved, dropped, err := w.moved(clientId, rescales[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if w.con.Partial {
+		return nil, w.publishGroups(clientId, dropped)
+	}
+
+	states := make(map[int][]byte, len(moved))
+	for j, fileNames := range moved {
+		files := make([]persistance.PersistedFile, 0, len(fileNames))
+		for _, fileName := range fileNames {
+			pf, err := w.persistor.Load(clientId, fileName)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, pf)
+		}
+		states[j] = persistance.EncodeFiles(files)
+	}
+
+	return states, nil
+}
+
+// Publishes the results of the given groups
+func (w *GroupBy) publishGroups(clientId int, fileNames []string) error {
+	if len(fileNames) == 0 {
+		return nil
+	}
+
+	fieldMaps, err := w.handler.result(clientId, *w.con, w.persistor)
+	if err != nil {
+		return err
+	}
+
+	groups := make([]map[string]string, 0, len(fileNames))
+	for _, fieldMap := range fieldMaps {
+		key, err := comms.ShardKey(fieldMap, w.con.GroupKeys)
+		if err == nil && slices.Contains(fileNames, key) {
+			groups = append(groups, fieldMap)
+		}
+	}
+
+	if len(groups) == 0 {
+		return nil
+	}
+	return w.Mailer.PublishBatch(comms.NewBatch(groups), clientId)
+}
+
+func (w *GroupBy) Drop(clientId int, rescales []comms.Rescale) error {
+	_, dropped, err := w.moved(clientId, rescales[0])
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range dropped {
+		if err := w.persistor.Remove(clientId, fileName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Each group has a single owner, so the ones handed over are new to this replica
+func (w *GroupBy) TakeOver(id middleware.DelId, state []byte) error {
+	files, err := persistance.DecodeFiles(state)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		pf, err := w.persistor.Load(id.ClientId, file.FileName)
+		if err == nil {
+			if !pf.Header.IsDup(id) {
+				w.Log.Errorf("group %s of client %d was handed over but it's already here, kept the one here", file.FileName, id.ClientId)
+			}
+			continue
+		}
+
+		if err := w.persistor.Store(id, file.FileName, file.State); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/comms/persistance"
+	"analyzer/workers/groupby/config"
+)
+
+// Events of a key closer than the gap, aggregated as a sum and the amount of rows
+type session struct {
+	start time.Time
+	end   time.Time
+	sum   float64
+	n     int
+}
+
+// Session windows are kept per key as a list of sessions that get merged as
+// events arrive, no matter the order they arrive in
+type Session struct {
+	*GroupBy
+	state map[string][]session
+}
+
+func NewSession(w *GroupBy) GroupByHandler {
+	return &Session{
+		GroupBy: w,
+		state:   make(map[string][]session),
+	}
+}
+
+// Adds the session and merges the ones that end up closer than the gap
+func mergeSession(sessions []session, s session, gap time.Duration) []session {
+	sessions = append(sessions, s)
+	slices.SortFunc(sessions, func(a, b session) int { return a.start.Compare(b.start) })
+
+	merged := sessions[:1]
+	for _, next := range sessions[1:] {
+		last := &merged[len(merged)-1]
+		if next.start.Sub(last.end) > gap {
+			merged = append(merged, next)
+			continue
+		}
+
+		if next.end.After(last.end) {
+			last.end = next.end
+		}
+		last.sum += next.sum
+		last.n += next.n
+	}
+
+	return merged
+}
+
+func (w *Session) add(shards map[string][]map[string]string, con config.GroupByConfig) error {
+	for compKey, fieldMaps := range shards {
+		for _, fieldMap := range fieldMaps {
+			t, err := parseEventTime(fieldMap[con.Window.Key])
+			if err != nil {
+				return err
+			}
+
+			var value float64
+			if con.Aggregator != "count" {
+				valueStr, ok := fieldMap[con.AggKey]
+				if !ok {
+					return fmt.Errorf("value %v was not found", con.AggKey)
+				}
+
+				value, err = strconv.ParseFloat(valueStr, 64)
+				if err != nil {
+					return fmt.Errorf("the aggregated value is not numerical %v", valueStr)
+				}
+			}
+
+			s := session{t, t, value, comms.Rows(fieldMap)}
+			w.state[compKey] = mergeSession(w.state[compKey], s, con.Window.Gap)
+		}
+	}
+
+	return nil
+}
+
+// Example: a "<start> <end> <sum> <n>" line per session, with the times in unix nanoseconds
+func (w *Session) encode(sessions []session) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, s := range sessions {
+		fmt.Fprintf(buf, "%d %d %f %d\n", s.start.UnixNano(), s.end.UnixNano(), s.sum, s.n)
+	}
+	return buf.Bytes()
+}
+
+func (w *Session) decode(state []byte) ([]session, error) {
+	sessions := make([]session, 0)
+
+	for line := range bytes.Lines(bytes.TrimSpace(state)) {
+		var start, end int64
+		var s session
+		if _, err := fmt.Sscanf(string(line), "%d %d %f %d", &start, &end, &s.sum, &s.n); err != nil {
+			return nil, fmt.Errorf("invalid session %q: %v", line, err)
+		}
+
+		s.start = time.Unix(0, start).UTC()
+		s.end = time.Unix(0, end).UTC()
+		sessions = append(sessions, s)
+	}
+
+	return sessions, nil
+}
+
+func (w *Session) result(clientId int, con config.GroupByConfig, persistor persistance.Persistor) ([]map[string]string, error) {
+	persistedFiles, err := persistor.RecoverFor(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldMaps := make([]map[string]string, 0)
+	for pf := range persistedFiles {
+		sessions, err := w.decode(pf.State)
+		if err != nil {
+			continue
+		}
+
+		keys := strings.Split(pf.FileName, comms.SEP)
+		for _, s := range sessions {
+			fieldMap := make(map[string]string)
+			for i, key := range keys {
+				fieldMap[con.GroupKeys[i]] = key
+			}
+
+			fieldMap[config.WINDOW_START] = formatEventTime(s.start)
+			fieldMap[config.WINDOW_END] = formatEventTime(s.end)
+
+			switch con.Aggregator {
+			case "count":
+				fieldMap[con.Storage] = strconv.Itoa(s.n)
+			case "sum":
+				fieldMap[con.Storage] = strconv.FormatFloat(s.sum, 'f', -1, 64)
+			case "mean":
+				fieldMap[con.Storage] = strconv.FormatFloat(s.sum/float64(s.n), 'f', 4, 64)
+			}
+			fieldMaps = append(fieldMaps, fieldMap)
+		}
+	}
+
+	return fieldMaps, nil
+}
+
+func (w *Session) store(id middleware.DelId, persistor *persistance.Persistor) error {
+	defer func() { w.state = make(map[string][]session) }()
+
+	clientId := id.ClientId
+
+	for compKey, partialSessions := range w.state {
+		pf, err := persistor.Load(clientId, compKey)
+		exists := err == nil
+		if !exists {
+			if err := persistor.Store(id, compKey, w.encode(partialSessions)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header := pf.Header
+		if header.IsDup(id) {
+			continue
+		}
+
+		sessions, err := w.decode(pf.State)
+		if err != nil {
+			w.Log.Errorf("failed to decode state: %v", err)
+			continue
+		}
+
+		for _, s := range partialSessions {
+			sessions = mergeSession(sessions, s, w.con.Window.Gap)
+		}
+		if err := persistor.Store(id, compKey, w.encode(sessions), header); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -63,7 +63,11 @@ func (w *Sum) result(clientId int, con config.GroupByConfig, persistor persistan
 			fieldMap[con.GroupKeys[i]] = key
 		}
 
-		fieldMap[con.Storage] = strconv.Itoa(sum)
+		if con.Partial {
+			fieldMap[con.AggKey] = strconv.Itoa(sum)
+		} else {
+			fieldMap[con.Storage] = strconv.Itoa(sum)
+		}
 		fieldMaps = append(fieldMaps, fieldMap)
 	}
 
@@ -93,7 +97,9 @@ func (w *Sum) store(id middleware.DelId, persistor *persistance.Persistor) error
 		exists := err == nil
 		if !exists {
 			newState := w.encode(partialSum)
-			persistor.Store(id, compKey, newState)
+			if err := persistor.Store(id, compKey, newState); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -109,7 +115,9 @@ func (w *Sum) store(id middleware.DelId, persistor *persistance.Persistor) error
 		}
 
 		newState := w.encode(prevSum + partialSum)
-		persistor.Store(id, compKey, newState, header)
+		if err := persistor.Store(id, compKey, newState, header); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,146 @@
+package impl
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Bigger compressions keep more centroids and give more precise quantiles
+const TDIGEST_COMPRESSION = 100
+
+type centroid struct {
+	mean  float64
+	count int
+}
+
+// Merging t-digest for approximate quantiles, two of them merge by
+// compressing the centroids of both
+type tDigest struct {
+	centroids []centroid
+	total     int
+}
+
+func newTDigest() *tDigest {
+	return &tDigest{}
+}
+
+func (t *tDigest) add(value float64, count int) {
+	t.centroids = append(t.centroids, centroid{value, count})
+	t.total += count
+
+	if len(t.centroids) > 10*TDIGEST_COMPRESSION {
+		t.compress()
+	}
+}
+
+func (t *tDigest) merge(other *tDigest) {
+	t.centroids = append(t.centroids, other.centroids...)
+	t.total += other.total
+	t.compress()
+}
+
+// Merges neighbouring centroids while they stay under the size the quantile allows,
+// so they are small at the tails and bigger around the median
+func (t *tDigest) compress() {
+	if len(t.centroids) <= 1 {
+		return
+	}
+
+	slices.SortFunc(t.centroids, func(a, b centroid) int {
+		if a.mean < b.mean {
+			return -1
+		} else if a.mean > b.mean {
+			return 1
+		}
+		return 0
+	})
+
+	total := float64(t.total)
+	compressed := []centroid{t.centroids[0]}
+	seen := 0.0
+
+	for _, c := range t.centroids[1:] {
+		last := &compressed[len(compressed)-1]
+		q := (seen + float64(last.count+c.count)/2) / total
+		limit := 4 * total * q * (1 - q) / TDIGEST_COMPRESSION
+
+		if float64(last.count+c.count) <= max(limit, 1) {
+			n := last.count + c.count
+			last.mean += (c.mean - last.mean) * float64(c.count) / float64(n)
+			last.count = n
+			continue
+		}
+
+		seen += float64(last.count)
+		compressed = append(compressed, c)
+	}
+
+	t.centroids = compressed
+}
+
+// Interpolates between the centers of the centroids around the quantile
+func (t *tDigest) quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	target := q * float64(t.total)
+	seen := 0.0
+	for i, c := range t.centroids {
+		center := seen + float64(c.count)/2
+		if target <= center {
+			if i == 0 {
+				return c.mean
+			}
+			prev := t.centroids[i-1]
+			prevCenter := seen - float64(prev.count)/2
+			ratio := (target - prevCenter) / (center - prevCenter)
+			return prev.mean + ratio*(c.mean-prev.mean)
+		}
+		seen += float64(c.count)
+	}
+
+	return t.centroids[len(t.centroids)-1].mean
+}
+
+// Example: "<mean>/<count> ... <mean>/<count>"
+func (t *tDigest) encode() string {
+	t.compress()
+
+	parts := make([]string, 0, len(t.centroids))
+	for _, c := range t.centroids {
+		parts = append(parts, strconv.FormatFloat(c.mean, 'g', -1, 64)+"/"+strconv.Itoa(c.count))
+	}
+	return strings.Join(parts, " ")
+}
+
+func decodeTDigest(s string) (*tDigest, error) {
+	t := newTDigest()
+
+	for part := range strings.FieldsSeq(s) {
+		meanStr, countStr, ok := strings.Cut(part, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid centroid: %v", part)
+		}
+
+		mean, err := strconv.ParseFloat(meanStr, 64)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil {
+			return nil, err
+		}
+
+		t.centroids = append(t.centroids, centroid{mean, count})
+		t.total += count
+	}
+
+	return t, nil
+}
@@ -0,0 +1,65 @@
+package impl
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"time"
+
+	"analyzer/workers/groupby/config"
+)
+
+// Event times are unix timestamps in seconds, as in the ratings, or RFC3339 dates
+func parseEventTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the event time is invalid: %v", s)
+	}
+	return t.UTC(), nil
+}
+
+func formatEventTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Returns the starts of the windows that contain t, a tumbling window is a
+// sliding one whose slide is its size
+func windowStarts(window config.WindowConfig, t time.Time) []time.Time {
+	starts := make([]time.Time, 0, 1)
+	for start := window.Slide.Floor(t); window.Size.Add(start, 1).After(t) && len(starts) < config.MAX_WINDOWS_PER_EVENT; start = window.Slide.Add(start, -1) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// Copies every row once per window it belongs to, with the window bounds as columns
+func (w *GroupBy) windows(fieldMaps []map[string]string) []map[string]string {
+	window := w.con.Window
+	windowed := make([]map[string]string, 0, len(fieldMaps))
+	invalid := 0
+
+	for _, fieldMap := range fieldMaps {
+		t, err := parseEventTime(fieldMap[window.Key])
+		if err != nil {
+			invalid++
+			continue
+		}
+
+		for _, start := range windowStarts(window, t) {
+			row := maps.Clone(fieldMap)
+			row[config.WINDOW_START] = formatEventTime(start)
+			row[config.WINDOW_END] = formatEventTime(window.Size.Add(start, 1))
+			windowed = append(windowed, row)
+		}
+	}
+
+	if invalid > 0 {
+		w.Log.Warningf("discarded %d rows without a valid %v", invalid, window.Key)
+	}
+
+	return windowed
+}
@@ -3,14 +3,56 @@ package config
 import (
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 
+	"analyzer/comms"
 	"analyzer/workers/config"
 )
 
 type JoinConfig struct {
 	config.Config
-	LeftKey  string
-	RightKey string
+	LeftKeys      []string
+	RightKeys     []string
+	KeyTypes      []string
+	LeftRenames   map[string]string
+	RightRenames  map[string]string
+	OnCollision   string
+	JoinType      string
+	JoinMode      string
+	LeftBroadcast bool
+}
+
+// Example: "left.id:movieId,right.rating:count"
+func parseRenames(s string) (map[string]string, map[string]string, error) {
+	left, right := make(map[string]string), make(map[string]string)
+	if len(s) == 0 {
+		return left, right, nil
+	}
+
+	for entry := range strings.SplitSeq(s, ",") {
+		from, to, found := strings.Cut(entry, ":")
+		side, col, sideFound := strings.Cut(from, ".")
+		if !found || !sideFound || len(col) == 0 || len(to) == 0 {
+			return nil, nil, fmt.Errorf("the entry %q is not of the form <left|right>.<column>:<new column>", entry)
+		}
+
+		if !comms.IsColumn(to) {
+			return nil, nil, fmt.Errorf("the column %v is not supported by the protocol", to)
+		}
+
+		switch side {
+		case "left":
+			left[col] = to
+		case "right":
+			right[col] = to
+		default:
+			return nil, nil, fmt.Errorf("the side %v of the entry %q is neither left nor right", side, entry)
+		}
+	}
+
+	return left, right, nil
 }
 
 func Create() (*JoinConfig, error) {
@@ -19,15 +61,97 @@ func Create() (*JoinConfig, error) {
 		return nil, err
 	}
 
-	leftKey := os.Getenv("LEFT_KEY")
-	if len(leftKey) == 0 {
+	leftKeysVar := os.Getenv("LEFT_KEY")
+	if len(leftKeysVar) == 0 {
 		return nil, fmt.Errorf("no left key was provided")
 	}
+	leftKeys := strings.Split(leftKeysVar, ",")
 
-	rightKey := os.Getenv("RIGHT_KEY")
-	if len(rightKey) == 0 {
+	rightKeysVar := os.Getenv("RIGHT_KEY")
+	if len(rightKeysVar) == 0 {
 		return nil, fmt.Errorf("no right key was provided")
 	}
+	rightKeys := strings.Split(rightKeysVar, ",")
+
+	if len(leftKeys) != len(rightKeys) {
+		return nil, fmt.Errorf("the length of left keys and right keys don't match (left: %d, right: %d)", len(leftKeys), len(rightKeys))
+	}
+
+	validKeyTypes := []string{"string", "number"}
+	keyTypes := slices.Repeat([]string{"string"}, len(leftKeys))
+	if keyTypesVar := os.Getenv("KEY_TYPES"); len(keyTypesVar) > 0 {
+		keyTypes = strings.Split(keyTypesVar, ",")
+	}
+	if len(keyTypes) != len(leftKeys) {
+		return nil, fmt.Errorf("the length of key types and keys don't match (types: %d, keys: %d)", len(keyTypes), len(leftKeys))
+	}
+	for _, keyType := range keyTypes {
+		if !slices.Contains(validKeyTypes, keyType) {
+			return nil, fmt.Errorf("the given key type is invalid %v", keyType)
+		}
+	}
+
+	leftRenames, rightRenames, err := parseRenames(os.Getenv("RENAME"))
+	if err != nil {
+		return nil, fmt.Errorf("the renames are invalid: %v", err)
+	}
+
+	validCollisions := []string{"right", "left", "error"}
+	onCollision := os.Getenv("ON_COLLISION")
+	if len(onCollision) == 0 {
+		onCollision = "right"
+	}
+	if !slices.Contains(validCollisions, onCollision) {
+		return nil, fmt.Errorf("the given collision policy is invalid %v", onCollision)
+	}
+
+	validJoinTypes := []string{"inner", "left", "right", "semi", "anti"}
+	joinType := os.Getenv("JOIN_TYPE")
+	if len(joinType) == 0 {
+		joinType = "inner"
+	}
+	if !slices.Contains(validJoinTypes, joinType) {
+		return nil, fmt.Errorf("the given join type is invalid %v", joinType)
+	}
+
+	validJoinModes := []string{"build", "symmetric"}
+	joinMode := os.Getenv("JOIN_MODE")
+	if len(joinMode) == 0 {
+		joinMode = "build"
+	}
+	if !slices.Contains(validJoinModes, joinMode) {
+		return nil, fmt.Errorf("the given join mode is invalid %v", joinMode)
+	}
+
+	if joinMode == "symmetric" && joinType != "inner" {
+		return nil, fmt.Errorf("the symmetric join mode only supports the inner join type, got %v", joinType)
+	}
+
+	// LEFT_BROADCAST
+	leftBroadcast := false
+	if leftBroadcastVar := os.Getenv("LEFT_BROADCAST"); len(leftBroadcastVar) > 0 {
+		leftBroadcast, err = strconv.ParseBool(leftBroadcastVar)
+		if err != nil {
+			return nil, fmt.Errorf("the left broadcast value is invalid: %v", err)
+		}
+	}
+
+	// Every replica has the whole left side, so each of them would publish the left rows
+	// it found unmatched or matched on its own share of the right side
+	if leftBroadcast && joinType != "inner" && joinType != "right" {
+		return nil, fmt.Errorf("a broadcast left side only supports the inner and right join types, got %v", joinType)
+	}
 
-	return &JoinConfig{con, leftKey, rightKey}, nil
+	return &JoinConfig{
+		Config:        con,
+		LeftKeys:      leftKeys,
+		RightKeys:     rightKeys,
+		KeyTypes:      keyTypes,
+		LeftRenames:   leftRenames,
+		RightRenames:  rightRenames,
+		OnCollision:   onCollision,
+		JoinType:      joinType,
+		JoinMode:      joinMode,
+		LeftBroadcast: leftBroadcast,
+	}, nil
 }
@@ -1,8 +1,11 @@
 package impl
 
 import (
+	"fmt"
 	"iter"
 	"maps"
+	"strconv"
+	"strings"
 
 	"analyzer/comms"
 	"analyzer/comms/middleware"
@@ -19,10 +22,37 @@ const (
 )
 
 const OUT_OF_ORDER_FILENAME = "out-of-order"
+
+// Rows published per batch when emitting the unmatched left rows
+const UNMATCHED_BATCH_SIZE = 1024
+
 const READING_RIGHT_FILENAME = "reading-right"
 const LEFT_PERSISTOR_DIRNAME = "left-persistor"
 const RIGHT_PERSISTOR_DIRNAME = "right-persistor"
 
+// Left keys that had a match are marked with a file in the right persistor
+const MATCHED_PREFIX = "matched-"
+
+const (
+	JOIN_INNER = "inner"
+	JOIN_LEFT  = "left"
+	JOIN_RIGHT = "right"
+	JOIN_SEMI  = "semi"
+	JOIN_ANTI  = "anti"
+)
+
+const (
+	MODE_BUILD     = "build"
+	MODE_SYMMETRIC = "symmetric"
+)
+
+const KEY_NUMBER = "number"
+
+const (
+	COLLISION_LEFT  = "left"
+	COLLISION_ERROR = "error"
+)
+
 type Join struct {
 	*workers.Worker
 	Con            *config.JoinConfig
@@ -31,10 +61,14 @@ type Join struct {
 
 	// Persisted
 	readingRight map[int]struct{}
+	chunks       map[int]map[string]*keyChunks
 }
 
 func (w *Join) tryRecover() error {
-	persistedFiles, err := w.rightPersistor.Recover()
+	// The rest of the right files are only read when they're needed
+	persistedFiles, err := w.rightPersistor.RecoverFunc(func(fileName string) bool {
+		return fileName == READING_RIGHT_FILENAME
+	})
 	if err != nil {
 		return err
 	}
@@ -59,6 +93,7 @@ func New(con *config.JoinConfig, log *logging.Logger) (*Join, error) {
 		Worker:         base,
 		Con:            con,
 		readingRight:   make(map[int]struct{}),
+		chunks:         make(map[int]map[string]*keyChunks),
 		leftPersistor:  persistance.New(LEFT_PERSISTOR_DIRNAME, con.InputCopies[0], log),
 		rightPersistor: persistance.New(RIGHT_PERSISTOR_DIRNAME, con.InputCopies[1], log),
 	}
@@ -70,15 +105,95 @@ func New(con *config.JoinConfig, log *logging.Logger) (*Join, error) {
 	return w, nil
 }
 
-func joinFieldMaps(left map[string]string, right map[string]string) map[string]string {
+// Joins the columns of both rows, a column both of them have with different
+// values is resolved as `ON_COLLISION` says
+func (w *Join) joinFieldMaps(left map[string]string, right map[string]string) (map[string]string, error) {
 	joined := make(map[string]string, len(left)+len(right))
 	maps.Copy(joined, left)
-	maps.Copy(joined, right)
-	return joined
+
+	for col, value := range right {
+		if prev, ok := joined[col]; ok && prev != value {
+			switch w.Con.OnCollision {
+			case COLLISION_LEFT:
+				continue
+			case COLLISION_ERROR:
+				return nil, fmt.Errorf("column %v is %v on the left and %v on the right", col, prev, value)
+			}
+		}
+		joined[col] = value
+	}
+
+	return joined, nil
 }
 
-func keyHash(str string) string {
-	return str
+// Numbers are compared by value, so "862" and "862.0" are the same key
+func normalizeKey(value string, keyType string) (string, error) {
+	if keyType != KEY_NUMBER {
+		return value, nil
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return "", fmt.Errorf("the key value %v is not a number", value)
+	}
+
+	return strconv.FormatFloat(n, 'f', -1, 64), nil
+}
+
+func rename(fieldMap map[string]string, renames map[string]string) map[string]string {
+	if len(renames) == 0 {
+		return fieldMap
+	}
+
+	renamed := make(map[string]string, len(fieldMap))
+	for col, value := range fieldMap {
+		if to, ok := renames[col]; ok {
+			col = to
+		}
+		renamed[col] = value
+	}
+
+	return renamed
+}
+
+func joinKey(fieldMap map[string]string, keys []string, keyTypes []string) (string, error) {
+	values := make([]string, 0, len(keys))
+	for i, key := range keys {
+		value, ok := fieldMap[key]
+		if !ok {
+			return "", fmt.Errorf("key %v was not found in field map while sharding", key)
+		}
+
+		normalized, err := normalizeKey(value, keyTypes[i])
+		if err != nil {
+			return "", err
+		}
+		values = append(values, normalized)
+	}
+
+	return strings.Join(values, comms.SEP), nil
+}
+
+// Groups the rows of a side by their normalized join keys, renaming their columns.
+// Rows without a valid key can't match anything, so they are skipped
+func (w *Join) shard(qId int, fieldMaps []map[string]string) map[string][]map[string]string {
+	keys, renames := w.Con.LeftKeys, w.Con.LeftRenames
+	if qId == RIGHT {
+		keys, renames = w.Con.RightKeys, w.Con.RightRenames
+	}
+
+	shards := make(map[string][]map[string]string)
+	for _, fieldMap := range fieldMaps {
+		k, err := joinKey(fieldMap, keys, w.Con.KeyTypes)
+		if err != nil {
+			w.Log.Warningf("skipping row %v in qId %d: %v", fieldMap, qId, err)
+			continue
+		}
+
+		shards[k] = append(shards[k], rename(fieldMap, renames))
+	}
+
+	return shards
 }
 
 func (w *Join) encode(fieldMaps []map[string]string) []byte {
@@ -100,18 +215,8 @@ func (w *Join) decode(state []byte) (iter.Seq[map[string]string], error) {
 	}, nil
 }
 
-func handleLeft(w *Join, id middleware.DelId, data []byte) error {
-	batch, err := comms.DecodeBatch(data)
-	if err != nil {
-		w.Log.Criticalf("failed to decode batch: %v", err)
-		return err
-	}
-
-	shardKeys := []string{w.Con.LeftKey}
-	shards, err := comms.Shard(batch.FieldMaps, shardKeys, keyHash)
-	if err != nil {
-		return err
-	}
+func handleLeft(w *Join, id middleware.DelId, batch *comms.Batch) error {
+	shards := w.shard(LEFT, batch.FieldMaps)
 
 	clientId := id.ClientId
 
@@ -140,25 +245,20 @@ func handleLeft(w *Join, id middleware.DelId, data []byte) error {
 	return nil
 }
 
-func handleRight(w *Join, id middleware.DelId, data []byte) error {
-	batch, err := comms.DecodeBatch(data)
-	if err != nil {
-		w.Log.Fatalf("failed to decode batch: %v", err)
-	}
-
-	shardKeys := []string{w.Con.RightKey}
-	shards, err := comms.Shard(batch.FieldMaps, shardKeys, keyHash)
-	if err != nil {
-		return err
-	}
+func handleRight(w *Join, id middleware.DelId, batch *comms.Batch) error {
+	shards := w.shard(RIGHT, batch.FieldMaps)
 
 	clientId := id.ClientId
+	joinType := w.Con.JoinType
 	responseFieldMaps := make([]map[string]string, 0)
 
 	for k, shard := range shards {
 		pf, err := w.leftPersistor.Load(clientId, k)
 		exists := err == nil
 		if !exists {
+			if joinType == JOIN_RIGHT {
+				responseFieldMaps = append(responseFieldMaps, shard...)
+			}
 			continue
 		}
 
@@ -167,9 +267,38 @@ func handleRight(w *Join, id middleware.DelId, data []byte) error {
 			continue
 		}
 
+		switch joinType {
+		case JOIN_SEMI:
+			first, err := w.match(id, k)
+			if err != nil {
+				return err
+			}
+			if first {
+				for left := range decodedLefts {
+					responseFieldMaps = append(responseFieldMaps, left)
+				}
+			}
+			continue
+
+		case JOIN_ANTI:
+			if _, err := w.match(id, k); err != nil {
+				return err
+			}
+			continue
+
+		case JOIN_LEFT:
+			if _, err := w.match(id, k); err != nil {
+				return err
+			}
+		}
+
 		for left := range decodedLefts {
 			for _, right := range shard {
-				joined := joinFieldMaps(left, right)
+				joined, err := w.joinFieldMaps(left, right)
+				if err != nil {
+					w.Log.Errorf("failed to join rows for client %d: %v", clientId, err)
+					continue
+				}
 				responseFieldMaps = append(responseFieldMaps, joined)
 			}
 		}
@@ -186,13 +315,61 @@ func handleRight(w *Join, id middleware.DelId, data []byte) error {
 	return nil
 }
 
-func handleOutOfOrder(w *Join, id middleware.DelId, data []byte) error {
-	batch, err := comms.DecodeBatch(data)
+// Marks the left key as matched, returns whether it was this delivery that matched it
+// first. A delivery that's processed again after a crash gets the same answer
+func (w *Join) match(id middleware.DelId, k string) (bool, error) {
+	fileName := MATCHED_PREFIX + k
+
+	header, err := w.rightPersistor.LoadHeader(id.ClientId, fileName)
+	if err == nil && id.Replayed {
+		return header.HasReplay(id), nil
+	}
+	if err == nil {
+		return header.Seq(id.ReplicaId) == id.Seq, nil
+	}
+
+	return true, w.rightPersistor.Store(id, fileName, []byte{})
+}
+
+// Publishes the left rows whose key never had a match, for left and anti joins
+func (w *Join) publishUnmatched(clientId int) error {
+	files, err := w.leftPersistor.RecoverFor(clientId)
 	if err != nil {
-		w.Log.Criticalf("failed to decode batch: %v", err)
 		return err
 	}
 
+	fieldMaps := make([]map[string]string, 0)
+	for pf := range files {
+		if _, err := w.rightPersistor.LoadHeader(clientId, MATCHED_PREFIX+pf.FileName); err == nil {
+			continue
+		}
+
+		lefts, err := w.decode(pf.State)
+		if err != nil {
+			w.Log.Errorf("failed to decode left rows of key %v for client %d: %v", pf.FileName, clientId, err)
+			continue
+		}
+
+		for left := range lefts {
+			fieldMaps = append(fieldMaps, left)
+		}
+
+		if len(fieldMaps) >= UNMATCHED_BATCH_SIZE {
+			if err := w.Mailer.PublishBatch(comms.NewBatch(fieldMaps), clientId); err != nil {
+				return err
+			}
+			fieldMaps = make([]map[string]string, 0)
+		}
+	}
+
+	if len(fieldMaps) == 0 {
+		return nil
+	}
+
+	return w.Mailer.PublishBatch(comms.NewBatch(fieldMaps), clientId)
+}
+
+func handleOutOfOrder(w *Join, id middleware.DelId, batch *comms.Batch) error {
 	replicaId := id.ReplicaId
 	clientId := id.ClientId
 	seq := id.Seq
@@ -205,8 +382,7 @@ func handleOutOfOrder(w *Join, id middleware.DelId, data []byte) error {
 		return w.rightPersistor.Store(id, OUT_OF_ORDER_FILENAME, encoded)
 	}
 
-	header := pf.Header
-	if seq <= header.Seqs[replicaId] {
+	if seq <= pf.Header.Seq(replicaId) {
 		return nil
 	}
 
@@ -222,22 +398,32 @@ func (w *Join) Batch(qId int, del middleware.Delivery) {
 	clientId := del.Headers.ClientId
 
 	id := del.Id()
-	body := del.Body
-	if _, ok := w.readingRight[clientId]; !ok && qId == LEFT {
+	batch, err := comms.DecodeBatch(del.Body)
+	if err != nil {
+		w.DeadLetter(qId, del, err)
+		return
+	}
+
+	if w.Con.JoinMode == MODE_SYMMETRIC {
+		if err := handleSymmetric(w, qId, id, batch); err != nil {
+			w.Log.Errorf("error while handling batch in symmetric join: %v", err)
+		}
+
+	} else if _, ok := w.readingRight[clientId]; !ok && qId == LEFT {
 		// Reading left and given data is from LEFT queue
-		if err := handleLeft(w, id, body); err != nil {
+		if err := handleLeft(w, id, batch); err != nil {
 			w.Log.Errorf("error while handling batch in left side: %v", err)
 		}
 
 	} else if _, ok := w.readingRight[clientId]; ok && qId == RIGHT {
 		// Reading right and given data is from RIGHT queue
-		if err := handleRight(w, id, body); err != nil {
+		if err := handleRight(w, id, batch); err != nil {
 			w.Log.Errorf("error while handling batch in right side: %v", err)
 		}
 
 	} else if _, ok := w.readingRight[clientId]; !ok && qId == RIGHT {
 		// Reading left and given data is from RIGHT queue
-		if err := handleOutOfOrder(w, id, body); err != nil {
+		if err := handleOutOfOrder(w, id, batch); err != nil {
 			w.Log.Errorf("error while handling batch out of order: %v", err)
 		}
 
@@ -252,6 +438,11 @@ func (w *Join) Eof(qId int, del middleware.Delivery) {
 	clientId := id.ClientId
 	body := del.Body
 
+	if w.Con.JoinMode == MODE_SYMMETRIC {
+		w.symmetricEof(qId, del)
+		return
+	}
+
 	if _, ok := w.readingRight[clientId]; !ok {
 		w.readingRight[clientId] = struct{}{}
 
@@ -271,6 +462,12 @@ func (w *Join) Eof(qId int, del middleware.Delivery) {
 	exists := err == nil
 
 	if exists {
+		if w.Con.JoinType == JOIN_LEFT || w.Con.JoinType == JOIN_ANTI {
+			if err := w.publishUnmatched(clientId); err != nil {
+				w.Log.Errorf("failed to publish unmatched left rows: %v", err)
+			}
+		}
+
 		eof := comms.DecodeEof(body)
 		if err := w.Mailer.PublishEof(eof, clientId); err != nil {
 			w.Log.Errorf("failed to publish message: %v", err)
@@ -280,6 +477,7 @@ func (w *Join) Eof(qId int, del middleware.Delivery) {
 
 func (w *Join) flush(clientId int) {
 	delete(w.readingRight, clientId)
+	delete(w.chunks, clientId)
 	if err := w.leftPersistor.Flush(clientId); err != nil {
 		w.Log.Errorf("failed to flush left inner state for client %d: %v", clientId, err)
 	}
@@ -305,6 +503,7 @@ func (w *Join) Flush(qId int, del middleware.Delivery) {
 
 func (w *Join) purge() {
 	w.readingRight = make(map[int]struct{})
+	w.chunks = make(map[int]map[string]*keyChunks)
 	if err := w.leftPersistor.Purge(); err != nil {
 		w.Log.Errorf("failed to purge left inner state: %v", err)
 	}
@@ -0,0 +1,333 @@
+package impl
+
+import (
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/comms/persistance"
+	"analyzer/workers"
+)
+
+// Prefixes of the files handed over, by the persistor they go to
+const (
+	HANDOFF_LEFT  = "left/"
+	HANDOFF_RIGHT = "right/"
+)
+
+// Chunks handed over by another replica were already paired there, they're told apart from
+// the ones of the deliveries so a delivery is never taken for one of them
+const MOVED_REPLICA_ID = -1
+
+// State of a client that changes owner with a rescale
+type migration struct {
+	// Files handed over, by the replica they go to
+	files map[int][]persistance.PersistedFile
+
+	// Files removed from the left and right persistors
+	dropped [2][]string
+
+	// Out of order right rows that stay, nil if none of them leaves
+	kept []map[string]string
+}
+
+// Returns the key the sender of the side shards the row with, its columns are renamed back first
+func (w *Join) senderKey(qId int, row map[string]string, rescale comms.Rescale) string {
+	renames := w.Con.LeftRenames
+	if qId == RIGHT {
+		renames = w.Con.RightRenames
+	}
+
+	original := make(map[string]string, len(row))
+	for col, value := range row {
+		original[col] = value
+	}
+	for from, to := range renames {
+		if value, ok := row[to]; ok {
+			original[from] = value
+		}
+	}
+
+	key, _ := comms.ShardKey(original, rescale.Keys)
+	return key
+}
+
+func (w *Join) migration(clientId int, rescales []comms.Rescale) (migration, error) {
+	mig := migration{files: make(map[int][]persistance.PersistedFile)}
+	add := func(dests []int, prefix string, pf persistance.PersistedFile) {
+		for _, j := range dests {
+			mig.files[j] = append(mig.files[j], persistance.PersistedFile{FileName: prefix + pf.FileName, State: pf.State})
+		}
+	}
+
+	flags := []string{READING_RIGHT_FILENAME}
+	var err error
+	if w.Con.JoinMode == MODE_SYMMETRIC {
+		flags = []string{EOF_LEFT_FILENAME, EOF_RIGHT_FILENAME}
+		err = w.migrateChunks(clientId, rescales, add, &mig)
+	} else {
+		err = w.migrateBuild(clientId, rescales, add, &mig)
+	}
+	if err != nil {
+		return migration{}, err
+	}
+
+	// The replicas added by the rescale get the flags of the phase the client is at
+	rescale := rescales[0]
+	for _, flag := range flags {
+		pf, err := w.rightPersistor.Load(clientId, flag)
+		if err != nil {
+			continue
+		}
+		for j := rescale.From; j < rescale.To; j++ {
+			add([]int{j}, HANDOFF_RIGHT, pf)
+		}
+	}
+
+	return mig, nil
+}
+
+// The rows of each key move along with the sender of their side
+func (w *Join) migrateChunks(clientId int, rescales []comms.Rescale, add func([]int, string, persistance.PersistedFile), mig *migration) error {
+	for side, p := range []persistance.Persistor{w.leftPersistor, w.rightPersistor} {
+		prefix := []string{HANDOFF_LEFT, HANDOFF_RIGHT}[side]
+		files, err := p.RecoverFor(clientId)
+		if err != nil {
+			return err
+		}
+
+		for pf := range files {
+			if !strings.HasPrefix(pf.FileName, ROWS_PREFIX) {
+				continue
+			}
+
+			chunks, err := decodeChunks(pf.State, true)
+			if err != nil {
+				return err
+			}
+
+			key := ""
+			if len(chunks) > 0 && len(chunks[0].rows) > 0 {
+				key = w.senderKey(side+1, chunks[0].rows[0], rescales[side])
+			}
+
+			dests, keeps := workers.Destinations(w.Con.Id, rescales[side], key)
+			add(dests, prefix, pf)
+			if !keeps {
+				mig.dropped[side] = append(mig.dropped[side], pf.FileName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// The left rows of each key move along with their matched mark, and the right rows that
+// arrived before the left side was done move one by one
+func (w *Join) migrateBuild(clientId int, rescales []comms.Rescale, add func([]int, string, persistance.PersistedFile), mig *migration) error {
+	files, err := w.leftPersistor.RecoverFor(clientId)
+	if err != nil {
+		return err
+	}
+
+	for pf := range files {
+		key := ""
+		if lefts, err := w.decode(pf.State); err == nil {
+			for left := range lefts {
+				key = w.senderKey(LEFT, left, rescales[0])
+				break
+			}
+		}
+
+		dests, keeps := workers.Destinations(w.Con.Id, rescales[0], key)
+		add(dests, HANDOFF_LEFT, pf)
+		if !keeps {
+			mig.dropped[0] = append(mig.dropped[0], pf.FileName)
+		}
+
+		matched, err := w.rightPersistor.Load(clientId, MATCHED_PREFIX+pf.FileName)
+		if err != nil {
+			continue
+		}
+		add(dests, HANDOFF_RIGHT, matched)
+		if !keeps {
+			mig.dropped[1] = append(mig.dropped[1], matched.FileName)
+		}
+	}
+
+	if _, ok := w.readingRight[clientId]; ok {
+		return nil
+	}
+
+	pf, err := w.rightPersistor.Load(clientId, OUT_OF_ORDER_FILENAME)
+	if err != nil {
+		return nil
+	}
+
+	rights, err := w.decode(pf.State)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]map[string]string, 0)
+	moved := make(map[int][]map[string]string)
+	for right := range rights {
+		dests, keeps := workers.Destinations(w.Con.Id, rescales[1], w.senderKey(RIGHT, right, rescales[1]))
+		for _, j := range dests {
+			moved[j] = append(moved[j], right)
+		}
+		if keeps {
+			kept = append(kept, right)
+		}
+	}
+
+	if len(moved) == 0 {
+		return nil
+	}
+
+	for j, rows := range moved {
+		add([]int{j}, HANDOFF_RIGHT, persistance.PersistedFile{FileName: OUT_OF_ORDER_FILENAME, State: w.encode(rows)})
+	}
+	mig.kept = kept
+	return nil
+}
+
+func (w *Join) HandOff(clientId int, rescales []comms.Rescale) (map[int][]byte, error) {
+	mig, err := w.migration(clientId, rescales)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[int][]byte, len(mig.files))
+	for j, files := range mig.files {
+		states[j] = persistance.EncodeFiles(files)
+	}
+
+	return states, nil
+}
+
+func (w *Join) Drop(clientId int, rescales []comms.Rescale) error {
+	mig, err := w.migration(clientId, rescales)
+	if err != nil {
+		return err
+	}
+
+	for side, p := range []persistance.Persistor{w.leftPersistor, w.rightPersistor} {
+		for _, fileName := range mig.dropped[side] {
+			if err := p.Remove(clientId, fileName); err != nil {
+				return err
+			}
+		}
+	}
+	delete(w.chunks, clientId)
+
+	if mig.kept == nil {
+		return nil
+	}
+	if len(mig.kept) == 0 {
+		return w.rightPersistor.Remove(clientId, OUT_OF_ORDER_FILENAME)
+	}
+
+	pf, err := w.rightPersistor.Load(clientId, OUT_OF_ORDER_FILENAME)
+	if err != nil {
+		return err
+	}
+
+	id := middleware.DelId{
+		ReplicaId: w.Con.Id,
+		Seq:       -rescales[0].Epoch,
+		ClientId:  clientId,
+		Replayed:  true,
+	}
+	return w.rightPersistor.Store(id, OUT_OF_ORDER_FILENAME, w.encode(mig.kept), pf.Header)
+}
+
+// Rows are appended to the ones of their key, the marks and flags are kept if they're missing
+func (w *Join) TakeOver(id middleware.DelId, state []byte) error {
+	files, err := persistance.DecodeFiles(state)
+	if err != nil {
+		return err
+	}
+
+	clientId := id.ClientId
+	for _, file := range files {
+		p := w.leftPersistor
+		fileName, ok := strings.CutPrefix(file.FileName, HANDOFF_LEFT)
+		if !ok {
+			p = w.rightPersistor
+			fileName = strings.TrimPrefix(file.FileName, HANDOFF_RIGHT)
+		}
+
+		pf, err := p.Load(clientId, fileName)
+		exists := err == nil
+		if exists && pf.Header.IsDup(id) {
+			continue
+		}
+
+		newState := file.State
+		switch {
+		case strings.HasPrefix(fileName, ROWS_PREFIX):
+			newState, err = w.takeOverChunks(clientId, p == w.rightPersistor, fileName, file.State)
+			if err != nil {
+				return err
+			}
+		case p == w.leftPersistor || fileName == OUT_OF_ORDER_FILENAME:
+		default:
+			if exists {
+				continue
+			}
+		}
+
+		if fileName == READING_RIGHT_FILENAME {
+			w.readingRight[clientId] = struct{}{}
+		}
+
+		if !exists {
+			err = p.Store(id, fileName, newState)
+		} else {
+			err = p.Store(id, fileName, append(pf.State, newState...), pf.Header)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The chunks handed over go after the ones of their key, they aren't paired again
+func (w *Join) takeOverChunks(clientId int, right bool, fileName string, state []byte) ([]byte, error) {
+	chunks, err := w.clientChunks(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	k := strings.TrimPrefix(fileName, ROWS_PREFIX)
+	kc, ok := chunks[k]
+	if !ok {
+		kc = &keyChunks{}
+		chunks[k] = kc
+	}
+
+	side := 0
+	if right {
+		side = 1
+	}
+
+	moved, err := decodeChunks(state, true)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := make([]byte, 0, len(state))
+	for _, c := range moved {
+		c.replicaId = MOVED_REPLICA_ID
+		c.order = kc.next
+		kc.next++
+
+		encoded = append(encoded, encodeChunk(c)...)
+		kc.sides[side] = append(kc.sides[side], chunk{replicaId: c.replicaId, seq: c.seq, order: c.order})
+	}
+
+	return encoded, nil
+}
@@ -0,0 +1,260 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/comms/persistance"
+)
+
+// The rows of each key are appended to a file of their own in the persistor of their side,
+// its header tells which deliveries are already in it. Example: "rows-<key>"
+const ROWS_PREFIX = "rows-"
+
+// Marks the EOF of each side, the state tells whether the other side was done by then
+const (
+	EOF_LEFT_FILENAME  = "eof-left"
+	EOF_RIGHT_FILENAME = "eof-right"
+)
+
+// Rows of one side stored by a delivery, `order` is its position among the chunks
+// of both sides of the key so the pairs it made can be told apart. The rows are only
+// read from disk when they're needed
+type chunk struct {
+	replicaId int
+	seq       int
+	order     int
+	rows      []map[string]string
+}
+
+// Index of the chunks of the left and right sides of a key, in the order they arrived
+type keyChunks struct {
+	sides [2][]chunk
+	next  int
+}
+
+// Example: "@<replicaId> <seq> <order> <rows>" followed by a line for every row
+func encodeChunk(c chunk) []byte {
+	buf := bytes.NewBuffer(fmt.Appendf(nil, "@%d %d %d %d\n", c.replicaId, c.seq, c.order, len(c.rows)))
+	buf.Write(comms.NewBatch(c.rows).EncodeForPersistance())
+	return buf.Bytes()
+}
+
+// Returns the chunks appended to a rows file, with their rows only if `withRows` is set
+func decodeChunks(state []byte, withRows bool) ([]chunk, error) {
+	chunks := make([]chunk, 0)
+	lines := bytes.Split(state, []byte("\n"))
+
+	for i := 0; i < len(lines); i++ {
+		if len(lines[i]) == 0 {
+			continue
+		}
+
+		var c chunk
+		var n int
+		if _, err := fmt.Sscanf(string(lines[i]), "@%d %d %d %d", &c.replicaId, &c.seq, &c.order, &n); err != nil {
+			return nil, fmt.Errorf("invalid chunk header %q: %v", lines[i], err)
+		}
+		if i+n >= len(lines) {
+			return nil, fmt.Errorf("the chunk %q is cut short", lines[i])
+		}
+
+		if withRows {
+			c.rows = make([]map[string]string, 0, n)
+			for _, line := range lines[i+1 : i+1+n] {
+				row, err := comms.DecodeLine(line)
+				if err != nil {
+					return nil, err
+				}
+				c.rows = append(c.rows, row)
+			}
+		}
+
+		chunks = append(chunks, c)
+		i += n
+	}
+
+	return chunks, nil
+}
+
+// Returns the index of the chunks of every key of the client, it's read from disk the
+// first time so it survives a crash
+func (w *Join) clientChunks(clientId int) (map[string]*keyChunks, error) {
+	if chunks, ok := w.chunks[clientId]; ok {
+		return chunks, nil
+	}
+
+	chunks := make(map[string]*keyChunks)
+	for side, p := range []persistance.Persistor{w.leftPersistor, w.rightPersistor} {
+		files, err := p.RecoverFor(clientId)
+		if err != nil {
+			return nil, err
+		}
+
+		for pf := range files {
+			k, ok := strings.CutPrefix(pf.FileName, ROWS_PREFIX)
+			if !ok {
+				continue
+			}
+
+			decoded, err := decodeChunks(pf.State, false)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode the chunks of %s: %v", pf.FileName, err)
+			}
+
+			if _, ok := chunks[k]; !ok {
+				chunks[k] = &keyChunks{}
+			}
+			chunks[k].sides[side] = append(chunks[k].sides[side], decoded...)
+			for _, c := range decoded {
+				chunks[k].next = max(chunks[k].next, c.order+1)
+			}
+		}
+	}
+
+	w.chunks[clientId] = chunks
+	return chunks, nil
+}
+
+// Appends the rows of either side to the file of their key and joins them with the ones of
+// the other side that arrived before, so every pair is published once by the last of the
+// two. Only an index of the chunks is kept in memory, the rows of the other side are read
+// from its file. A delivery that's processed again after a crash publishes the same pairs
+// it did the first time
+func handleSymmetric(w *Join, qId int, id middleware.DelId, batch *comms.Batch) error {
+	own, side, other := w.leftPersistor, 0, 1
+	otherPersistor := w.rightPersistor
+	if qId == RIGHT {
+		own, side, other = w.rightPersistor, 1, 0
+		otherPersistor = w.leftPersistor
+	}
+
+	shards := w.shard(qId, batch.FieldMaps)
+
+	clientId := id.ClientId
+	chunks, err := w.clientChunks(clientId)
+	if err != nil {
+		return err
+	}
+
+	responseFieldMaps := make([]map[string]string, 0)
+	for k, rows := range shards {
+		kc, ok := chunks[k]
+		if !ok {
+			kc = &keyChunks{}
+			chunks[k] = kc
+		}
+
+		fileName := ROWS_PREFIX + k
+		i := slices.IndexFunc(kc.sides[side], func(c chunk) bool {
+			return c.replicaId == id.ReplicaId && c.seq == id.Seq
+		})
+
+		var c chunk
+		if i != -1 {
+			c = kc.sides[side][i]
+			c.rows = rows
+		} else {
+			c = chunk{replicaId: id.ReplicaId, seq: id.Seq, order: kc.next, rows: rows}
+
+			pf, err := own.Load(clientId, fileName)
+			if err != nil {
+				err = own.Store(id, fileName, encodeChunk(c))
+			} else if !pf.Header.IsDup(id) {
+				err = own.Store(id, fileName, append(pf.State, encodeChunk(c)...), pf.Header)
+			}
+			if err != nil {
+				return err
+			}
+
+			kc.sides[side] = append(kc.sides[side], chunk{replicaId: c.replicaId, seq: c.seq, order: c.order})
+			kc.next++
+		}
+
+		if !slices.ContainsFunc(kc.sides[other], func(o chunk) bool { return o.order < c.order }) {
+			continue
+		}
+
+		pf, err := otherPersistor.Load(clientId, fileName)
+		if err != nil {
+			return err
+		}
+		otherChunks, err := decodeChunks(pf.State, true)
+		if err != nil {
+			return fmt.Errorf("failed to decode the chunks of %s: %v", fileName, err)
+		}
+
+		for _, otherChunk := range otherChunks {
+			if otherChunk.order > c.order {
+				continue
+			}
+
+			for _, row := range c.rows {
+				for _, otherRow := range otherChunk.rows {
+					left, right := row, otherRow
+					if qId == RIGHT {
+						left, right = right, left
+					}
+
+					joined, err := w.joinFieldMaps(left, right)
+					if err != nil {
+						w.Log.Errorf("failed to join rows for client %d: %v", clientId, err)
+						continue
+					}
+					responseFieldMaps = append(responseFieldMaps, joined)
+				}
+			}
+		}
+	}
+
+	if len(responseFieldMaps) > 0 {
+		batch := comms.NewBatch(responseFieldMaps)
+		if err := w.Mailer.PublishBatch(batch, clientId); err != nil {
+			w.Log.Errorf("failed to publish message: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// The EOF is published once both sides are done
+func (w *Join) symmetricEof(qId int, del middleware.Delivery) {
+	id := del.Id()
+	clientId := id.ClientId
+
+	own, other := EOF_LEFT_FILENAME, EOF_RIGHT_FILENAME
+	if qId == RIGHT {
+		own, other = other, own
+	}
+
+	var otherDone bool
+	pf, err := w.rightPersistor.Load(clientId, own)
+	if err == nil && pf.Header.IsDup(id) {
+		otherDone = strings.TrimSpace(string(pf.State)) == "1"
+	} else {
+		_, err := w.rightPersistor.LoadHeader(clientId, other)
+		otherDone = err == nil
+
+		state := []byte("0")
+		if otherDone {
+			state = []byte("1")
+		}
+		if err := w.rightPersistor.Store(id, own, state); err != nil {
+			w.Log.Errorf("failed to store the eof of client %d: %v", clientId, err)
+			return
+		}
+	}
+
+	if !otherDone {
+		return
+	}
+
+	eof := comms.DecodeEof(del.Body)
+	if err := w.Mailer.PublishEof(eof, clientId); err != nil {
+		w.Log.Errorf("failed to publish message: %v", err)
+	}
+}
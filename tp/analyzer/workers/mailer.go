@@ -11,6 +11,7 @@ import (
 	"sync"
 
 	"analyzer/comms"
+	"analyzer/comms/chaos"
 	"analyzer/comms/middleware"
 	"analyzer/workers/config"
 
@@ -31,21 +32,57 @@ type Mailer struct {
 	senders   []middleware.Sender
 	receivers map[string]*middleware.Receiver
 	inputQs   []middleware.Queue
+
+	// Nil unless the published rows are combined
+	combiner   *Combiner
+	selectCols map[string]struct{}
+
+	// Scale each client is processed with, every delivery carries it along with the
+	// epoch, the amount of rescales it went through. `done` is the last rescale whose
+	// state was taken over by this replica
+	scales map[int]string
+	epochs map[int]int
+	done   map[int]int
+
+	// Rescales in progress by client and epoch, and the barriers of the state that was
+	// handed over but not dropped yet
+	rescales map[int]map[int]*rescaling
+	drops    map[int]map[int][]comms.Rescale
+
+	// Whether the worker's state moves with a rescale
+	migrates bool
 }
 
 func NewMailer(con config.Config, log *logging.Logger) (*Mailer, error) {
-	broker, err := middleware.NewBroker(con.Url)
+	broker, err := middleware.NewBroker(con.Url, con.BrokerBackoff, con.PublishWindow)
 	if err != nil {
 		return nil, err
 	}
 
+	var combiner *Combiner
+	selectCols := con.Select
+	if len(con.CombineKeys) > 0 {
+		combiner = NewCombiner(con.CombineKeys, con.CombineSums, con.CombineWindow)
+		if len(con.Select) > 0 {
+			selectCols = maps.Clone(con.Select)
+			selectCols[comms.ROWS] = struct{}{}
+		}
+	}
+
 	return &Mailer{
-		broker:    broker,
-		con:       con,
-		log:       log,
-		senders:   nil,
-		receivers: nil,
-		inputQs:   nil,
+		broker:     broker,
+		con:        con,
+		log:        log,
+		senders:    nil,
+		receivers:  nil,
+		inputQs:    nil,
+		combiner:   combiner,
+		selectCols: selectCols,
+		scales:     make(map[int]string),
+		epochs:     make(map[int]int),
+		done:       make(map[int]int),
+		rescales:   make(map[int]map[int]*rescaling),
+		drops:      make(map[int]map[int][]comms.Rescale),
 	}, nil
 }
 
@@ -85,7 +122,26 @@ func (m *Mailer) tryRecover(inputQs []middleware.Queue) (map[string]*middleware.
 			}
 			line := strings.TrimSpace(string(lineBytes))
 
-			if strings.HasPrefix(line, "recv") {
+			if strings.HasPrefix(line, "barriers ") {
+				qName, barriers, err := middleware.DecodeLineBarriers(line)
+				if err != nil {
+					m.log.Errorf("failed to decode line for client-%d's barriers: %v", clientId, err)
+					continue
+				}
+				receivers[qName].SetBarriers(clientId, barriers)
+			} else if strings.HasPrefix(line, "barrier ") || strings.HasPrefix(line, "drop ") {
+				if err := m.decodeLineBarrier(clientId, line); err != nil {
+					m.log.Errorf("failed to decode line for client-%d's rescale barriers: %v", clientId, err)
+				}
+			} else if strings.HasPrefix(line, "rescale ") {
+				if err := m.decodeLineRescale(clientId, line); err != nil {
+					m.log.Errorf("failed to decode line for client-%d's rescales: %v", clientId, err)
+				}
+			} else if strings.HasPrefix(line, "scale ") {
+				if err := m.decodeLineScale(clientId, line); err != nil {
+					m.log.Errorf("failed to decode line for client-%d's scale: %v", clientId, err)
+				}
+			} else if strings.HasPrefix(line, "recv") {
 				qName, eofs, flushes, seqs, err := middleware.DecodeLineRecv(line)
 				if err != nil {
 					m.log.Errorf("Failed to decode line for client-%d's receiver: %v", clientId, err)
@@ -108,6 +164,29 @@ func (m *Mailer) tryRecover(inputQs []middleware.Queue) (map[string]*middleware.
 				}
 				senders[sendIdx].(*middleware.SenderShard).SetState(clientId, seqs)
 				sendIdx++
+			} else if strings.HasPrefix(line, "broadcast") {
+				seqs, err := middleware.DecodeLineBroadcast(line)
+				if err != nil {
+					m.log.Errorf("failed to decode line for client-%d's broadcast sender: %v", clientId, err)
+					continue
+				}
+				senders[sendIdx].(*middleware.SenderBroadcast).SetState(clientId, seqs)
+				sendIdx++
+			} else if strings.HasPrefix(line, "combined") && m.combiner != nil {
+				if err := m.combiner.SetCombined(clientId, line); err != nil {
+					m.log.Errorf("failed to decode line for client-%d's combined rows: %v", clientId, err)
+				}
+			} else if strings.HasPrefix(line, "combineheader") && m.combiner != nil {
+				if err := m.combiner.SetHeader(clientId, line); err != nil {
+					m.log.Errorf("failed to decode line for client-%d's combined headers: %v", clientId, err)
+				}
+			} else if strings.HasPrefix(line, "combine") && m.combiner != nil {
+				pending, err := DecodeLineCombine(line)
+				if err != nil {
+					m.log.Errorf("failed to decode line for client-%d's combiner: %v", clientId, err)
+					continue
+				}
+				m.combiner.SetPending(clientId, pending)
 			} else {
 				m.log.Errorf("Unknown line format for client-%d's mailer state: %s", clientId, line)
 				continue
@@ -121,16 +200,28 @@ func (m *Mailer) tryRecover(inputQs []middleware.Queue) (map[string]*middleware.
 
 func (m *Mailer) Init() ([]middleware.Queue, error) {
 	inExchNames := m.con.InputExchangeNames
+	inExchDurables := m.con.InputExchangeDurables
 	inQNames := m.con.InputQueueNames
+	inQTypes := m.con.InputQueueTypes
 	outExchName := m.con.OutputExchangeName
+	outExchDurable := m.con.OutputExchangeDurable
 	outQNames := m.con.OutputQueueNames
+	outQTypes := m.con.OutputQueueTypes
 	outCopies := m.con.OutputCopies
 
-	inputQs, err := m.broker.Init(m.con.Id, inExchNames, inQNames, outExchName, outQNames, outCopies)
+	inputQs, err := m.broker.InitInput(m.con.Id, inExchNames, inExchDurables, inQNames, inQTypes)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := m.broker.InitOutput(outExchName, outExchDurable, outQNames, outQTypes, outCopies); err != nil {
+		return nil, err
+	}
+
+	if err := m.broker.InitDeadLetter(m.con.DeadLetterExchange, m.con.DeadLetterQueue); err != nil {
+		return nil, err
+	}
+
 	m.receivers, m.senders = m.tryRecover(inputQs)
 	return inputQs, nil
 }
@@ -147,10 +238,17 @@ func (m *Mailer) initSenders() []middleware.Sender {
 		var sender middleware.Sender
 		if delTypes[i] == "robin" {
 			sender = middleware.NewRobin(m.broker, qNameFmt, outputQCopies[i])
+		} else if delTypes[i] == "broadcast" {
+			sender = middleware.NewBroadcast(m.broker, qNameFmt, outputQCopies[i])
 		} else {
 			parts := strings.Split(delTypes[i], ":")
 			keys := strings.Split(parts[1], ";")
-			sender = middleware.NewShard(m.broker, qNameFmt, keys, outputQCopies[i], m.log)
+			hot := middleware.HotKeys{
+				Keys:      m.con.HotKeys,
+				Split:     m.con.HotKeySplit,
+				Replicate: m.con.HotKeyMode == "replicate",
+			}
+			sender = middleware.NewShard(m.broker, qNameFmt, keys, outputQCopies[i], hot, m.log)
 		}
 
 		senders = append(senders, sender)
@@ -164,7 +262,8 @@ func (m *Mailer) initReceivers(inputQs []middleware.Queue, inputCopies []int) ma
 	mu := new(sync.Mutex)
 
 	for i := range inputQs {
-		recv := middleware.NewReceiver(m.broker, inputQs[i], inputCopies[i], m, mu)
+		prefetch := m.con.PrefetchPerCopy * inputCopies[i]
+		recv := middleware.NewReceiver(m.broker, inputQs[i], inputCopies[i], prefetch, m.con.ReorderBufferSize, m, mu)
 		receivers[inputQs[i].Name] = recv
 	}
 
@@ -184,6 +283,47 @@ func (m *Mailer) Consume(q middleware.Queue) (<-chan middleware.Delivery, error)
 	return recv.Consume("")
 }
 
+// Keeps the scale the delivery's client is processed with, so it's passed along.
+// Afterwards it only changes with the client's rescale barriers
+func (m *Mailer) Observe(del middleware.Delivery) {
+	clientId := del.Headers.ClientId
+	if _, ok := m.scales[clientId]; ok || len(del.Headers.Scale) == 0 {
+		return
+	}
+
+	m.scales[clientId] = del.Headers.Scale
+	m.epochs[clientId] = del.Headers.Epoch
+}
+
+func (m *Mailer) baseHeaders(kind int, clientId int) middleware.Table {
+	headers := middleware.Table{
+		"kind":       kind,
+		"replica-id": m.con.Id,
+		"client-id":  int32(clientId),
+	}
+
+	if epoch := m.epochs[clientId]; epoch > 0 {
+		headers[middleware.HEADER_EPOCH] = int32(epoch)
+	}
+
+	value, ok := m.scales[clientId]
+	if !ok || len(value) == 0 {
+		return headers
+	}
+	headers[middleware.HEADER_SCALE] = value
+
+	// The receivers downstream wait for the EOFs of as many replicas as this stage has for the client
+	scale, _ := middleware.ParseScale(value)
+	for _, qName := range m.con.InputQueueNames {
+		if copies := scale.Copies(qName, 0); copies > 0 {
+			headers[middleware.HEADER_COPIES] = int32(copies)
+			break
+		}
+	}
+
+	return headers
+}
+
 func mergeHeaders(base middleware.Table, headers []middleware.Table) middleware.Table {
 	for _, h := range headers {
 		maps.Copy(base, h)
@@ -192,16 +332,79 @@ func mergeHeaders(base middleware.Table, headers []middleware.Table) middleware.
 	return base
 }
 
+// Computes the SELECT columns in order, so each of them can use the ones before it
+func (m *Mailer) project(fieldMaps []map[string]string) []map[string]string {
+	if len(m.con.SelectColumns) == 0 {
+		return fieldMaps
+	}
+
+	projected := make([]map[string]string, 0, len(fieldMaps))
+	for _, fieldMap := range fieldMaps {
+		row := maps.Clone(fieldMap)
+		ok := true
+		for _, c := range m.con.SelectColumns {
+			value, err := c.Expr.Value(row)
+			if err != nil {
+				m.log.Errorf("failed to compute %v: %v", c.Name, err)
+				ok = false
+				break
+			}
+			row[c.Name] = value
+		}
+		if ok {
+			projected = append(projected, row)
+		}
+	}
+
+	return projected
+}
+
 func (m *Mailer) PublishBatch(batch comms.Batch, clientId int, headers ...middleware.Table) error {
-	baseHeaders := middleware.Table{
-		"kind":       comms.BATCH,
-		"replica-id": m.con.Id,
-		"client-id":  int32(clientId),
+	fieldMaps := m.project(batch.FieldMaps)
+	if len(fieldMaps) == 0 && len(batch.FieldMaps) > 0 {
+		return nil
+	}
+	batch = comms.NewBatch(fieldMaps)
+
+	if m.combiner == nil {
+		return m.publishBatch(batch, clientId, headers)
+	}
+
+	// Rows published with other headers can't be combined with these ones
+	merged := mergeHeaders(middleware.Table{}, headers)
+	if m.combiner.Differs(clientId, merged) {
+		if err := m.publishCombined(clientId); err != nil {
+			return err
+		}
 	}
+
+	done, errs := m.combiner.Add(clientId, batch.FieldMaps, merged)
+	for _, err := range errs {
+		m.log.Errorf("failed to combine row: %v", err)
+	}
+	if !done {
+		return nil
+	}
+
+	return m.publishCombined(clientId)
+}
+
+// Publishes the rows combined so far for the client, if any, with the headers they were published with
+func (m *Mailer) publishCombined(clientId int) error {
+	fieldMaps, headers := m.combiner.Take(clientId)
+	if len(fieldMaps) == 0 {
+		return nil
+	}
+
+	return m.publishBatch(comms.NewBatch(fieldMaps), clientId, []middleware.Table{headers})
+}
+
+func (m *Mailer) publishBatch(batch comms.Batch, clientId int, headers []middleware.Table) error {
+	baseHeaders := m.baseHeaders(comms.BATCH, clientId)
 	merged := mergeHeaders(baseHeaders, headers)
 
 	for _, sender := range m.senders {
-		if err := sender.Batch(batch, m.con.Select, merged); err != nil {
+		if err := sender.Batch(batch, m.selectCols, merged); err != nil {
 			return err
 		}
 	}
@@ -210,11 +413,14 @@ func (m *Mailer) PublishBatch(batch comms.Batch, clientId int, headers ...middle
 }
 
 func (m *Mailer) PublishEof(eof comms.Eof, clientId int, headers ...middleware.Table) error {
-	baseHeaders := middleware.Table{
-		"kind":       comms.EOF,
-		"replica-id": m.con.Id,
-		"client-id":  int32(clientId),
+	// The last window is published before the EOF
+	if m.combiner != nil {
+		if err := m.publishCombined(clientId); err != nil {
+			return err
+		}
 	}
+
+	baseHeaders := m.baseHeaders(comms.EOF, clientId)
 	merged := mergeHeaders(baseHeaders, headers)
 
 	for _, sender := range m.senders {
@@ -227,11 +433,7 @@ func (m *Mailer) PublishEof(eof comms.Eof, clientId int, headers ...middleware.T
 }
 
 func (m *Mailer) PublishFlush(flush comms.Flush, clientId int, headers ...middleware.Table) error {
-	baseHeaders := middleware.Table{
-		"kind":       comms.FLUSH,
-		"replica-id": m.con.Id,
-		"client-id":  int32(clientId),
-	}
+	baseHeaders := m.baseHeaders(comms.FLUSH, clientId)
 	merged := mergeHeaders(baseHeaders, headers)
 
 	for _, sender := range m.senders {
@@ -260,6 +462,47 @@ func (m *Mailer) PublishPurge(purge comms.Purge, headers ...middleware.Table) er
 	return nil
 }
 
+// Parks a delivery of the `qId`th input queue that couldn't be processed in the
+// dead letter queue, along with where it came from and why it failed
+func (m *Mailer) PublishDeadLetter(qId int, del middleware.Delivery, reason error) error {
+	headers := del.Table()
+	headers[middleware.HEADER_FAILURES] = int32(del.Headers.Failures + 1)
+	headers[middleware.HEADER_DL_QUEUE] = m.inputQs[qId-1].Name
+	headers[middleware.HEADER_DL_EXCHANGE] = m.con.InputExchangeNames[qId-1]
+	headers[middleware.HEADER_DL_ERROR] = reason.Error()
+
+	return m.broker.DeadLetter(del.Body, headers)
+}
+
+// Waits till every message published so far is confirmed, must be called before
+// persisting the state that accounts for them
+func (m *Mailer) Confirm() error {
+	return m.broker.Confirm()
+}
+
+// Returns the amount of deliveries waiting in the input queues
+func (m *Mailer) Lag() (int, error) {
+	lag := 0
+	for _, q := range m.inputQs {
+		n, err := m.broker.QueueLength(q)
+		if err != nil {
+			return 0, err
+		}
+		lag += n
+	}
+
+	return lag, nil
+}
+
+// Returns the amount of out of order deliveries the receivers hold
+func (m *Mailer) Held() int {
+	held := 0
+	for _, receiver := range m.receivers {
+		held += receiver.Held()
+	}
+	return held
+}
+
 func (m *Mailer) Dump(clientId int) error {
 	buf := bytes.NewBuffer(nil)
 
@@ -277,17 +520,56 @@ func (m *Mailer) Dump(clientId int) error {
 		buf.WriteByte('\n')
 	}
 
-	// 3. Atomic write
+	// 3. Write the rows combined so far
+	if m.combiner != nil {
+		buf.Write(m.combiner.Encode(clientId))
+		buf.WriteByte('\n')
+	}
+
+	// 4. Write the scale and the rescales in progress
+	for _, receiver := range m.receivers {
+		if encoded := receiver.EncodeBarriers(clientId); encoded != nil {
+			buf.Write(encoded)
+			buf.WriteByte('\n')
+		}
+	}
+	buf.Write(m.encodeRescales(clientId))
+
+	// 5. Atomic write
+	chaos.Point(chaos.POINT_MAILER_DUMP)
 	dirPath := fmt.Sprintf("/%s/%d", PERSISTANCE_DIRNAME, clientId)
-	return comms.AtomicWrite(dirPath, PERSISTANCE_FILENAME, buf.Bytes())
+	if err := comms.AtomicWrite(dirPath, PERSISTANCE_FILENAME, buf.Bytes()); err != nil {
+		return err
+	}
+
+	m.cleanParked(clientId)
+	return nil
 }
 
 func (m *Mailer) Flush(clientId int) error {
+	if m.combiner != nil {
+		m.combiner.Flush(clientId)
+	}
+	delete(m.scales, clientId)
+	delete(m.epochs, clientId)
+	delete(m.done, clientId)
+	delete(m.rescales, clientId)
+	delete(m.drops, clientId)
+
 	dirPath := fmt.Sprintf("/%s/%d", PERSISTANCE_DIRNAME, clientId)
 	return os.RemoveAll(dirPath)
 }
 
 func (m *Mailer) Purge() error {
+	if m.combiner != nil {
+		m.combiner.Purge()
+	}
+	m.scales = make(map[int]string)
+	m.epochs = make(map[int]int)
+	m.done = make(map[int]int)
+	m.rescales = make(map[int]map[int]*rescaling)
+	m.drops = make(map[int]map[int][]comms.Rescale)
+
 	for _, q := range m.inputQs {
 		if err := m.broker.Purge(q); err != nil {
 			return fmt.Errorf("failed to purge queue %s: %v", q.Name, err)
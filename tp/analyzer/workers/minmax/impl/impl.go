@@ -155,7 +155,8 @@ func (w *MinMax) Batch(qId int, del middleware.Delivery) {
 
 	batch, err := comms.DecodeBatch(body)
 	if err != nil {
-		w.Log.Fatal("failed to decode batch: %v", err)
+		w.DeadLetter(qId, del, err)
+		return
 	}
 
 	// Check for duplicated deliveries
@@ -179,15 +180,19 @@ func (w *MinMax) Batch(qId int, del middleware.Delivery) {
 
 func (w *MinMax) Eof(qId int, del middleware.Delivery) {
 	clientId := del.Headers.ClientId
-	responseFieldMaps := []map[string]string{
-		w.mins[clientId].fieldMap,
-		w.maxs[clientId].fieldMap,
-	}
 
-	w.Log.Debugf("fieldMaps: %v", responseFieldMaps)
-	batch := comms.NewBatch(responseFieldMaps)
-	if err := w.Mailer.PublishBatch(batch, clientId); err != nil {
-		w.Log.Errorf("failed to publish message: %v", err)
+	// A partial minmax might not have gotten any rows
+	if _, ok := w.mins[clientId]; ok {
+		responseFieldMaps := []map[string]string{
+			w.mins[clientId].fieldMap,
+			w.maxs[clientId].fieldMap,
+		}
+
+		w.Log.Debugf("fieldMaps: %v", responseFieldMaps)
+		batch := comms.NewBatch(responseFieldMaps)
+		if err := w.Mailer.PublishBatch(batch, clientId); err != nil {
+			w.Log.Errorf("failed to publish message: %v", err)
+		}
 	}
 
 	body := del.Body
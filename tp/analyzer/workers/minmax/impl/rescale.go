@@ -0,0 +1,46 @@
+package impl
+
+import (
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/workers"
+)
+
+// The partial minimum and maximum of a replica that's removed are merged into one of the remaining ones
+func (w *MinMax) HandOff(clientId int, rescales []comms.Rescale) (map[int][]byte, error) {
+	dests, _ := workers.Destinations(w.Con.Id, rescales[0], "")
+	if w.mins[clientId].fieldMap == nil {
+		return nil, nil
+	}
+
+	states := make(map[int][]byte, len(dests))
+	for _, j := range dests {
+		states[j] = w.Encode(clientId)
+	}
+
+	return states, nil
+}
+
+func (w *MinMax) Drop(clientId int, rescales []comms.Rescale) error {
+	if _, keeps := workers.Destinations(w.Con.Id, rescales[0], ""); keeps {
+		return nil
+	}
+
+	delete(w.mins, clientId)
+	delete(w.maxs, clientId)
+	return w.persistor.Flush(clientId)
+}
+
+func (w *MinMax) TakeOver(id middleware.DelId, state []byte) error {
+	clientId := id.ClientId
+	header, err := w.persistor.LoadHeader(clientId, STATE_FILENAME)
+	if (err == nil && header.IsDup(id)) || len(state) == 0 {
+		return nil
+	}
+
+	if err := w.Decode(clientId, state); err != nil {
+		return err
+	}
+
+	return w.persistor.Store(id, STATE_FILENAME, w.Encode(clientId), header)
+}
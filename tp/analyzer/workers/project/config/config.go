@@ -0,0 +1,80 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/workers/config"
+)
+
+// An output column and the expression that computes it
+type Column struct {
+	Name string
+	Expr string
+}
+
+type ProjectConfig struct {
+	config.Config
+	Columns []Column
+	Keep    bool
+	Drop    []string
+	Where   string
+	Explode string
+}
+
+func Create() (*ProjectConfig, error) {
+	con, err := config.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	// PROJECT
+	// Example: "*;rate_revenue_budget=format(revenue / budget, 4);actor=cast"
+	projectVar := os.Getenv("PROJECT")
+	if len(projectVar) == 0 {
+		return nil, fmt.Errorf("no projection was provided")
+	}
+
+	columns := make([]Column, 0)
+	keep := false
+	for item := range strings.SplitSeq(projectVar, ";") {
+		item = strings.TrimSpace(item)
+		if item == "*" {
+			keep = true
+			continue
+		}
+
+		name, expr, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			expr = name
+		}
+
+		if !comms.IsColumn(name) {
+			return nil, fmt.Errorf("the projected column %v is not a column of the protocol", name)
+		}
+		if len(strings.TrimSpace(expr)) == 0 {
+			return nil, fmt.Errorf("no expression was provided for the column %v", name)
+		}
+		columns = append(columns, Column{name, expr})
+	}
+
+	// DROP
+	var drop []string
+	if dropVar := os.Getenv("DROP"); len(dropVar) > 0 {
+		drop = strings.Split(dropVar, ",")
+	}
+
+	// WHERE
+	where := os.Getenv("WHERE")
+
+	// EXPLODE
+	explode := os.Getenv("EXPLODE")
+	if len(explode) > 0 && !comms.IsColumn(explode) {
+		return nil, fmt.Errorf("the exploded column %v is not a column of the protocol", explode)
+	}
+
+	return &ProjectConfig{con, columns, keep, drop, where, explode}, nil
+}
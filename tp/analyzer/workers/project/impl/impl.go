@@ -0,0 +1,165 @@
+package impl
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+	"analyzer/workers"
+	"analyzer/workers/expr"
+	"analyzer/workers/project/config"
+
+	"github.com/op/go-logging"
+)
+
+type column struct {
+	name string
+	expr *expr.Expr
+}
+
+type Project struct {
+	*workers.Worker
+	Con *config.ProjectConfig
+
+	// Compiled once at startup
+	columns []column
+	where   *expr.Expr
+}
+
+func New(con *config.ProjectConfig, log *logging.Logger) (*Project, error) {
+	base, err := workers.New(con.Config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]column, 0, len(con.Columns))
+	for _, c := range con.Columns {
+		e, err := expr.Compile(c.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("the expression of %v is invalid: %v", c.Name, err)
+		}
+		columns = append(columns, column{c.Name, e})
+	}
+
+	var where *expr.Expr
+	if len(con.Where) > 0 {
+		if where, err = expr.Compile(con.Where); err != nil {
+			return nil, fmt.Errorf("the where expression is invalid: %v", err)
+		}
+	}
+
+	return &Project{base, con, columns, where}, nil
+}
+
+func (w *Project) Run() error {
+	return w.Worker.Run(w)
+}
+
+// Computes the columns in order, so each of them can use the ones before it
+func (w *Project) handleProject(fieldMap map[string]string) ([]map[string]string, error) {
+	if w.where != nil {
+		ok, err := w.where.Eval(fieldMap)
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	scope := maps.Clone(fieldMap)
+	projected := make(map[string]string, len(w.columns))
+	if w.Con.Keep {
+		projected = maps.Clone(fieldMap)
+	}
+
+	for _, c := range w.columns {
+		value, err := c.expr.Value(scope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute %v: %v", c.name, err)
+		}
+		projected[c.name] = value
+		scope[c.name] = value
+	}
+
+	for _, drop := range w.Con.Drop {
+		delete(projected, drop)
+	}
+
+	if len(w.Con.Explode) == 0 {
+		return []map[string]string{projected}, nil
+	}
+
+	values, ok := projected[w.Con.Explode]
+	if !ok {
+		return nil, fmt.Errorf("%v is not a field in the message", w.Con.Explode)
+	}
+
+	exploded := make([]map[string]string, 0)
+	for value := range strings.SplitSeq(values, ",") {
+		expCopy := maps.Clone(projected)
+		expCopy[w.Con.Explode] = value
+		exploded = append(exploded, expCopy)
+	}
+
+	return exploded, nil
+}
+
+func (w *Project) Batch(qId int, del middleware.Delivery) {
+	clientId := del.Headers.ClientId
+	body := del.Body
+	batch, err := comms.DecodeBatch(body)
+	if err != nil {
+		w.DeadLetter(qId, del, err)
+		return
+	}
+	responseFieldMaps := make([]map[string]string, 0, len(batch.FieldMaps))
+
+	for _, fieldMap := range batch.FieldMaps {
+		responseFieldMapSlice, err := w.handleProject(fieldMap)
+		if err != nil {
+			w.Log.Errorf("failed to handle message: %v", err)
+			continue
+		}
+
+		responseFieldMaps = append(responseFieldMaps, responseFieldMapSlice...)
+	}
+
+	if len(responseFieldMaps) > 0 {
+		w.Log.Debugf("fieldMaps: %v", responseFieldMaps)
+		batch := comms.NewBatch(responseFieldMaps)
+		if err := w.Mailer.PublishBatch(batch, clientId); err != nil {
+			w.Log.Errorf("failed to publish message: %v", err)
+		}
+	}
+}
+
+func (w *Project) Eof(qId int, del middleware.Delivery) {
+	clientId := del.Headers.ClientId
+	data := del.Body
+	eof := comms.DecodeEof(data)
+	if err := w.Mailer.PublishEof(eof, clientId); err != nil {
+		w.Log.Errorf("failed to publish message: %v", err)
+	}
+}
+
+func (w *Project) Flush(qId int, del middleware.Delivery) {
+	clientId := del.Headers.ClientId
+	data := del.Body
+	flush := comms.DecodeFlush(data)
+	if err := w.Mailer.PublishFlush(flush, clientId); err != nil {
+		w.Log.Errorf("failed to publish message: %v", err)
+	}
+}
+
+func (w *Project) Purge(qId int, del middleware.Delivery) {
+	body := del.Body
+
+	purge := comms.DecodePurge(body)
+	if err := w.Mailer.PublishPurge(purge); err != nil {
+		w.Log.Errorf("failed to publish message: %v", err)
+	}
+}
+
+func (w *Project) Close() {
+	w.Worker.Close()
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"analyzer/workers/explode/config"
-	impl "analyzer/workers/explode/impl"
+	"analyzer/workers/project/config"
+	impl "analyzer/workers/project/impl"
 
 	"github.com/op/go-logging"
 )
@@ -0,0 +1,628 @@
+package workers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"analyzer/comms"
+	"analyzer/comms/middleware"
+)
+
+// Deliveries put aside until a rescale is done, laid out as "/mailer/<clientId>/parked/<epoch>-<n>"
+const PARKED_DIRNAME = "parked"
+
+// Workers whose state is split among the replicas of their stage move it when the stage
+// is rescaled in the middle of a client, see the README
+type Migrator interface {
+	// Returns the state each of the new replicas takes over from this one, by replica.
+	// There's a barrier for every input queue, in order
+	HandOff(clientId int, rescales []comms.Rescale) (map[int][]byte, error)
+
+	// Removes the state that was handed over, it's called once the handoffs are persisted
+	// and may be called again after a crash
+	Drop(clientId int, rescales []comms.Rescale) error
+
+	// Takes over the state handed by another replica, `id` tells each handoff apart
+	TakeOver(id middleware.DelId, state []byte) error
+}
+
+// Rescale of a client in progress, it's done once its barriers arrived through every input
+// and the state moved to this replica was taken over. The deliveries parked meanwhile are
+// handled afterwards, one at a time
+type rescaling struct {
+	barriers map[int]comms.Rescale
+	handoffs map[int]struct{}
+	parked   int
+	replayed int
+}
+
+// A parked delivery along with the input it came from
+type parkedDelivery struct {
+	qId int
+	del middleware.Delivery
+}
+
+func (m *Mailer) rescaling(clientId int, epoch int) *rescaling {
+	if _, ok := m.rescales[clientId]; !ok {
+		m.rescales[clientId] = make(map[int]*rescaling)
+	}
+
+	r, ok := m.rescales[clientId][epoch]
+	if !ok {
+		r = &rescaling{
+			barriers: make(map[int]comms.Rescale),
+			handoffs: make(map[int]struct{}),
+		}
+		m.rescales[clientId][epoch] = r
+	}
+
+	return r
+}
+
+// Returns the epoch of the oldest rescale of the client whose parked deliveries are being handled
+func (m *Mailer) replaying(clientId int) (int, bool) {
+	for _, epoch := range slices.Sorted(maps.Keys(m.rescales[clientId])) {
+		if epoch <= m.done[clientId] {
+			return epoch, true
+		}
+	}
+	return 0, false
+}
+
+// A replica that wasn't part of the stage before the rescale starts with it
+func (m *Mailer) Join(clientId int, rescale comms.Rescale) {
+	if m.con.Id >= rescale.From {
+		m.done[clientId] = max(m.done[clientId], rescale.Epoch-1)
+	}
+}
+
+// Returns whether the delivery has to wait for a rescale that isn't done, it goes after the
+// ones that are already waiting. Deliveries sent after a barrier wait for its rescale, and
+// barriers for the one before theirs
+func (m *Mailer) Parks(del middleware.Delivery) bool {
+	clientId := del.Headers.ClientId
+	done := m.done[clientId]
+
+	switch del.Headers.Kind {
+	case comms.BATCH, comms.EOF:
+		if _, ok := m.replaying(clientId); ok {
+			return true
+		}
+		return del.Headers.Epoch > done
+	case comms.RESCALE:
+		if _, ok := m.replaying(clientId); ok {
+			return true
+		}
+		return del.Headers.Epoch > done+1
+	}
+
+	return false
+}
+
+// Returns whether a parked delivery has to wait again, for a later rescale
+func (m *Mailer) parksAgain(del middleware.Delivery) bool {
+	done := m.done[del.Headers.ClientId]
+
+	switch del.Headers.Kind {
+	case comms.BATCH, comms.EOF:
+		return del.Headers.Epoch > done
+	case comms.RESCALE:
+		return del.Headers.Epoch > done+1
+	}
+
+	return false
+}
+
+func (m *Mailer) parkedDir(clientId int) string {
+	return fmt.Sprintf("/%s/%d/%s", PERSISTANCE_DIRNAME, clientId, PARKED_DIRNAME)
+}
+
+// Writes the delivery to disk, it's handled once the rescale it waits for is done.
+// Example: "<qId> <kind> <replicaId> <seq> <query> <copies> <epoch> <failures> <replayed> <scale>\n<body>"
+func (m *Mailer) Park(qId int, del middleware.Delivery, again bool) error {
+	clientId := del.Headers.ClientId
+	epoch, ok := m.replaying(clientId)
+	if again || !ok {
+		epoch = del.Headers.Epoch
+		if del.Headers.Kind == comms.RESCALE {
+			epoch--
+		}
+	}
+	r := m.rescaling(clientId, epoch)
+
+	h := del.Headers
+	scale := "-"
+	if len(h.Scale) > 0 {
+		scale = h.Scale
+	}
+
+	data := fmt.Appendf(nil, "%d %d %d %d %d %d %d %d %d %s\n", qId, h.Kind, h.ReplicaId, h.Seq, h.Query, h.Copies, h.Epoch, h.Failures, boolToInt(h.Replayed), scale)
+	data = append(data, del.Body...)
+
+	if err := comms.AtomicWrite(m.parkedDir(clientId), fmt.Sprintf("%d-%d", epoch, r.parked), data); err != nil {
+		return err
+	}
+
+	r.parked++
+	return nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Returns the next parked delivery of a rescale that's done, if any client has one
+func (m *Mailer) NextParked() (parkedDelivery, bool, error) {
+	for _, clientId := range slices.Sorted(maps.Keys(m.rescales)) {
+		epoch, ok := m.replaying(clientId)
+		if !ok {
+			continue
+		}
+
+		r := m.rescales[clientId][epoch]
+		if r.replayed == r.parked {
+			m.finish(clientId, epoch)
+			continue
+		}
+
+		path := fmt.Sprintf("%s/%d-%d", m.parkedDir(clientId), epoch, r.replayed)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return parkedDelivery{}, false, fmt.Errorf("failed to read parked delivery %s: %v", path, err)
+		}
+
+		parked, err := decodeParked(clientId, data)
+		if err != nil {
+			return parkedDelivery{}, false, fmt.Errorf("failed to decode parked delivery %s: %v", path, err)
+		}
+
+		return parked, true, nil
+	}
+
+	return parkedDelivery{}, false, nil
+}
+
+func decodeParked(clientId int, data []byte) (parkedDelivery, error) {
+	header, body, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return parkedDelivery{}, fmt.Errorf("it has no header")
+	}
+
+	var qId, replayed int
+	var scale string
+	h := middleware.Headers{ClientId: clientId}
+	_, err := fmt.Sscanf(string(header), "%d %d %d %d %d %d %d %d %d %s", &qId, &h.Kind, &h.ReplicaId, &h.Seq, &h.Query, &h.Copies, &h.Epoch, &h.Failures, &replayed, &scale)
+	if err != nil {
+		return parkedDelivery{}, fmt.Errorf("invalid header %q: %v", header, err)
+	}
+
+	h.Replayed = replayed == 1
+	if scale != "-" {
+		h.Scale = scale
+	}
+
+	return parkedDelivery{qId, middleware.Delivery{Headers: h, Body: body}}, nil
+}
+
+// Moves past the parked delivery that was just handled
+func (m *Mailer) Replayed(clientId int) {
+	epoch, ok := m.replaying(clientId)
+	if !ok {
+		return
+	}
+
+	r := m.rescales[clientId][epoch]
+	r.replayed++
+	if r.replayed == r.parked {
+		m.finish(clientId, epoch)
+	}
+}
+
+// The files of the rescale are removed with the next dump
+func (m *Mailer) finish(clientId int, epoch int) {
+	delete(m.rescales[clientId], epoch)
+	if len(m.rescales[clientId]) == 0 {
+		delete(m.rescales, clientId)
+	}
+}
+
+// Keeps the barrier that came through the `qId`th input, returns the barriers of every
+// input in order once all of them arrived
+func (m *Mailer) Align(clientId int, qId int, rescale comms.Rescale) ([]comms.Rescale, bool) {
+	r := m.rescaling(clientId, rescale.Epoch)
+	r.barriers[qId] = rescale
+	if len(r.barriers) < len(m.inputQs) {
+		return nil, false
+	}
+
+	barriers := make([]comms.Rescale, 0, len(r.barriers))
+	for _, qId := range slices.Sorted(maps.Keys(r.barriers)) {
+		barriers = append(barriers, r.barriers[qId])
+	}
+
+	return barriers, true
+}
+
+// Keeps the handoff of the replica, returns false if it was already taken over
+func (m *Mailer) HandedOver(clientId int, epoch int, replicaId int) bool {
+	if epoch <= m.done[clientId] {
+		return false
+	}
+
+	r := m.rescaling(clientId, epoch)
+	if _, ok := r.handoffs[replicaId]; ok {
+		return false
+	}
+
+	r.handoffs[replicaId] = struct{}{}
+	return true
+}
+
+// Returns whether the replica takes over state from the other ones in the rescale
+func (m *Mailer) takesOver(rescale comms.Rescale) bool {
+	return m.migrates && rescale.From != rescale.To && m.con.Id < rescale.To
+}
+
+// Returns whether the replica hands its state over to the other ones in the rescale
+func (m *Mailer) handsOver(rescale comms.Rescale) bool {
+	return m.migrates && rescale.From != rescale.To && m.con.Id < rescale.From
+}
+
+// Marks the client's next rescale as done if its barriers and handoffs arrived, the
+// deliveries that were parked waiting for it are handled next
+func (m *Mailer) Complete(clientId int) bool {
+	epoch := m.done[clientId] + 1
+	r, ok := m.rescales[clientId][epoch]
+	if !ok || len(r.barriers) < len(m.inputQs) {
+		return false
+	}
+
+	if rescale := r.barriers[1]; m.takesOver(rescale) {
+		for replicaId := range rescale.From {
+			if _, ok := r.handoffs[replicaId]; !ok && replicaId != m.con.Id {
+				return false
+			}
+		}
+	}
+
+	m.done[clientId] = epoch
+	if r.parked == 0 {
+		m.finish(clientId, epoch)
+	}
+	return true
+}
+
+// Forwards the barrier once it arrived through every input. What was combined so far goes
+// before it, as it's routed with the old scale, and what's published afterwards with the new one
+func (m *Mailer) PublishRescale(clientId int, rescale comms.Rescale) error {
+	if m.combiner != nil {
+		if err := m.publishCombined(clientId); err != nil {
+			return err
+		}
+	}
+
+	m.scales[clientId] = rescale.New
+	m.epochs[clientId] = rescale.Epoch
+
+	// Both the old and the new replicas of this stage forward it
+	headers := m.baseHeaders(comms.RESCALE, clientId)
+	headers[middleware.HEADER_COPIES] = int32(max(rescale.From, rescale.To))
+
+	for _, sender := range m.senders {
+		if err := sender.Rescale(rescale, headers); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sends the state handed over to another replica of this stage, straight to its first input queue
+func (m *Mailer) PublishHandoff(clientId int, replicaId int, handoff comms.Handoff) error {
+	headers := m.baseHeaders(comms.HANDOFF, clientId)
+	headers["seq"] = int32(handoff.Epoch)
+
+	qName := fmt.Sprintf("%s-%d", m.con.InputQueueNames[0], replicaId)
+	return m.broker.PublishPeer(m.con.InputExchangeNames[0], qName, m.con.InputQueueTypes[0], handoff.Encode(), headers)
+}
+
+// Keeps the barriers whose handed over state is still to be dropped
+func (m *Mailer) toDrop(clientId int, rescales []comms.Rescale) {
+	if _, ok := m.drops[clientId]; !ok {
+		m.drops[clientId] = make(map[int][]comms.Rescale)
+	}
+	m.drops[clientId][rescales[0].Epoch] = rescales
+}
+
+// Example: "scale <epoch> <done> <scale>" along with "rescale <epoch> <parked> <replayed> <replicaId> ..."
+// for each rescale in progress, with the replicas whose handoff was taken over, and "barrier <epoch>
+// <qId> <hex>" for each barrier that arrived. "drop <epoch> <qId> <hex>" are the barriers of the
+// handed over state that's still to be dropped
+func (m *Mailer) encodeRescales(clientId int) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	scale, ok := m.scales[clientId]
+	if ok || m.done[clientId] > 0 {
+		if len(scale) == 0 {
+			scale = "-"
+		}
+		fmt.Fprintf(buf, "scale %d %d %s\n", m.epochs[clientId], m.done[clientId], scale)
+	}
+
+	for _, epoch := range slices.Sorted(maps.Keys(m.rescales[clientId])) {
+		r := m.rescales[clientId][epoch]
+		fmt.Fprintf(buf, "rescale %d %d %d", epoch, r.parked, r.replayed)
+		for _, replicaId := range slices.Sorted(maps.Keys(r.handoffs)) {
+			fmt.Fprintf(buf, " %d", replicaId)
+		}
+		buf.WriteByte('\n')
+
+		for _, qId := range slices.Sorted(maps.Keys(r.barriers)) {
+			fmt.Fprintf(buf, "barrier %d %d %s\n", epoch, qId, hex.EncodeToString(r.barriers[qId].Encode()))
+		}
+	}
+
+	for _, epoch := range slices.Sorted(maps.Keys(m.drops[clientId])) {
+		for qId, rescale := range m.drops[clientId][epoch] {
+			fmt.Fprintf(buf, "drop %d %d %s\n", epoch, qId+1, hex.EncodeToString(rescale.Encode()))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Example: "scale <epoch> <done> <scale>"
+func (m *Mailer) decodeLineScale(clientId int, line string) error {
+	parts := strings.Split(strings.TrimPrefix(line, "scale "), " ")
+	if len(parts) != 3 {
+		return fmt.Errorf("the amount of parts is not enough: %s", line)
+	}
+
+	epoch, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("epoch is not a number: %s", line)
+	}
+
+	done, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("done epoch is not a number: %s", line)
+	}
+
+	if parts[2] != "-" {
+		m.scales[clientId] = parts[2]
+	}
+	m.epochs[clientId] = epoch
+	m.done[clientId] = done
+	return nil
+}
+
+// Example: "rescale <epoch> <parked> <replayed> <replicaId> ... <replicaId>"
+func (m *Mailer) decodeLineRescale(clientId int, line string) error {
+	parts := strings.Split(strings.TrimPrefix(line, "rescale "), " ")
+	if len(parts) < 3 {
+		return fmt.Errorf("the amount of parts is not enough: %s", line)
+	}
+
+	nums := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return fmt.Errorf("%s is not a number: %s", part, line)
+		}
+		nums = append(nums, n)
+	}
+
+	r := m.rescaling(clientId, nums[0])
+	r.parked, r.replayed = nums[1], nums[2]
+	for _, replicaId := range nums[3:] {
+		r.handoffs[replicaId] = struct{}{}
+	}
+
+	return nil
+}
+
+// Example: "<barrier|drop> <epoch> <qId> <hex>"
+func (m *Mailer) decodeLineBarrier(clientId int, line string) error {
+	parts := strings.Split(line, " ")
+	if len(parts) != 4 {
+		return fmt.Errorf("the amount of parts is not enough: %s", line)
+	}
+
+	epoch, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("epoch is not a number: %s", line)
+	}
+
+	qId, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return fmt.Errorf("qId is not a number: %s", line)
+	}
+
+	data, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return fmt.Errorf("the barrier is not hex encoded: %s", line)
+	}
+
+	rescale, err := comms.DecodeRescale(data)
+	if err != nil {
+		return err
+	}
+
+	if parts[0] == "barrier" {
+		m.rescaling(clientId, epoch).barriers[qId] = rescale
+		return nil
+	}
+
+	if _, ok := m.drops[clientId]; !ok {
+		m.drops[clientId] = make(map[int][]comms.Rescale)
+	}
+	drops := m.drops[clientId][epoch]
+	for len(drops) < qId {
+		drops = append(drops, comms.Rescale{})
+	}
+	drops[qId-1] = rescale
+	m.drops[clientId][epoch] = drops
+	return nil
+}
+
+// Removes the parked deliveries of the rescales that are over
+func (m *Mailer) cleanParked(clientId int) {
+	files, err := os.ReadDir(m.parkedDir(clientId))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		epochStr, _, _ := strings.Cut(file.Name(), "-")
+		epoch, err := strconv.Atoi(epochStr)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := m.rescales[clientId][epoch]; !ok {
+			os.Remove(fmt.Sprintf("%s/%s", m.parkedDir(clientId), file.Name()))
+		}
+	}
+}
+
+// Handles a barrier, once it arrived through every input the state that changes owner
+// is handed over and it's forwarded
+func (base *Worker) rescale(w IWorker, qId int, del middleware.Delivery) {
+	clientId := del.Headers.ClientId
+	rescale, err := comms.DecodeRescale(del.Body)
+	if err != nil {
+		base.DeadLetter(qId, del, err)
+		return
+	}
+
+	rescales, aligned := base.Mailer.Align(clientId, qId, rescale)
+	if !aligned {
+		return
+	}
+	base.Log.Infof("[%d] rescaled from %d to %d replicas (epoch %d)", clientId, rescale.From, rescale.To, rescale.Epoch)
+
+	if migrator, ok := w.(Migrator); ok && base.Mailer.handsOver(rescale) {
+		states, err := migrator.HandOff(clientId, rescales)
+		if err != nil {
+			base.requeueErr = fmt.Errorf("failed to hand over the state of client %d: %v", clientId, err)
+			return
+		}
+
+		// Every new replica waits for a handoff of each old one, even if it's empty
+		for replicaId := range rescale.To {
+			if replicaId == base.con.Id {
+				continue
+			}
+
+			handoff := comms.Handoff{Epoch: rescale.Epoch, State: states[replicaId]}
+			if err := base.Mailer.PublishHandoff(clientId, replicaId, handoff); err != nil {
+				base.requeueErr = fmt.Errorf("failed to publish the handoff of client %d: %v", clientId, err)
+				return
+			}
+		}
+
+		base.Mailer.toDrop(clientId, rescales)
+	}
+
+	if err := base.Mailer.PublishRescale(clientId, rescale); err != nil {
+		base.Log.Errorf("failed to publish message: %v", err)
+	}
+
+	base.Mailer.Complete(clientId)
+}
+
+// Takes over the state handed by another replica of the stage
+func (base *Worker) takeOver(w IWorker, qId int, del middleware.Delivery) {
+	clientId := del.Headers.ClientId
+	handoff, err := comms.DecodeHandoff(del.Body)
+	if err != nil {
+		base.DeadLetter(qId, del, err)
+		return
+	}
+
+	migrator, ok := w.(Migrator)
+	if !ok {
+		base.Log.Errorf("received a handoff for client %d but the worker has no state to take over", clientId)
+		return
+	}
+
+	replicaId := del.Headers.ReplicaId
+	if !base.Mailer.HandedOver(clientId, handoff.Epoch, replicaId) {
+		return
+	}
+
+	// Handoffs are out of the sequence of their replica, they're told apart by their epoch
+	id := middleware.DelId{
+		ReplicaId: replicaId,
+		Seq:       -handoff.Epoch,
+		ClientId:  clientId,
+		Replayed:  true,
+	}
+
+	if err := migrator.TakeOver(id, handoff.State); err != nil {
+		base.requeueErr = fmt.Errorf("failed to take over the state of client %d: %v", clientId, err)
+		return
+	}
+
+	base.Mailer.Complete(clientId)
+}
+
+// Drops the state that was handed over once the rescale is persisted, so it's handed
+// over the same way if the barrier is handled again after a crash
+func (base *Worker) drop(w IWorker, clientId int) {
+	migrator, ok := w.(Migrator)
+	drops := base.Mailer.drops[clientId]
+	if !ok || len(drops) == 0 {
+		return
+	}
+
+	for _, epoch := range slices.Sorted(maps.Keys(drops)) {
+		if err := migrator.Drop(clientId, drops[epoch]); err != nil {
+			base.Log.Errorf("failed to drop the state handed over by client %d: %v", clientId, err)
+			return
+		}
+		delete(drops, epoch)
+	}
+
+	delete(base.Mailer.drops, clientId)
+	if err := base.Mailer.Dump(clientId); err != nil {
+		base.Log.Errorf("failed to dump the mailer state of client %d: %v", clientId, err)
+	}
+}
+
+// Returns the replicas this one hands the state with the given key over to in the rescale,
+// and whether it keeps it. A replicated state is handed by the first replica that held it to
+// the ones that didn't, a split one by each replica that doesn't hold it anymore
+func Destinations(replicaId int, rescale comms.Rescale, key string) ([]int, bool) {
+	from, replicated := middleware.Placement(rescale, key, rescale.From)
+	to, _ := middleware.Placement(rescale, key, rescale.To)
+	keeps := slices.Contains(to, replicaId)
+
+	if replicated {
+		if from[0] != replicaId {
+			return nil, keeps
+		}
+
+		dests := make([]int, 0, len(to))
+		for _, j := range to {
+			if !slices.Contains(from, j) {
+				dests = append(dests, j)
+			}
+		}
+		return dests, keeps
+	}
+
+	if keeps {
+		return nil, true
+	}
+	return []int{to[replicaId%len(to)]}, false
+}
@@ -17,7 +17,7 @@ import (
 type Sanitize struct {
 	*workers.Worker
 	Con     *config.SanitizeConfig
-	Handler func(*Sanitize, []string) map[string]string
+	Handler func([]string) map[string]string
 }
 
 func New(con *config.SanitizeConfig, log *logging.Logger) (*Sanitize, error) {
@@ -26,15 +26,18 @@ func New(con *config.SanitizeConfig, log *logging.Logger) (*Sanitize, error) {
 		return nil, err
 	}
 
-	handler := map[string]func(*Sanitize, []string) map[string]string{
-		"movies":  handleMovie,
-		"credits": handleCredit,
-		"ratings": handleRating,
-	}[con.Handler]
+	handler := Handlers[con.Handler]
 
 	return &Sanitize{base, con, handler}, nil
 }
 
+// Sanitizes a line of each kind of file, returns nil for the lines that are discarded
+var Handlers = map[string]func([]string) map[string]string{
+	"movies":  SanitizeMovie,
+	"credits": SanitizeCredit,
+	"ratings": SanitizeRating,
+}
+
 func (w *Sanitize) Run() error {
 	return w.Worker.Run(w)
 }
@@ -73,7 +76,7 @@ func isValidRow(fields map[string]string) bool {
 	return true
 }
 
-func handleMovie(w *Sanitize, line []string) map[string]string {
+func SanitizeMovie(line []string) map[string]string {
 	if len(line) != 24 {
 		return nil
 	}
@@ -119,7 +122,7 @@ func handleMovie(w *Sanitize, line []string) map[string]string {
 	return fieldMap
 }
 
-func handleRating(w *Sanitize, line []string) map[string]string {
+func SanitizeRating(line []string) map[string]string {
 	if len(line) != 4 {
 		return nil
 	}
@@ -133,10 +136,15 @@ func handleRating(w *Sanitize, line []string) map[string]string {
 		return nil
 	}
 
+	// Only needed by windowed aggregations, a missing one doesn't discard the rating
+	if len(line[3]) > 0 {
+		fields["timestamp"] = line[3]
+	}
+
 	return fields
 }
 
-func handleCredit(w *Sanitize, line []string) map[string]string {
+func SanitizeCredit(line []string) map[string]string {
 	if len(line) != 3 {
 		return nil
 	}
@@ -171,7 +179,7 @@ func (w *Sanitize) Batch(qId int, del middleware.Delivery) {
 			break
 		}
 
-		if responseFieldMap := w.Handler(w, line); responseFieldMap != nil {
+		if responseFieldMap := w.Handler(line); responseFieldMap != nil {
 			responseFieldMaps = append(responseFieldMaps, responseFieldMap)
 		}
 	}
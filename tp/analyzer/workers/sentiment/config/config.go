@@ -1,11 +1,24 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+
 	"analyzer/workers/config"
 )
 
+// How the overviews are scored, the verifier reads it too to classify them the same way
+type ScorerConfig struct {
+	Scorer           string
+	LexiconFile      string
+	NeutralThreshold float64
+}
+
 type SentimentConfig struct {
 	config.Config
+	ScorerConfig
 }
 
 func Create() (*SentimentConfig, error) {
@@ -14,5 +27,40 @@ func Create() (*SentimentConfig, error) {
 		return nil, err
 	}
 
-	return &SentimentConfig{Config: con}, nil
+	scorerCon, err := CreateScorer()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SentimentConfig{con, scorerCon}, nil
+}
+
+func CreateScorer() (ScorerConfig, error) {
+	// SCORER
+	scorer := os.Getenv("SCORER")
+	if len(scorer) == 0 {
+		scorer = "bayes"
+	}
+	validScorers := []string{"bayes", "lexicon"}
+	if !slices.Contains(validScorers, scorer) {
+		return ScorerConfig{}, fmt.Errorf("the given scorer is invalid %v", scorer)
+	}
+
+	// LEXICON_FILE
+	lexiconFile := os.Getenv("LEXICON_FILE")
+
+	// NEUTRAL_THRESHOLD
+	neutralThreshold := 0.0
+	if thresholdVar := os.Getenv("NEUTRAL_THRESHOLD"); len(thresholdVar) > 0 {
+		var err error
+		neutralThreshold, err = strconv.ParseFloat(thresholdVar, 64)
+		if err != nil {
+			return ScorerConfig{}, fmt.Errorf("the neutral threshold is invalid: %v", err)
+		}
+		if neutralThreshold < 0 || neutralThreshold >= 1 {
+			return ScorerConfig{}, fmt.Errorf("the neutral threshold must be between 0 and 1: %f", neutralThreshold)
+		}
+	}
+
+	return ScorerConfig{scorer, lexiconFile, neutralThreshold}, nil
 }
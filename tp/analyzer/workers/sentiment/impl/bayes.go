@@ -0,0 +1,52 @@
+package impl
+
+import (
+	"math"
+
+	"github.com/cdipaolo/goml/base"
+	"github.com/cdipaolo/goml/text"
+	"github.com/cdipaolo/sentiment"
+	"golang.org/x/text/transform"
+)
+
+const SCORER_BAYES = "bayes"
+
+// The pre-trained naive Bayes model of the sentiment library, for english
+type Bayes struct {
+	model    *text.NaiveBayes
+	sanitize transform.Transformer
+}
+
+func NewBayes() (*Bayes, error) {
+	models, err := sentiment.Restore()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bayes{models[sentiment.English], transform.RemoveFunc(base.OnlyWords)}, nil
+}
+
+// Same log likelihoods as the model's Predict, which only gives the class,
+// so the score is the difference between the probabilities of both classes
+func (b *Bayes) Score(overview string) float64 {
+	sums := make([]float64, len(b.model.Count))
+
+	overview, _, _ = transform.String(b.sanitize, overview)
+	for _, word := range b.model.Tokenizer.Tokenize(overview) {
+		w, ok := b.model.Words.Get(word)
+		if !ok {
+			continue
+		}
+
+		for i := range sums {
+			sums[i] += math.Log(float64(w.Count[i]+1) / float64(w.Seen+b.model.DictCount))
+		}
+	}
+
+	for i := range sums {
+		sums[i] += math.Log(b.model.Probabilities[i])
+	}
+
+	// P(positive) - P(negative), keeps the sign of the difference however small it is
+	return math.Tanh((sums[1] - sums[0]) / 2)
+}
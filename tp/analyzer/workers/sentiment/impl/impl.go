@@ -2,20 +2,21 @@ package impl
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 
 	"analyzer/comms"
 	"analyzer/comms/middleware"
 	"analyzer/workers"
 	"analyzer/workers/sentiment/config"
 
-	"github.com/cdipaolo/sentiment"
 	"github.com/op/go-logging"
 )
 
 type Sentiment struct {
 	*workers.Worker
-	Con   *config.SentimentConfig
-	Model sentiment.Models
+	Con    *config.SentimentConfig
+	Scorer Scorer
 }
 
 func New(con *config.SentimentConfig, log *logging.Logger) (*Sentiment, error) {
@@ -24,12 +25,12 @@ func New(con *config.SentimentConfig, log *logging.Logger) (*Sentiment, error) {
 		return nil, err
 	}
 
-	model, err := sentiment.Restore()
+	scorer, err := NewScorer(con.Scorer, con.LexiconFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Sentiment{base, con, model}, nil
+	return &Sentiment{base, con, scorer}, nil
 }
 
 func (w *Sentiment) Run() error {
@@ -46,15 +47,11 @@ func handleSentiment(w *Sentiment, fieldMap map[string]string) (map[string]strin
 		return nil, nil
 	}
 
-	analysis := w.Model.SentimentAnalysis(overview, sentiment.English)
-	var result string
-	if analysis.Score == 0 {
-		result = "negative"
-	} else {
-		result = "positive"
-	}
+	score := w.Scorer.Score(overview)
 
-	fieldMap["sentiment"] = result
+	fieldMap["sentiment"] = Classify(score, w.Con.NeutralThreshold)
+	fieldMap["sentiment_score"] = strconv.FormatFloat(score, 'f', 4, 64)
+	fieldMap["confidence"] = strconv.FormatFloat(math.Abs(score), 'f', 4, 64)
 	return fieldMap, nil
 }
 
@@ -64,7 +61,8 @@ func (w *Sentiment) Batch(qId int, del middleware.Delivery) {
 
 	batch, err := comms.DecodeBatch(body)
 	if err != nil {
-		w.Log.Fatal("failed to decode batch: %v", err)
+		w.DeadLetter(qId, del, err)
+		return
 	}
 	responseFieldMaps := make([]map[string]string, 0, len(batch.FieldMaps))
 
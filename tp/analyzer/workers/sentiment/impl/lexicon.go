@@ -0,0 +1,170 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const SCORER_LEXICON = "lexicon"
+
+// English lexicon used when no other file is given
+//
+//go:embed lexicon.tsv
+var defaultLexicon []byte
+
+// Heuristics of VADER, a rule based scorer for short texts
+const (
+	// Added to the valence of the word that follows
+	BOOSTER_INCREMENT = 0.293
+	// Words in all caps within a text that isn't
+	CAPS_INCREMENT = 0.733
+	// A negation in the 3 words before flips and dampens the valence
+	NEGATION_SCALAR = -0.74
+	NEGATION_WINDOW = 3
+	// Words before a "but" weigh less and the ones after it more
+	BUT_BEFORE_SCALAR = 0.5
+	BUT_AFTER_SCALAR  = 1.5
+	// Added for each of the first 4 exclamation marks
+	EXCLAMATION_INCREMENT = 0.292
+	// Normalizes the sum of valences to (-1, 1)
+	NORMALIZATION_ALPHA = 15
+)
+
+var boosters = map[string]float64{
+	"absolutely": 1, "completely": 1, "deeply": 1, "extremely": 1, "highly": 1, "incredibly": 1,
+	"really": 1, "so": 1, "totally": 1, "truly": 1, "very": 1, "most": 1, "more": 1,
+	"barely": -1, "hardly": -1, "less": -1, "little": -1, "slightly": -1, "somewhat": -1,
+}
+
+var negations = map[string]struct{}{
+	"not": {}, "no": {}, "never": {}, "none": {}, "nobody": {}, "nothing": {}, "neither": {}, "nor": {},
+	"without": {}, "cannot": {}, "cant": {}, "dont": {}, "doesnt": {}, "didnt": {}, "isnt": {}, "wasnt": {},
+	"arent": {}, "werent": {}, "wont": {}, "wouldnt": {}, "shouldnt": {}, "couldnt": {},
+}
+
+// Scores with a lexicon of word valences, a file with a "<word>\t<valence>"
+// line per word, so other languages only need another file
+type Lexicon struct {
+	valences map[string]float64
+}
+
+func NewLexicon(path string) (*Lexicon, error) {
+	var r io.Reader = bytes.NewReader(defaultLexicon)
+	if len(path) > 0 {
+		fp, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		r = fp
+	}
+
+	valences := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid lexicon line: %q", line)
+		}
+		valence, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid valence in lexicon line %q: %v", line, err)
+		}
+		valences[strings.ToLower(fields[0])] = valence
+	}
+
+	return &Lexicon{valences}, scanner.Err()
+}
+
+type lexToken struct {
+	word string
+	caps bool
+}
+
+func tokenize(text string) []lexToken {
+	tokens := make([]lexToken, 0)
+	for field := range strings.FieldsSeq(text) {
+		word := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, field)
+		if len(word) == 0 {
+			continue
+		}
+
+		caps := len(word) > 1 && strings.ToUpper(word) == word && strings.ToLower(word) != word
+		tokens = append(tokens, lexToken{strings.ToLower(word), caps})
+	}
+	return tokens
+}
+
+func (l *Lexicon) Score(text string) float64 {
+	tokens := tokenize(text)
+
+	// Emphasis by caps only counts when the rest of the text isn't shouting
+	allCaps := true
+	for _, t := range tokens {
+		allCaps = allCaps && t.caps
+	}
+
+	butAt := -1
+	for i, t := range tokens {
+		if t.word == "but" {
+			butAt = i
+		}
+	}
+
+	sum := 0.0
+	for i, t := range tokens {
+		valence, ok := l.valences[t.word]
+		if !ok {
+			continue
+		}
+
+		if t.caps && !allCaps {
+			valence += math.Copysign(CAPS_INCREMENT, valence)
+		}
+
+		for j := max(0, i-NEGATION_WINDOW); j < i; j++ {
+			prev := tokens[j].word
+			if boost, ok := boosters[prev]; ok && j == i-1 {
+				valence += math.Copysign(BOOSTER_INCREMENT*boost, valence)
+			}
+			if _, ok := negations[prev]; ok {
+				valence *= NEGATION_SCALAR
+			}
+		}
+
+		if butAt >= 0 {
+			if i < butAt {
+				valence *= BUT_BEFORE_SCALAR
+			} else if i > butAt {
+				valence *= BUT_AFTER_SCALAR
+			}
+		}
+
+		sum += valence
+	}
+
+	// Exclamations add emphasis in the direction of the text
+	if sum != 0 {
+		sum += math.Copysign(EXCLAMATION_INCREMENT*float64(min(strings.Count(text, "!"), 4)), sum)
+	}
+
+	return sum / math.Sqrt(sum*sum+NORMALIZATION_ALPHA)
+}
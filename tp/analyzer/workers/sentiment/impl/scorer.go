@@ -0,0 +1,39 @@
+package impl
+
+import (
+	"fmt"
+)
+
+const (
+	POSITIVE = "positive"
+	NEGATIVE = "negative"
+	NEUTRAL  = "neutral"
+)
+
+// Scores a text between -1 (negative) and 1 (positive), its absolute value
+// is how confident the scorer is
+type Scorer interface {
+	Score(text string) float64
+}
+
+func NewScorer(name string, lexiconFile string) (Scorer, error) {
+	switch name {
+	case SCORER_BAYES:
+		return NewBayes()
+	case SCORER_LEXICON:
+		return NewLexicon(lexiconFile)
+	}
+	return nil, fmt.Errorf("unknown scorer %v", name)
+}
+
+// Scores within the threshold are neutral, without a threshold a score
+// of 0 is negative as the naive Bayes model breaks ties
+func Classify(score float64, threshold float64) string {
+	switch {
+	case score > threshold:
+		return POSITIVE
+	case score < -threshold || threshold == 0:
+		return NEGATIVE
+	}
+	return NEUTRAL
+}
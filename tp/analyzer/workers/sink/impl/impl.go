@@ -32,7 +32,8 @@ func (w *Sink) Batch(qId int, del middleware.Delivery) {
 
 	batch, err := comms.DecodeBatch(body)
 	if err != nil {
-		w.Log.Fatal("failed to decode batch: %v", err)
+		w.DeadLetter(qId, del, err)
+		return
 	}
 	responseFieldMaps := batch.FieldMaps
 
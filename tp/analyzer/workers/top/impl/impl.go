@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"maps"
+	"slices"
 	"sort"
 	"strconv"
 
@@ -81,6 +83,11 @@ func handleTop(w *Top, clientId int, fieldMap map[string]string) error {
 		return err
 	}
 
+	// When merging partial tops the same row could come more than once
+	if slices.ContainsFunc(w.tops[clientId], func(tup tuple) bool { return maps.Equal(tup.fieldMap, fieldMap) }) {
+		return nil
+	}
+
 	top := append(w.tops[clientId], tuple{value, fieldMap})
 
 	sort.Slice(top, func(i, j int) bool {
@@ -136,7 +143,8 @@ func (w *Top) Batch(qId int, del middleware.Delivery) {
 
 	batch, err := comms.DecodeBatch(body)
 	if err != nil {
-		w.Log.Fatal("failed to decode batch: %v", err)
+		w.DeadLetter(qId, del, err)
+		return
 	}
 
 	// Check for duplicated deliveries
@@ -2,20 +2,28 @@ package workers
 
 import (
 	"fmt"
+	"maps"
 	"math/rand"
 	"os"
 	"os/signal"
 	"reflect"
+	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
 	checker "analyzer/checker/impl"
 	"analyzer/comms"
+	"analyzer/comms/chaos"
 	"analyzer/comms/middleware"
 	"analyzer/workers/config"
 
 	"github.com/op/go-logging"
 )
 
+// Time between samples of the input queues' lag, keep-alives report the last one
+const LAG_SAMPLE_INTERVAL = 2 * time.Second
+
 type IWorker interface {
 	Batch(int, middleware.Delivery)
 	Eof(int, middleware.Delivery)
@@ -29,9 +37,48 @@ type Worker struct {
 	Mailer    *Mailer
 	recvCases []reflect.SelectCase
 	con       config.Config
+	progress  progress
+
+	// Set when the delivery being handled couldn't be dead lettered, parked or handed
+	// over, it's requeued and the worker stops
+	requeueErr error
+}
+
+// Progress made by the worker, reported to the health checkers
+type progress struct {
+	mu           sync.Mutex
+	seqs         map[string]int
+	lastDelivery time.Time
+	busySince    time.Time
+	processed    uint64
+	lag          int
+	held         int
+}
+
+func (p *progress) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busySince = time.Now()
+}
+
+func (p *progress) done(qName string, seq int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.seqs[qName] = seq
+	p.lastDelivery = now
+	p.busySince = time.Time{}
+	p.processed++
 }
 
 func New(con config.Config, log *logging.Logger) (*Worker, error) {
+	if len(con.ChaosScenario) > 0 {
+		if err := chaos.Init(con.ChaosScenario, con.NodeName, log); err != nil {
+			return nil, err
+		}
+	}
+
 	mailer, err := NewMailer(con, log)
 	if err != nil {
 		return nil, err
@@ -66,20 +113,113 @@ func New(con config.Config, log *logging.Logger) (*Worker, error) {
 		Mailer:    mailer,
 		recvCases: cases,
 		con:       con,
+		progress: progress{
+			seqs:         make(map[string]int),
+			lastDelivery: time.Now(),
+		},
 	}, nil
 }
 
+// Dead letters a delivery of the `qId`th input queue that can't be processed, so it
+// doesn't take the worker down. It's acked along with the rest once it's confirmed.
+// If it can't be published the delivery is requeued instead of acked, and the
+// worker stops so it's processed again after the restart
+func (base *Worker) DeadLetter(qId int, del middleware.Delivery, reason error) error {
+	base.Log.Errorf("dead lettering delivery %v from qId %d: %v", del.Id(), qId, reason)
+	if err := base.Mailer.PublishDeadLetter(qId, del, reason); err != nil {
+		base.requeueErr = fmt.Errorf("failed to dead letter delivery %v: %v", del.Id(), err)
+		return base.requeueErr
+	}
+	return nil
+}
+
+// Reports the worker's progress, called by the acker on every keep-alive
+func (base *Worker) health() checker.Health {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	p := &base.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	busy := time.Duration(0)
+	if !p.busySince.IsZero() {
+		busy = now.Sub(p.busySince)
+	}
+
+	return checker.Health{
+		Seqs:      maps.Clone(p.seqs),
+		Idle:      now.Sub(p.lastDelivery),
+		Busy:      busy,
+		Lag:       p.lag,
+		Memory:    mem.HeapAlloc,
+		Processed: p.processed,
+		Held:      p.held,
+	}
+}
+
+// Samples the input queues' lag in the background so keep-alives don't wait on the
+// broker, along with the deliveries held by the receivers
+func (base *Worker) sampleLag(stop <-chan struct{}) {
+	ticker := time.NewTicker(LAG_SAMPLE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		held := base.Mailer.Held()
+		lag, err := base.Mailer.Lag()
+		if err != nil {
+			base.Log.Errorf("couldn't get the input queues' lag: %v", err)
+		}
+
+		base.progress.mu.Lock()
+		if err == nil {
+			base.progress.lag = lag
+		}
+		base.progress.held = held
+		base.progress.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
 func (base *Worker) Run(w IWorker) error {
 	base.Log.Infof("Running...")
 	cases := base.recvCases
 
-	acker, err := checker.SpawnAcker(base.con.HealthCheckPort, base.con.KeepAliveRetries, base.Log)
+	acker, err := checker.SpawnHealthAcker(base.con.HealthCheckPort, base.con.KeepAliveRetries, base.Log, base.health)
 	if err != nil {
 		return fmt.Errorf("failed to spawn acker: %v", err)
 	}
 	defer acker.Stop()
 
+	stopSampling := make(chan struct{})
+	defer close(stopSampling)
+	go base.sampleLag(stopSampling)
+
+	// The state handed over right before a crash is dropped first
+	_, base.Mailer.migrates = w.(Migrator)
+	for clientId := range maps.Clone(base.Mailer.drops) {
+		base.drop(w, clientId)
+	}
+
 	for {
+		// The deliveries parked during a rescale go before the ones in the queues
+		parked, ok, err := base.Mailer.NextParked()
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := base.replay(w, parked); err != nil {
+				return err
+			}
+			continue
+		}
+
 		qId, value, ok := reflect.Select(cases)
 		if !ok {
 			return fmt.Errorf("ok in reflective select is false, channel got closed unexpectedly for qId %d", qId)
@@ -91,30 +231,36 @@ func (base *Worker) Run(w IWorker) error {
 		}
 
 		base.RussianRoulette("[Recv, Process + Send]")
+		chaos.Point(chaos.POINT_RECV)
 		del := value.Interface().(middleware.Delivery)
 		kind := del.Headers.Kind
+		base.progress.start()
 
 		// Process + Send
-		switch kind {
-		case comms.BATCH:
-			w.Batch(qId, del)
-		case comms.EOF:
-			w.Eof(qId, del)
-		case comms.FLUSH:
-			w.Flush(qId, del)
-		case comms.PURGE:
-			w.Purge(qId, del)
-		default:
-			base.Log.Errorf("received an unknown message kind %v", kind)
+		base.handle(w, qId, del, false)
+
+		// A delivery that couldn't be parked is given back before persisting anything
+		if err := base.requeueErr; err != nil {
+			if nackErr := del.Nack(); nackErr != nil {
+				base.Log.Errorf("couldn't requeue delivery: %v", nackErr)
+			}
+			return err
+		}
+
+		// Confirm
+		if err := base.Mailer.Confirm(); err != nil {
+			return fmt.Errorf("couldn't confirm published messages: %v", err)
 		}
 
 		base.RussianRoulette("[Process + Send, Dump]")
+		chaos.Point(chaos.POINT_PROCESS)
 		clientId := del.Headers.ClientId
 
 		// Dump
 		switch kind {
-		case comms.BATCH, comms.EOF:
+		case comms.BATCH, comms.EOF, comms.RESCALE, comms.HANDOFF:
 			base.Mailer.Dump(clientId)
+			base.drop(w, clientId)
 		case comms.FLUSH:
 			base.Mailer.Flush(clientId)
 		case comms.PURGE:
@@ -124,14 +270,88 @@ func (base *Worker) Run(w IWorker) error {
 		}
 
 		base.RussianRoulette("[Dump, Ack]")
+		chaos.Point(chaos.POINT_DUMP)
 
 		// Ack
+		// The broker's connection might have been restored since the delivery was
+		// received, it'll be delivered again and discarded as it's already persisted
 		if err := del.Ack(false); err != nil {
-			return fmt.Errorf("couldn't acknowledge delivery: %v", err)
+			base.Log.Errorf("couldn't acknowledge delivery: %v", err)
 		}
+
+		base.progress.done(base.Mailer.inputQs[qId-1].Name, del.Headers.Seq)
 	}
 }
 
+// Processes a delivery of the `qId`th input queue, unless it has to wait for a rescale
+// that isn't done. Parked deliveries that are handled again may have to wait for a later one
+func (base *Worker) handle(w IWorker, qId int, del middleware.Delivery, replayed bool) {
+	kind := del.Headers.Kind
+	clientId := del.Headers.ClientId
+
+	if kind == comms.RESCALE {
+		if rescale, err := comms.DecodeRescale(del.Body); err == nil {
+			base.Mailer.Join(clientId, rescale)
+		}
+	}
+
+	parks := base.Mailer.Parks(del)
+	if replayed {
+		parks = base.Mailer.parksAgain(del)
+	}
+	if parks {
+		if err := base.Mailer.Park(qId, del, replayed); err != nil {
+			base.requeueErr = fmt.Errorf("failed to park delivery %v: %v", del.Id(), err)
+		}
+		return
+	}
+
+	if kind != comms.RESCALE && kind != comms.HANDOFF {
+		base.Mailer.Observe(del)
+	}
+
+	switch kind {
+	case comms.BATCH:
+		w.Batch(qId, del)
+	case comms.EOF:
+		w.Eof(qId, del)
+	case comms.FLUSH:
+		w.Flush(qId, del)
+	case comms.PURGE:
+		w.Purge(qId, del)
+	case comms.RESCALE:
+		base.rescale(w, qId, del)
+	case comms.HANDOFF:
+		base.takeOver(w, qId, del)
+	default:
+		base.Log.Errorf("received an unknown message kind %v", kind)
+	}
+}
+
+// Handles a delivery that was parked, it was already acked. If it can't be handled the
+// worker stops and it's handled again after the restart
+func (base *Worker) replay(w IWorker, parked parkedDelivery) error {
+	del := parked.del
+	clientId := del.Headers.ClientId
+	base.progress.start()
+
+	base.handle(w, parked.qId, del, true)
+	if err := base.requeueErr; err != nil {
+		return err
+	}
+
+	if err := base.Mailer.Confirm(); err != nil {
+		return fmt.Errorf("couldn't confirm published messages: %v", err)
+	}
+
+	base.Mailer.Replayed(clientId)
+	base.Mailer.Dump(clientId)
+	base.drop(w, clientId)
+
+	base.progress.done(base.Mailer.inputQs[parked.qId-1].Name, del.Headers.Seq)
+	return nil
+}
+
 func (w *Worker) RussianRoulette(format string, args ...any) {
 	threshold := w.con.RussianRouletteChance
 	r := rand.Float64()
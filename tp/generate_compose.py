@@ -1,7 +1,6 @@
 import json
 import sys
 import math
-import random
 from pathlib import Path
 
 PIPELINE_COMPOSE_FILE_NAME = "compose.yaml"
@@ -10,9 +9,9 @@ CHECKERS_COMPOSE_FILE_NAME = "compose.checkers.yaml"
 
 # unscalable
 GATEWAY = 1
-TOP_10_COUNT = 1
-TOP_5_BUDGET = 1
-MINMAX_RATING = 1
+TOP_10_COUNT_MERGE = 1
+TOP_5_BUDGET_MERGE = 1
+MINMAX_RATING_MERGE = 1
 
 
 def generate_pipeline_compose(
@@ -24,14 +23,17 @@ def generate_pipeline_compose(
     filter_production_countries_argentina,
     filter_release_date_since_2000,
     filter_release_date_upto_2010,
-    explode_production_countries,
-    explode_cast,
+    project_production_countries,
+    project_cast,
     groupby_sentiment_mean_rate_revenue_budget,
     groupby_country_sum_budget,
     groupby_actor_count,
     groupby_id_title_mean_rating,
-    divider,
+    project_revenue_budget,
     sentiment,
+    top_10_count,
+    top_5_budget,
+    minmax_rating,
     sink_1,
     sink_2,
     sink_3,
@@ -72,6 +74,8 @@ services:
     depends_on:
       rabbitmq:
         condition: service_healthy
+    volumes:
+      - ./configs/gateway/scale:/scale
     env_file:
       - configs/gateway/.env
     environment:
@@ -98,7 +102,7 @@ services:
     environment:
       - ID={i}
       - INPUT_COPIES={GATEWAY}
-      - OUTPUT_COPIES={divider},{filter_production_countries_length},{filter_release_date_since_2000}
+      - OUTPUT_COPIES={project_revenue_budget},{filter_production_countries_length},{filter_release_date_since_2000}
 """
 
     for i in range(sanitize_credits):
@@ -159,7 +163,7 @@ services:
     environment:
       - ID={i}
       - INPUT_COPIES={sanitize_movies}
-      - OUTPUT_COPIES={explode_production_countries}
+      - OUTPUT_COPIES={project_production_countries}
 """
 
     for i in range(filter_release_date_since_2000):
@@ -242,13 +246,13 @@ services:
       - OUTPUT_COPIES={filter_release_date_upto_2010}
 """
 
-    docker_compose += "\n# ======================= Explodes =======================\n"
-    for i in range(explode_cast):
+    docker_compose += "\n# ======================= Projects =======================\n"
+    for i in range(project_cast):
         docker_compose += f"""
-  explode-cast-{i}:
-    container_name: explode-cast-{i}
+  project-cast-{i}:
+    container_name: project-cast-{i}
     build:
-      dockerfile: build/explode.Dockerfile
+      dockerfile: build/project.Dockerfile
     networks:
       - my-network
     depends_on:
@@ -256,19 +260,19 @@ services:
         condition: service_healthy
     env_file:
       - configs/workers/.env
-      - configs/workers/explode/.env.cast
+      - configs/workers/project/.env.cast
     environment:
       - ID={i}
       - INPUT_COPIES={join_id_id}
       - OUTPUT_COPIES={groupby_actor_count}
 """
 
-    for i in range(explode_production_countries):
+    for i in range(project_production_countries):
         docker_compose += f"""
-  explode-production_countries-{i}:
-    container_name: explode-production_countries-{i}
+  project-production_countries-{i}:
+    container_name: project-production_countries-{i}
     build:
-      dockerfile: build/explode.Dockerfile
+      dockerfile: build/project.Dockerfile
     networks:
       - my-network
     depends_on:
@@ -276,7 +280,7 @@ services:
         condition: service_healthy
     env_file:
       - configs/workers/.env
-      - configs/workers/explode/.env.production_countries
+      - configs/workers/project/.env.production_countries
     environment:
       - ID={i}
       - INPUT_COPIES={filter_production_countries_length}
@@ -301,7 +305,7 @@ services:
     environment:
       - ID={i}
       - INPUT_COPIES={join_id_movieid}
-      - OUTPUT_COPIES={MINMAX_RATING}
+      - OUTPUT_COPIES={minmax_rating}
 """
 
     for i in range(groupby_sentiment_mean_rate_revenue_budget):
@@ -340,8 +344,8 @@ services:
       - configs/workers/groupby/.env.country_sum_budget
     environment:
       - ID={i}
-      - INPUT_COPIES={explode_production_countries}
-      - OUTPUT_COPIES={TOP_5_BUDGET}
+      - INPUT_COPIES={project_production_countries}
+      - OUTPUT_COPIES={top_5_budget}
 """
 
     for i in range(groupby_actor_count):
@@ -360,17 +364,17 @@ services:
       - configs/workers/groupby/.env.actor_count
     environment:
       - ID={i}
-      - INPUT_COPIES={explode_cast}
-      - OUTPUT_COPIES={TOP_10_COUNT}
+      - INPUT_COPIES={project_cast}
+      - OUTPUT_COPIES={top_10_count}
 """
 
-    docker_compose += "\n# ======================= Dividers =======================\n"
-    for i in range(divider):
+    docker_compose += "\n# ======================= Projects =======================\n"
+    for i in range(project_revenue_budget):
         docker_compose += f"""
-  divider-{i}:
-    container_name: divider-{i}
+  project-revenue_budget-{i}:
+    container_name: project-revenue_budget-{i}
     build:
-      dockerfile: build/divider.Dockerfile
+      dockerfile: build/project.Dockerfile
     networks:
       - my-network
     depends_on:
@@ -378,7 +382,7 @@ services:
         condition: service_healthy
     env_file:
       - configs/workers/.env
-      - configs/workers/divider/.env.revenue_budget
+      - configs/workers/project/.env.revenue_budget
     environment:
       - ID={i}
       - INPUT_COPIES={sanitize_movies}
@@ -402,12 +406,12 @@ services:
       - configs/workers/sentiment/.env.overview
     environment:
       - ID={i}
-      - INPUT_COPIES={divider}
+      - INPUT_COPIES={project_revenue_budget}
       - OUTPUT_COPIES={groupby_sentiment_mean_rate_revenue_budget}
 """
 
     docker_compose += "\n# ======================= Tops =======================\n"
-    for i in range(TOP_10_COUNT):
+    for i in range(top_10_count):
         docker_compose += f"""
   top-10_count-{i}:
     container_name: top-10_count-{i}
@@ -424,10 +428,10 @@ services:
     environment:
       - ID={i}
       - INPUT_COPIES={groupby_actor_count}
-      - OUTPUT_COPIES={sink_4}
+      - OUTPUT_COPIES={TOP_10_COUNT_MERGE}
 """
 
-    for i in range(TOP_5_BUDGET):
+    for i in range(top_5_budget):
         docker_compose += f"""
   top-5_budget-{i}:
     container_name: top-5_budget-{i}
@@ -444,11 +448,52 @@ services:
     environment:
       - ID={i}
       - INPUT_COPIES={groupby_country_sum_budget}
+      - OUTPUT_COPIES={TOP_5_BUDGET_MERGE}
+"""
+
+    # The partial tops are merged by a single replica
+    for i in range(TOP_10_COUNT_MERGE):
+        docker_compose += f"""
+  top-10_count_merge-{i}:
+    container_name: top-10_count_merge-{i}
+    build:
+      dockerfile: build/top.Dockerfile
+    networks:
+      - my-network
+    depends_on:
+      rabbitmq:
+        condition: service_healthy
+    env_file:
+      - configs/workers/.env
+      - configs/workers/top/.env.10_count_merge
+    environment:
+      - ID={i}
+      - INPUT_COPIES={top_10_count}
+      - OUTPUT_COPIES={sink_4}
+"""
+
+    for i in range(TOP_5_BUDGET_MERGE):
+        docker_compose += f"""
+  top-5_budget_merge-{i}:
+    container_name: top-5_budget_merge-{i}
+    build:
+      dockerfile: build/top.Dockerfile
+    networks:
+      - my-network
+    depends_on:
+      rabbitmq:
+        condition: service_healthy
+    env_file:
+      - configs/workers/.env
+      - configs/workers/top/.env.5_budget_merge
+    environment:
+      - ID={i}
+      - INPUT_COPIES={top_5_budget}
       - OUTPUT_COPIES={sink_2}
 """
 
     docker_compose += "\n# ======================= MinMax =======================\n"
-    for i in range(MINMAX_RATING):
+    for i in range(minmax_rating):
         docker_compose += f"""
   minmax-rating-{i}:
     container_name: minmax-rating-{i}
@@ -465,6 +510,27 @@ services:
     environment:
       - ID={i}
       - INPUT_COPIES={groupby_id_title_mean_rating}
+      - OUTPUT_COPIES={MINMAX_RATING_MERGE}
+"""
+
+    # The partial minmaxs are merged by a single replica
+    for i in range(MINMAX_RATING_MERGE):
+        docker_compose += f"""
+  minmax-rating_merge-{i}:
+    container_name: minmax-rating_merge-{i}
+    build:
+      dockerfile: build/minmax.Dockerfile
+    networks:
+      - my-network
+    depends_on:
+      rabbitmq:
+        condition: service_healthy
+    env_file:
+      - configs/workers/.env
+      - configs/workers/minmax/.env.rating_merge
+    environment:
+      - ID={i}
+      - INPUT_COPIES={minmax_rating}
       - OUTPUT_COPIES={sink_3}
 """
 
@@ -506,7 +572,7 @@ services:
     environment:
       - ID={i}
       - INPUT_COPIES={filter_production_countries_argentina},{sanitize_credits}
-      - OUTPUT_COPIES={explode_cast}
+      - OUTPUT_COPIES={project_cast}
 """
 
     docker_compose += "\n# ======================= Sinks =======================\n"
@@ -546,7 +612,7 @@ services:
       - configs/workers/sink/.env.2
     environment:
       - ID={i}
-      - INPUT_COPIES={TOP_5_BUDGET}
+      - INPUT_COPIES={TOP_5_BUDGET_MERGE}
       - OUTPUT_COPIES={GATEWAY}
 """
 
@@ -566,7 +632,7 @@ services:
       - configs/workers/sink/.env.3
     environment:
       - ID={i}
-      - INPUT_COPIES={MINMAX_RATING}
+      - INPUT_COPIES={MINMAX_RATING_MERGE}
       - OUTPUT_COPIES={GATEWAY}
 """
 
@@ -586,7 +652,7 @@ services:
       - configs/workers/sink/.env.4
     environment:
       - ID={i}
-      - INPUT_COPIES={TOP_10_COUNT}
+      - INPUT_COPIES={TOP_10_COUNT_MERGE}
       - OUTPUT_COPIES={GATEWAY}
 """
 
@@ -644,19 +710,12 @@ networks:
     return docker_compose
 
 
-def chunks(arr, r):
-    for i in range(0, len(arr), r):
-        bot = i
-        top = min(i + r, len(arr))
-        yield arr[bot:top]
-
-
 def generate_checkers_compose(config: dict[str, int]):
     nodes = [
         "gateway",
-        "top-10_count-0",
-        "top-5_budget-0",
-        "minmax-rating-0",
+        "top-10_count_merge-0",
+        "top-5_budget_merge-0",
+        "minmax-rating_merge-0",
     ]
 
     for kind, replicas in config.items():
@@ -667,10 +726,8 @@ def generate_checkers_compose(config: dict[str, int]):
         for i in range(replicas):
             nodes.append(f"{name}-{i}")
 
-    random.shuffle(nodes)
+    # Every checker knows every node, the elected leader splits them
     ncheckers = math.ceil(len(nodes) / 10)
-    partition_size = math.ceil(len(nodes) / ncheckers)
-    watch_nodes_chunks = list(chunks(nodes, partition_size))
     host_name = "checker"
 
     docker_compose = f"""name: checkers
@@ -683,6 +740,8 @@ services:"""
       dockerfile: build/checker.Dockerfile
     networks:
       - my-network
+    ports:
+      - {8080 + i}:8080
     volumes:
       - /var/run/docker.sock:/var/run/docker.sock
     env_file: configs/checker/.env
@@ -690,7 +749,7 @@ services:"""
       - ID={i}
       - N={ncheckers}
       - HOST_NAME={host_name}
-      - WATCH_NODES={",".join(watch_nodes_chunks[i])}
+      - WATCH_NODES={",".join(nodes)}
 """
     docker_compose += """
 networks: